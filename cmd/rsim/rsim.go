@@ -18,8 +18,10 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/libopenstorage/rico/pkg/allocator/roundrobin"
 	fakecloud "github.com/libopenstorage/rico/pkg/cloudprovider/fake"
@@ -35,6 +37,14 @@ import (
 ca name=small wh=60 wl=10 size=1 max=20 min=10
 
 ca name=large wh=75 wl=25 size=250 max=10240 min=1024
+
+A JSON or YAML configuration file can be passed as an argument. The
+file is watched and changes are applied to the simulation:
+
+rsim rico.yaml
+
+Set journalPath in the file to keep the journal across runs. Operations
+left in it are recovered on startup.
 */
 
 func main() {
@@ -52,8 +62,34 @@ func main() {
 	configuration := &config.Config{
 		Classes: []config.Class{class},
 	}
+	if len(os.Args) > 1 {
+		var err error
+		configuration, err = config.Load(os.Args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 	im := inframanager.NewManager(configuration, fc, fs, rr)
 
+	// Replay the operations left in the journal by a previous run
+	if len(configuration.JournalPath) != 0 {
+		if err := im.Recover(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if len(os.Args) > 1 {
+		watcher := config.NewWatcher(os.Args[1], time.Second, func(c *config.Config) error {
+			_, err := im.SetConfig(c)
+			return err
+		}, im.ClassValidators()...)
+		if _, err := watcher.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer watcher.Stop()
+	}
+
 	// ishell
 	shell := ishell.New()
 	shell.Println("Rico Simulator")
@@ -78,11 +114,58 @@ func main() {
 		Help: "add a node to the storage system",
 	})
 
+	// Node state
+	shell.AddCmd(&ishell.Cmd{
+		Name:    "node-state",
+		Aliases: []string{"ns"},
+		Func: func(c *ishell.Context) {
+			if len(c.Args) < 1 {
+				c.Err(fmt.Errorf("node-state <id> [ready|cordoned|maintenance|decommissioning]"))
+				return
+			}
+			state := topology.NodeState("")
+			if len(c.Args) > 1 {
+				state = topology.NodeState(c.Args[1])
+			}
+			if err := im.SetNodeState(c.Args[0], state); err != nil {
+				c.Err(err)
+				return
+			}
+			c.Println("OK")
+		},
+		Help: "set the state of a node, or clear it if no state is given",
+	})
+
+	// Device health
+	shell.AddCmd(&ishell.Cmd{
+		Name:    "device-health",
+		Aliases: []string{"dh"},
+		Func: func(c *ishell.Context) {
+			if len(c.Args) < 2 {
+				c.Err(fmt.Errorf("device-health <device-id> <healthy|degraded|failed>"))
+				return
+			}
+			t, _ := fs.GetTopology()
+			for _, node := range t.Cluster.StorageNodes {
+				for _, device := range node.Devices {
+					if device.Metadata.ID == c.Args[0] {
+						device.Health = topology.DeviceHealth(c.Args[1])
+						c.Println("OK")
+						return
+					}
+				}
+			}
+			c.Err(fmt.Errorf("device %s not found", c.Args[0]))
+		},
+		Help: "set the health of a device",
+	})
+
 	// Utilization set
 	shell.AddCmd(&ishell.Cmd{
 		Name:    "utilization-set",
 		Aliases: []string{"us"},
 		Func: func(c *ishell.Context) {
+			configuration := im.Config()
 			if len(c.Args) < 2 {
 				c.Err(fmt.Errorf("utilization-set <class-name> <int>"))
 				return
@@ -137,7 +220,25 @@ func main() {
 		Name:    "reconcile",
 		Aliases: []string{"r"},
 		Func: func(c *ishell.Context) {
-			if err := im.Reconcile(); err == nil {
+			result, err := im.Reconcile()
+			if result != nil {
+				for _, cr := range result.Classes {
+					c.Println(cr)
+				}
+				for _, nr := range result.Nodes {
+					c.Println(nr)
+				}
+				for _, rr := range result.Replacements {
+					c.Println(rr)
+				}
+				for _, ar := range result.Adopted {
+					c.Println(ar)
+				}
+				if result.GC != nil {
+					c.Println(result.GC)
+				}
+			}
+			if err == nil {
 				c.Println("OK")
 			} else {
 				c.Err(err)
@@ -146,11 +247,30 @@ func main() {
 		Help: "reconcile once",
 	})
 
+	// Plan
+	shell.AddCmd(&ishell.Cmd{
+		Name:    "plan",
+		Aliases: []string{"p"},
+		Func: func(c *ishell.Context) {
+			actions, err := im.Plan()
+			for _, action := range actions {
+				c.Println(action)
+			}
+			if err != nil {
+				c.Err(err)
+			} else if len(actions) == 0 {
+				c.Println("No changes")
+			}
+		},
+		Help: "show what the next reconcile would do",
+	})
+
 	// List classes
 	shell.AddCmd(&ishell.Cmd{
 		Name:    "class-list",
 		Aliases: []string{"c", "classes"},
 		Func: func(c *ishell.Context) {
+			configuration := im.Config()
 			for _, class := range configuration.Classes {
 				c.Printf("%v\n", class)
 			}
@@ -163,6 +283,7 @@ func main() {
 		Name:    "class-delete",
 		Aliases: []string{"cd"},
 		Func: func(c *ishell.Context) {
+			configuration := im.Config()
 			if len(c.Args) < 1 {
 				c.Err(fmt.Errorf("Missing class name: class-delete <name>"))
 				return
@@ -187,7 +308,10 @@ func main() {
 			// Delete class
 			configuration.Classes[index] = configuration.Classes[len(configuration.Classes)-1]
 			configuration.Classes = configuration.Classes[:len(configuration.Classes)-1]
-			im.SetConfig(configuration)
+			if _, err := im.SetConfig(configuration); err != nil {
+				c.Err(err)
+				return
+			}
 			c.Println("OK")
 		},
 		Help: "delete a class",
@@ -198,6 +322,7 @@ func main() {
 		Name:    "class-add",
 		Aliases: []string{"ca"},
 		Func: func(c *ishell.Context) {
+			configuration := im.Config()
 			if len(c.Args) < 6 {
 				c.Err(fmt.Errorf("Missing arguments: " +
 					"class-add name=<name> " +
@@ -258,24 +383,11 @@ func main() {
 					return
 				}
 			}
-			if len(newClass.Name) == 0 {
-				c.Err(fmt.Errorf("Name missing: name=<name>"))
-				return
-			}
-			if newClass.WatermarkHigh == 0 || newClass.WatermarkLow == 0 {
-				c.Err(fmt.Errorf("Watermarks missing: wh=<int> wl=<int>"))
-				return
-			}
-			if newClass.MinimumTotalSizeGb == 0 || newClass.MaximumTotalSizeGb == 0 {
-				c.Err(fmt.Errorf("Max or min missing: max=<int> min=<int>"))
-				return
-			}
-			if newClass.DiskSizeGb == 0 {
-				c.Err(fmt.Errorf("Size missing: size=<int>"))
+			configuration.Classes = append(configuration.Classes, newClass)
+			if _, err := im.SetConfig(configuration); err != nil {
+				c.Err(err)
 				return
 			}
-			configuration.Classes = append(configuration.Classes, newClass)
-			im.SetConfig(configuration)
 			c.Println("OK")
 		},
 		Help: "add a class",
@@ -31,3 +31,12 @@ type Interface interface {
 	// DetermineNodeToAddStorage returns a node which storage can be added to
 	DetermineNodeToAddStorage(*topology.Topology, *config.Class) (*topology.StorageNode, error)
 }
+
+// Configurable is implemented by allocators which prepare themselves for
+// each configuration applied to the manager
+type Configurable interface {
+
+	// SetConfig is called with the initial configuration and every
+	// configuration applied afterwards
+	SetConfig(*config.Config)
+}
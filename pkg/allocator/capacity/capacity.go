@@ -0,0 +1,121 @@
+/*
+Package capacity provides a utilization aware allocator
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package capacity
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+// Allocator places storage according to the utilization and capacity
+// of each node for the class. Storage is added to the node under the
+// most pressure and removed from the node under the least. Nodes whose
+// class list excludes the class are never considered.
+type Allocator struct{}
+
+// New returns a new capacity aware allocator
+func New() *Allocator {
+	return &Allocator{}
+}
+
+// DetermineNodeToAddStorage returns the node with the highest utilization
+// for the class. Ties are broken by the lowest capacity for the class and
+// then by the least number of devices. Nodes which are not schedulable or
+// are at their device limit are skipped.
+func (a *Allocator) DetermineNodeToAddStorage(
+	t *topology.Topology,
+	class *config.Class,
+) (*topology.StorageNode, error) {
+	var node *topology.StorageNode
+	unavailable := false
+	for _, n := range t.Cluster.StorageNodes {
+		if !n.SupportsClass(class) {
+			continue
+		}
+		if !n.Schedulable() || !n.HasRoomForClass(class) {
+			unavailable = true
+			continue
+		}
+		if node == nil || morePressure(n, node, class) {
+			node = n
+		}
+	}
+	if node == nil && unavailable {
+		return nil, fmt.Errorf("No storage nodes for class %s can take more devices",
+			class.Name)
+	} else if node == nil {
+		return nil, fmt.Errorf("No storage nodes in the cluster support class %s", class.Name)
+	}
+
+	return node, nil
+}
+
+// DetermineStorageToRemove returns the least utilized device of the class
+// on the node with the lowest utilization for the class. Nodes in
+// maintenance are skipped.
+func (a *Allocator) DetermineStorageToRemove(
+	t *topology.Topology,
+	class *config.Class,
+) (*topology.StorageNode, *topology.Pool, *topology.Device) {
+	var node *topology.StorageNode
+	for _, n := range t.Cluster.StorageNodes {
+		if !n.SupportsClass(class) || !n.Removable() ||
+			len(n.DevicesForClass(class)) == 0 {
+			continue
+		}
+		if node == nil || morePressure(node, n, class) {
+			node = n
+		}
+	}
+	if node == nil {
+		return nil, nil, nil
+	}
+
+	devices := node.DevicesForClass(class)
+	pool, ok := node.Pools[class.Name]
+	if ok {
+		devices = node.DevicesOnPool(pool)
+	} else {
+		pool = nil
+	}
+
+	var device *topology.Device
+	for _, d := range devices {
+		if device == nil || d.Utilization < device.Utilization {
+			device = d
+		}
+	}
+	if device == nil {
+		return nil, nil, nil
+	}
+
+	return node, pool, device
+}
+
+// morePressure returns true if node a needs storage for the class more
+// than node b
+func morePressure(a, b *topology.StorageNode, class *config.Class) bool {
+	if ua, ub := a.Utilization(class), b.Utilization(class); ua != ub {
+		return ua > ub
+	}
+	if ca, cb := a.TotalStorage(class), b.TotalStorage(class); ca != cb {
+		return ca < cb
+	}
+	return len(a.Devices) < len(b.Devices)
+}
@@ -0,0 +1,113 @@
+/*
+Package capacity provides a utilization aware allocator
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package capacity
+
+import (
+	"testing"
+
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+	"github.com/stretchr/testify/assert"
+)
+
+func newNode(id string, devices ...*topology.Device) *topology.StorageNode {
+	return &topology.StorageNode{
+		Name: id,
+		Metadata: topology.InstanceMetadata{
+			ID: id,
+		},
+		Devices: devices,
+	}
+}
+
+func newDevice(id, class string, size int64, utilization int) *topology.Device {
+	return &topology.Device{
+		Class:       class,
+		Size:        size,
+		Utilization: utilization,
+		Metadata: topology.DeviceMetadata{
+			ID: id,
+		},
+	}
+}
+
+func TestCapacityDetermineNodeToAddStorage(t *testing.T) {
+	class := &config.Class{Name: "c1"}
+	a := New()
+
+	_, err := a.DetermineNodeToAddStorage(&topology.Topology{}, class)
+	assert.Error(t, err)
+
+	// Node two has more devices but is under the most pressure for c1
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				newNode("one", newDevice("d1", "c1", 100, 20)),
+				newNode("two",
+					newDevice("d2", "c1", 100, 90),
+					newDevice("d3", "c2", 100, 0),
+					newDevice("d4", "c2", 100, 0)),
+				newNode("three", newDevice("d5", "c1", 50, 90)),
+			},
+		},
+	}
+
+	// Same utilization, less capacity wins
+	node, err := a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "three", node.Metadata.ID)
+
+	// Nodes excluding the class are skipped
+	testTopology.Cluster.StorageNodes[2].Classes = []string{"c2"}
+	node, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", node.Metadata.ID)
+
+	for _, n := range testTopology.Cluster.StorageNodes {
+		n.Classes = []string{"c2"}
+	}
+	_, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.Error(t, err)
+}
+
+func TestCapacityDetermineStorageToRemove(t *testing.T) {
+	class := &config.Class{Name: "c1"}
+	a := New()
+
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				newNode("one",
+					newDevice("d1", "c1", 100, 50),
+					newDevice("d2", "c1", 100, 30)),
+				newNode("two",
+					newDevice("d3", "c1", 100, 10),
+					newDevice("d4", "c1", 100, 5)),
+				newNode("three", newDevice("d5", "c2", 100, 0)),
+			},
+		},
+	}
+	node, pool, device := a.DetermineStorageToRemove(testTopology, class)
+	assert.Equal(t, "two", node.Metadata.ID)
+	assert.Nil(t, pool)
+	assert.Equal(t, "d4", device.Metadata.ID)
+
+	node, pool, device = a.DetermineStorageToRemove(testTopology, &config.Class{Name: "c3"})
+	assert.Nil(t, node)
+	assert.Nil(t, pool)
+	assert.Nil(t, device)
+}
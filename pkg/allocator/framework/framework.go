@@ -0,0 +1,318 @@
+/*
+Package framework provides a pluggable allocator
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package framework
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+// MaxScore is the highest score a ScorePlugin can return
+const MaxScore = 100
+
+// Plugin is implemented by all allocator plugins
+type Plugin interface {
+	// Name returns the name of the plugin
+	Name() string
+}
+
+// FilterPlugin removes nodes which cannot take storage of a class
+type FilterPlugin interface {
+	Plugin
+
+	// Filter returns an error with the reason the node cannot take
+	// storage of the class, or nil if it can
+	Filter(*topology.Topology, *config.Class, *topology.StorageNode) error
+}
+
+// ScorePlugin ranks the nodes which passed all the filters
+type ScorePlugin interface {
+	Plugin
+
+	// Score returns a value between 0 and MaxScore. Nodes with higher
+	// scores are preferred when adding storage.
+	Score(*topology.Topology, *config.Class, *topology.StorageNode) int
+}
+
+// Allocator places storage using the plugins configured for each class.
+// Storage is added to the node with the highest weighted score after
+// filtering, and removed from the node with the lowest weighted score.
+type Allocator struct {
+	registry *Registry
+	defaults []config.Plugin
+
+	// chains holds the plugins of each class in the configuration
+	lock   sync.Mutex
+	chains map[string]*chain
+}
+
+// DefaultPlugins returns the plugins used for classes which do not list
+// any in their allocation configuration
+func DefaultPlugins() []config.Plugin {
+	return []config.Plugin{
+		{Name: ZoneSpreadName},
+		{Name: LeastUtilizationName},
+		{Name: DeviceCountName},
+	}
+}
+
+// New returns an allocator creating plugins from the registry provided.
+// Classes which do not list plugins use the defaults provided, or
+// DefaultPlugins() if defaults is nil.
+func New(r *Registry, defaults []config.Plugin) *Allocator {
+	if defaults == nil {
+		defaults = DefaultPlugins()
+	}
+	return &Allocator{
+		registry: r,
+		defaults: defaults,
+		chains:   make(map[string]*chain),
+	}
+}
+
+// weightedScore holds a score plugin and its weight
+type weightedScore struct {
+	plugin ScorePlugin
+	weight int
+}
+
+// chain holds the plugins created for a class
+type chain struct {
+	filters []FilterPlugin
+	scores  []weightedScore
+}
+
+// SetConfig creates the plugins of every class in the configuration.
+// Classes with invalid plugins are logged and fail when storage is
+// placed for them.
+func (a *Allocator) SetConfig(c *config.Config) {
+	chains := make(map[string]*chain, len(c.Classes))
+	for i := range c.Classes {
+		class := &c.Classes[i]
+		ch, err := a.newChain(class)
+		if err != nil {
+			logrus.Errorf("class:%s Unable to create allocator plugins: %v",
+				class.Name,
+				err)
+			continue
+		}
+		chains[class.Name] = ch
+	}
+
+	a.lock.Lock()
+	a.chains = chains
+	a.lock.Unlock()
+}
+
+// ValidateClass returns an error if the plugins of the class are unknown
+// or their arguments are invalid
+func (a *Allocator) ValidateClass(class *config.Class) error {
+	_, err := a.newChain(class)
+	return err
+}
+
+// pluginsForClass returns the plugins created for the class by
+// SetConfig. They are created on each call for classes which are not in
+// the configuration, such as classes being drained.
+func (a *Allocator) pluginsForClass(class *config.Class) (*chain, error) {
+	a.lock.Lock()
+	ch, ok := a.chains[class.Name]
+	a.lock.Unlock()
+	if ok {
+		return ch, nil
+	}
+	return a.newChain(class)
+}
+
+// newChain creates the plugins configured for the class
+func (a *Allocator) newChain(class *config.Class) (*chain, error) {
+	configs := class.Allocation
+	if len(configs) == 0 {
+		configs = a.defaults
+	}
+
+	ch := &chain{
+		filters: make([]FilterPlugin, 0),
+		scores:  make([]weightedScore, 0),
+	}
+	for _, c := range configs {
+		p, err := a.registry.New(c.Name, c.Args)
+		if err != nil {
+			return nil, err
+		}
+		used := false
+		if f, ok := p.(FilterPlugin); ok {
+			ch.filters = append(ch.filters, f)
+			used = true
+		}
+		if s, ok := p.(ScorePlugin); ok {
+			weight := c.Weight
+			if weight == 0 {
+				weight = 1
+			}
+			ch.scores = append(ch.scores, weightedScore{plugin: s, weight: weight})
+			used = true
+		}
+		if !used {
+			return nil, fmt.Errorf("Plugin %s is neither a filter nor a score plugin",
+				c.Name)
+		}
+	}
+	return ch, nil
+}
+
+// score returns the weighted score of the node
+func score(
+	scores []weightedScore,
+	t *topology.Topology,
+	class *config.Class,
+	node *topology.StorageNode,
+) int {
+	total := 0
+	for _, s := range scores {
+		total += s.weight * s.plugin.Score(t, class, node)
+	}
+	return total
+}
+
+// DetermineNodeToAddStorage returns the node with the highest score among
+// the nodes which support the class, are schedulable, have not reached
+// their device limit and pass all the filters
+func (a *Allocator) DetermineNodeToAddStorage(
+	t *topology.Topology,
+	class *config.Class,
+) (*topology.StorageNode, error) {
+	ch, err := a.pluginsForClass(class)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		node *topology.StorageNode
+		best int
+	)
+	reasons := make([]string, 0)
+	for _, n := range t.Cluster.StorageNodes {
+		if !n.SupportsClass(class) {
+			continue
+		}
+		if !n.Schedulable() {
+			reasons = append(reasons, fmt.Sprintf("node:%s is %s",
+				n.Metadata.ID,
+				n.State))
+			continue
+		}
+		if !n.HasRoomForClass(class) {
+			reasons = append(reasons, fmt.Sprintf("node:%s device limit of %d reached",
+				n.Metadata.ID,
+				n.MaxDevices))
+			continue
+		}
+		if err := filter(ch.filters, t, class, n); err != nil {
+			reasons = append(reasons, fmt.Sprintf("node:%s %v", n.Metadata.ID, err))
+			continue
+		}
+		if s := score(ch.scores, t, class, n); node == nil || s > best {
+			node, best = n, s
+		}
+	}
+	if node == nil {
+		if len(reasons) == 0 {
+			return nil, fmt.Errorf("No storage nodes in the cluster support class %s",
+				class.Name)
+		}
+		return nil, fmt.Errorf("No storage nodes available for class %s: %s",
+			class.Name,
+			strings.Join(reasons, "; "))
+	}
+
+	return node, nil
+}
+
+// DetermineStorageToRemove returns the least utilized device of the class
+// on the node with the lowest score. Filters are not applied but nodes in
+// maintenance and nodes which do not support the class are skipped.
+func (a *Allocator) DetermineStorageToRemove(
+	t *topology.Topology,
+	class *config.Class,
+) (*topology.StorageNode, *topology.Pool, *topology.Device) {
+	ch, err := a.pluginsForClass(class)
+	if err != nil {
+		logrus.Errorf("class:%s Unable to create allocator plugins: %v",
+			class.Name,
+			err)
+		return nil, nil, nil
+	}
+
+	var (
+		node  *topology.StorageNode
+		worst int
+	)
+	for _, n := range t.Cluster.StorageNodes {
+		if !n.SupportsClass(class) ||
+			!n.Removable() ||
+			len(n.DevicesForClass(class)) == 0 {
+			continue
+		}
+		if s := score(ch.scores, t, class, n); node == nil || s < worst {
+			node, worst = n, s
+		}
+	}
+	if node == nil {
+		return nil, nil, nil
+	}
+
+	devices := node.DevicesForClass(class)
+	pool, ok := node.Pools[class.Name]
+	if ok {
+		devices = node.DevicesOnPool(pool)
+	} else {
+		pool = nil
+	}
+
+	var device *topology.Device
+	for _, d := range devices {
+		if device == nil || d.Utilization < device.Utilization {
+			device = d
+		}
+	}
+	if device == nil {
+		return nil, nil, nil
+	}
+
+	return node, pool, device
+}
+
+// filter returns the error of the first filter the node does not pass
+func filter(
+	filters []FilterPlugin,
+	t *topology.Topology,
+	class *config.Class,
+	node *topology.StorageNode,
+) error {
+	for _, f := range filters {
+		if err := f.Filter(t, class, node); err != nil {
+			return fmt.Errorf("%s: %v", f.Name(), err)
+		}
+	}
+	return nil
+}
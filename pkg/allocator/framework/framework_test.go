@@ -0,0 +1,263 @@
+/*
+Package framework provides a pluggable allocator
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package framework
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+	"github.com/stretchr/testify/assert"
+)
+
+func newNode(id, zone string, devices ...*topology.Device) *topology.StorageNode {
+	return &topology.StorageNode{
+		Name: id,
+		Metadata: topology.InstanceMetadata{
+			ID:   id,
+			Zone: zone,
+		},
+		Devices: devices,
+	}
+}
+
+func newDevice(id, class string, size int64, utilization int) *topology.Device {
+	return &topology.Device{
+		Class:       class,
+		Size:        size,
+		Utilization: utilization,
+		Metadata: topology.DeviceMetadata{
+			ID: id,
+		},
+	}
+}
+
+// preferNode is a test plugin which only scores the node in its args
+type preferNode struct {
+	id string
+}
+
+func (p *preferNode) Name() string {
+	return "prefer-node"
+}
+
+func (p *preferNode) Score(
+	t *topology.Topology,
+	class *config.Class,
+	node *topology.StorageNode,
+) int {
+	if node.Metadata.ID == p.id {
+		return MaxScore
+	}
+	return 0
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewDefaultRegistry()
+
+	_, err := r.New("unknown", nil)
+	assert.Error(t, err)
+
+	_, err = r.New(MaxDevicesPerNodeName, nil)
+	assert.Error(t, err)
+	_, err = r.New(MaxDevicesPerNodeName, map[string]string{"max": "zero"})
+	assert.Error(t, err)
+	p, err := r.New(MaxDevicesPerNodeName, map[string]string{"max": "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, MaxDevicesPerNodeName, p.Name())
+
+	factory := func(args map[string]string) (Plugin, error) {
+		return &preferNode{id: args["node"]}, nil
+	}
+	assert.NoError(t, r.Register("prefer-node", factory))
+	assert.Error(t, r.Register("prefer-node", factory))
+	assert.Error(t, r.Register(ZoneSpreadName, factory))
+}
+
+func TestDetermineNodeToAddStorage(t *testing.T) {
+	r := NewDefaultRegistry()
+	assert.NoError(t, r.Register("prefer-node",
+		func(args map[string]string) (Plugin, error) {
+			return &preferNode{id: args["node"]}, nil
+		}))
+	a := New(r, nil)
+
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				newNode("one", "a",
+					newDevice("d1", "c1", 100, 50),
+					newDevice("d2", "c1", 100, 50)),
+				newNode("two", "a", newDevice("d3", "c1", 100, 50)),
+				newNode("three", "b", newDevice("d4", "c1", 100, 50)),
+			},
+		},
+	}
+
+	// Defaults spread across zones
+	class := &config.Class{Name: "c1"}
+	node, err := a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "three", node.Metadata.ID)
+
+	// A heavier custom plugin wins
+	class.Allocation = []config.Plugin{
+		{Name: ZoneSpreadName},
+		{Name: "prefer-node", Weight: 2, Args: map[string]string{"node": "two"}},
+	}
+	node, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", node.Metadata.ID)
+
+	// Filters remove nodes
+	class.Allocation = []config.Plugin{
+		{Name: DeviceCountName},
+		{Name: MaxDevicesPerNodeName, Args: map[string]string{"max": "1"}},
+	}
+	_, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), MaxDevicesPerNodeName)
+
+	class.Allocation[1].Args["max"] = "2"
+	node, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", node.Metadata.ID)
+
+	// Nodes which are not schedulable are skipped
+	testTopology.Cluster.StorageNodes[1].State = topology.NodeStateDecommissioning
+	node, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "three", node.Metadata.ID)
+	testTopology.Cluster.StorageNodes[2].State = topology.NodeStateCordoned
+	_, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "decommissioning")
+	testTopology.Cluster.StorageNodes[1].State = ""
+	testTopology.Cluster.StorageNodes[2].State = ""
+
+	// Unknown plugins are reported
+	class.Allocation = []config.Plugin{{Name: "unknown"}}
+	_, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.Error(t, err)
+}
+
+func TestDetermineStorageToRemove(t *testing.T) {
+	a := New(NewDefaultRegistry(), []config.Plugin{{Name: LeastUtilizationName}})
+
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				newNode("one", "a",
+					newDevice("d1", "c1", 100, 10),
+					newDevice("d2", "c1", 100, 20)),
+				newNode("two", "a",
+					newDevice("d3", "c1", 100, 90),
+					newDevice("d4", "c1", 100, 80)),
+				newNode("three", "b"),
+			},
+		},
+	}
+	class := &config.Class{Name: "c1"}
+	node, pool, device := a.DetermineStorageToRemove(testTopology, class)
+	assert.Equal(t, "two", node.Metadata.ID)
+	assert.Nil(t, pool)
+	assert.Equal(t, "d4", device.Metadata.ID)
+
+	// Nodes which no longer support the class are skipped
+	testTopology.Cluster.StorageNodes[1].Classes = []string{"c2"}
+	node, _, device = a.DetermineStorageToRemove(testTopology, class)
+	assert.Equal(t, "one", node.Metadata.ID)
+	assert.Equal(t, "d1", device.Metadata.ID)
+
+	class.Allocation = []config.Plugin{{Name: "unknown"}}
+	node, pool, device = a.DetermineStorageToRemove(testTopology, class)
+	assert.Nil(t, node)
+	assert.Nil(t, pool)
+	assert.Nil(t, device)
+}
+
+func TestSetConfig(t *testing.T) {
+	created := 0
+	r := NewDefaultRegistry()
+	assert.NoError(t, r.Register("prefer-node",
+		func(args map[string]string) (Plugin, error) {
+			created++
+			return &preferNode{id: args["node"]}, nil
+		}))
+	a := New(r, nil)
+
+	class := config.Class{
+		Name:       "c1",
+		Allocation: []config.Plugin{{Name: "prefer-node", Args: map[string]string{"node": "two"}}},
+	}
+	assert.NoError(t, a.ValidateClass(&class))
+	assert.Error(t, a.ValidateClass(&config.Class{
+		Name:       "c1",
+		Allocation: []config.Plugin{{Name: "prefer-nod"}},
+	}))
+
+	// Plugins are created once per configuration
+	created = 0
+	a.SetConfig(&config.Config{Classes: []config.Class{class}})
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				newNode("one", "a"),
+				newNode("two", "a"),
+			},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		node, err := a.DetermineNodeToAddStorage(testTopology, &class)
+		assert.NoError(t, err)
+		assert.Equal(t, "two", node.Metadata.ID)
+	}
+	assert.Equal(t, 1, created)
+}
+
+func TestPluginScores(t *testing.T) {
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				newNode("one", "a",
+					newDevice("d1", "c1", 300, 25),
+					newDevice("d2", "c2", 100, 0)),
+				newNode("two", "b", newDevice("d3", "c1", 100, 75)),
+				newNode("three", "c"),
+			},
+		},
+	}
+	class := &config.Class{Name: "c1"}
+	nodes := testTopology.Cluster.StorageNodes
+
+	tests := []struct {
+		plugin ScorePlugin
+		scores []int
+	}{
+		{&ZoneSpread{}, []int{0, 66, 100}},
+		{&LeastUtilization{}, []int{75, 25, 100}},
+		{&DeviceCount{}, []int{0, 50, 100}},
+	}
+	for _, test := range tests {
+		for i, node := range nodes {
+			assert.Equal(t, test.scores[i],
+				test.plugin.Score(testTopology, class, node),
+				fmt.Sprintf("%s node:%s", test.plugin.Name(), node.Metadata.ID))
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Package framework provides a pluggable allocator
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package framework
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+const (
+	// ZoneSpreadName prefers nodes in the zone with the least capacity
+	// for the class
+	ZoneSpreadName = "zone-spread"
+	// LeastUtilizationName prefers nodes with the lowest utilization for
+	// the class
+	LeastUtilizationName = "least-utilization"
+	// DeviceCountName prefers nodes with the least devices
+	DeviceCountName = "device-count"
+	// MaxDevicesPerNodeName filters out nodes which already have the
+	// number of devices set in the "max" argument
+	MaxDevicesPerNodeName = "max-devices-per-node"
+)
+
+// ZoneSpread scores nodes by the capacity of the class in their zone
+type ZoneSpread struct{}
+
+// NewZoneSpread returns a zone spread plugin. It takes no arguments.
+func NewZoneSpread(args map[string]string) (Plugin, error) {
+	return &ZoneSpread{}, nil
+}
+
+// Name returns the name of the plugin
+func (p *ZoneSpread) Name() string {
+	return ZoneSpreadName
+}
+
+// Score returns MaxScore for the zone with the least capacity of the
+// class, scaled down to 0 for the zone with the most
+func (p *ZoneSpread) Score(
+	t *topology.Topology,
+	class *config.Class,
+	node *topology.StorageNode,
+) int {
+	zones := make(map[string]int64)
+	for _, n := range t.Cluster.StorageNodes {
+		if n.SupportsClass(class) {
+			zones[n.Metadata.Zone] += n.TotalStorage(class)
+		}
+	}
+	max := int64(0)
+	for _, capacity := range zones {
+		if capacity > max {
+			max = capacity
+		}
+	}
+	if max == 0 {
+		return MaxScore
+	}
+	return int(MaxScore * (max - zones[node.Metadata.Zone]) / max)
+}
+
+// LeastUtilization scores nodes by their utilization of the class
+type LeastUtilization struct{}
+
+// NewLeastUtilization returns a least utilization plugin. It takes no
+// arguments.
+func NewLeastUtilization(args map[string]string) (Plugin, error) {
+	return &LeastUtilization{}, nil
+}
+
+// Name returns the name of the plugin
+func (p *LeastUtilization) Name() string {
+	return LeastUtilizationName
+}
+
+// Score returns the unused percentage of the class on the node
+func (p *LeastUtilization) Score(
+	t *topology.Topology,
+	class *config.Class,
+	node *topology.StorageNode,
+) int {
+	score := MaxScore - node.Utilization(class)
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// DeviceCount scores nodes by their number of devices of all classes
+type DeviceCount struct{}
+
+// NewDeviceCount returns a device count plugin. It takes no arguments.
+func NewDeviceCount(args map[string]string) (Plugin, error) {
+	return &DeviceCount{}, nil
+}
+
+// Name returns the name of the plugin
+func (p *DeviceCount) Name() string {
+	return DeviceCountName
+}
+
+// Score returns MaxScore for nodes without devices, scaled down to 0 for
+// the node with the most devices
+func (p *DeviceCount) Score(
+	t *topology.Topology,
+	class *config.Class,
+	node *topology.StorageNode,
+) int {
+	max := 0
+	for _, n := range t.Cluster.StorageNodes {
+		if len(n.Devices) > max {
+			max = len(n.Devices)
+		}
+	}
+	if max == 0 {
+		return MaxScore
+	}
+	return MaxScore * (max - len(node.Devices)) / max
+}
+
+// MaxDevicesPerNode filters out nodes with too many devices
+type MaxDevicesPerNode struct {
+	max int
+}
+
+// NewMaxDevicesPerNode returns a plugin which filters out nodes with
+// the number of devices in the "max" argument or more
+func NewMaxDevicesPerNode(args map[string]string) (Plugin, error) {
+	value, ok := args["max"]
+	if !ok {
+		return nil, fmt.Errorf("Argument max missing")
+	}
+	max, err := strconv.Atoi(value)
+	if err != nil || max <= 0 {
+		return nil, fmt.Errorf("Argument max must be a positive number: %s", value)
+	}
+	return &MaxDevicesPerNode{max: max}, nil
+}
+
+// Name returns the name of the plugin
+func (p *MaxDevicesPerNode) Name() string {
+	return MaxDevicesPerNodeName
+}
+
+// Filter returns an error if the node already has the maximum number
+// of devices
+func (p *MaxDevicesPerNode) Filter(
+	t *topology.Topology,
+	class *config.Class,
+	node *topology.StorageNode,
+) error {
+	if len(node.Devices) >= p.max {
+		return fmt.Errorf("has %d devices of a maximum of %d",
+			len(node.Devices),
+			p.max)
+	}
+	return nil
+}
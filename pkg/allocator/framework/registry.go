@@ -0,0 +1,76 @@
+/*
+Package framework provides a pluggable allocator
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package framework
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Factory creates a plugin from the arguments in the class configuration
+type Factory func(args map[string]string) (Plugin, error)
+
+// Registry maps plugin names to the factories which create them
+type Registry struct {
+	lock      sync.RWMutex
+	factories map[string]Factory
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		factories: make(map[string]Factory),
+	}
+}
+
+// NewDefaultRegistry returns a registry with all the built in plugins
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.factories[ZoneSpreadName] = NewZoneSpread
+	r.factories[LeastUtilizationName] = NewLeastUtilization
+	r.factories[DeviceCountName] = NewDeviceCount
+	r.factories[MaxDevicesPerNodeName] = NewMaxDevicesPerNode
+	return r
+}
+
+// Register adds a plugin factory to the registry
+func (r *Registry) Register(name string, f Factory) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.factories[name]; ok {
+		return fmt.Errorf("Plugin %s already registered", name)
+	}
+	r.factories[name] = f
+	return nil
+}
+
+// New creates the plugin registered with the name provided
+func (r *Registry) New(name string, args map[string]string) (Plugin, error) {
+	r.lock.RLock()
+	f, ok := r.factories[name]
+	r.lock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown allocator plugin %s", name)
+	}
+	p, err := f(args)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create plugin %s: %v", name, err)
+	}
+	return p, nil
+}
@@ -40,12 +40,18 @@ func (r *Allocator) DetermineNodeToAddStorage(
 	if len(t.Cluster.StorageNodes) == 0 {
 		return nil, fmt.Errorf("No storage nodes in the cluster")
 	}
-	node := t.Cluster.StorageNodes[0]
+	var node *topology.StorageNode
 	for _, currentNode := range t.Cluster.StorageNodes {
-		if len(currentNode.Devices) < len(node.Devices) {
+		if !currentNode.Schedulable() || !currentNode.HasRoomForClass(class) {
+			continue
+		}
+		if node == nil || len(currentNode.Devices) < len(node.Devices) {
 			node = currentNode
 		}
 	}
+	if node == nil {
+		return nil, fmt.Errorf("No storage nodes can take more devices")
+	}
 
 	return node, nil
 }
@@ -64,30 +70,37 @@ func (r *Allocator) DetermineStorageToRemove(
 
 	// Get the node
 	for _, currentNode := range t.Cluster.StorageNodes {
+		if !currentNode.Removable() {
+			continue
+		}
 		devices := currentNode.DevicesForClass(class)
 		if len(devices) == 0 {
 			continue
 		}
 
 		// Check pools on this node
+		var nodePool *topology.Pool
 		if len(currentNode.Pools) != 0 {
-			for _, currentpool := range node.Pools {
+			for _, currentpool := range currentNode.Pools {
 				if currentpool.Class == class.Name {
-					if pool == nil ||
-						currentpool.Utilization < pool.Utilization {
-						pool = currentpool
+					if nodePool == nil ||
+						currentpool.Utilization < nodePool.Utilization {
+						nodePool = currentpool
 					}
 				}
 			}
 
-			// Pick devices in the pull
-			devices = node.DevicesOnPool(pool)
+			// Pick devices in the pool
+			if nodePool != nil {
+				devices = currentNode.DevicesOnPool(nodePool)
+			}
 		}
 
 		for _, currentDevice := range devices {
 			if device == nil ||
 				currentDevice.Utilization < device.Utilization {
 				node = currentNode
+				pool = nodePool
 				device = currentDevice
 			}
 		}
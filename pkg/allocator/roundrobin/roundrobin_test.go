@@ -147,3 +147,116 @@ func TestRRDetermineStorageToRemove(t *testing.T) {
 	assert.NotNil(t, d)
 	assert.Equal(t, "d4", d.Metadata.ID)
 }
+
+func TestRRDetermineNodeToAddStorage(t *testing.T) {
+	class := &config.Class{Name: "c1"}
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				&topology.StorageNode{
+					Metadata: topology.InstanceMetadata{
+						ID: "one",
+					},
+					Devices: []*topology.Device{
+						&topology.Device{Class: "c1"},
+						&topology.Device{Class: "c1"},
+					},
+				},
+				&topology.StorageNode{
+					Metadata: topology.InstanceMetadata{
+						ID: "two",
+					},
+					Devices: []*topology.Device{
+						&topology.Device{Class: "c1"},
+					},
+				},
+			},
+		},
+	}
+
+	r := New()
+	node, err := r.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", node.Metadata.ID)
+
+	// Nodes at their device limit are skipped
+	testTopology.Cluster.StorageNodes[1].MaxDevices = 1
+	node, err = r.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "one", node.Metadata.ID)
+
+	testTopology.Cluster.StorageNodes[0].MaxDevices = 2
+	_, err = r.DetermineNodeToAddStorage(testTopology, class)
+	assert.Error(t, err)
+}
+
+func TestRRNodeStates(t *testing.T) {
+	class := &config.Class{Name: "c1"}
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				&topology.StorageNode{
+					Metadata: topology.InstanceMetadata{
+						ID: "one",
+					},
+					State: topology.NodeStateMaintenance,
+					Devices: []*topology.Device{
+						&topology.Device{
+							Class: "c1",
+							Metadata: topology.DeviceMetadata{
+								ID: "d1",
+							},
+						},
+					},
+				},
+				&topology.StorageNode{
+					Metadata: topology.InstanceMetadata{
+						ID: "two",
+					},
+					State: topology.NodeStateCordoned,
+					Pools: map[string]*topology.Pool{
+						"c1": &topology.Pool{
+							Name:        "p1",
+							Class:       "c1",
+							SetSize:     1,
+							Utilization: 20,
+						},
+					},
+					Devices: []*topology.Device{
+						&topology.Device{
+							Class:       "c1",
+							Pool:        "p1",
+							Utilization: 20,
+							Metadata: topology.DeviceMetadata{
+								ID: "d2",
+							},
+						},
+						&topology.Device{
+							Class:       "c1",
+							Pool:        "p1",
+							Utilization: 10,
+							Metadata: topology.DeviceMetadata{
+								ID: "d3",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	r := New()
+	_, err := r.DetermineNodeToAddStorage(testTopology, class)
+	assert.Error(t, err)
+
+	// Storage is removed from the pool of the cordoned node only
+	node, pool, device := r.DetermineStorageToRemove(testTopology, class)
+	assert.Equal(t, "two", node.Metadata.ID)
+	assert.Equal(t, "p1", pool.Name)
+	assert.Equal(t, "d3", device.Metadata.ID)
+
+	testTopology.Cluster.StorageNodes[1].State = topology.NodeStateReady
+	node, err = r.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", node.Metadata.ID)
+}
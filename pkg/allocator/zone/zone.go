@@ -0,0 +1,195 @@
+/*
+Package zone provides a zone aware allocator
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package zone
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+// Allocator keeps the capacity of each class balanced across the zones
+// of the cluster. Storage is added to the zone with the least capacity
+// for the class and removed from the zone with the most. The last
+// devices of a class in a zone are never removed so that the storage
+// system can keep replicas in every failure domain.
+type Allocator struct{}
+
+// zoneInfo holds the capacity of a class in a single zone
+type zoneInfo struct {
+	name     string
+	capacity int64
+	devices  int
+	nodes    []*topology.StorageNode
+}
+
+// New returns a new zone aware allocator
+func New() *Allocator {
+	return &Allocator{}
+}
+
+// DetermineNodeToAddStorage returns a node in the zone with the least
+// capacity for the class. Within the zone the node with the least
+// devices of the class is chosen. Nodes which are not schedulable or are
+// at their device limit are skipped.
+func (a *Allocator) DetermineNodeToAddStorage(
+	t *topology.Topology,
+	class *config.Class,
+) (*topology.StorageNode, error) {
+	zones := zonesForClass(t, class)
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("No storage nodes in the cluster support class %s", class.Name)
+	}
+
+	var zone *zoneInfo
+	for _, z := range zones {
+		if !hasAvailable(z, class) {
+			continue
+		}
+		if zone == nil || z.capacity < zone.capacity {
+			zone = z
+		}
+	}
+	if zone == nil {
+		return nil, fmt.Errorf("No storage nodes for class %s can take more devices",
+			class.Name)
+	}
+
+	var node *topology.StorageNode
+	for _, n := range zone.nodes {
+		if !available(n, class) {
+			continue
+		}
+		if node == nil ||
+			len(n.DevicesForClass(class)) < len(node.DevicesForClass(class)) ||
+			(len(n.DevicesForClass(class)) == len(node.DevicesForClass(class)) &&
+				len(n.Devices) < len(node.Devices)) {
+			node = n
+		}
+	}
+
+	return node, nil
+}
+
+// DetermineStorageToRemove returns the least utilized device of the class
+// in the zone with the most capacity. Devices are only taken from a zone
+// if the zone keeps at least one device of the class afterwards. Nodes in
+// maintenance are skipped.
+func (a *Allocator) DetermineStorageToRemove(
+	t *topology.Topology,
+	class *config.Class,
+) (*topology.StorageNode, *topology.Pool, *topology.Device) {
+	zones := zonesForClass(t, class)
+
+	// Try the zones with the most capacity first
+	sort.SliceStable(zones, func(i, j int) bool {
+		return zones[i].capacity > zones[j].capacity
+	})
+
+	for _, zone := range zones {
+		var (
+			node   *topology.StorageNode
+			pool   *topology.Pool
+			device *topology.Device
+		)
+		for _, n := range zone.nodes {
+			if !n.Removable() {
+				continue
+			}
+			p, d := leastUtilized(n, class)
+			if d == nil {
+				continue
+			}
+
+			// Removing from a pool takes out a full set
+			setSize, _ := n.SetSizeForClass(class)
+			if zone.devices-setSize < 1 {
+				continue
+			}
+			if device == nil || d.Utilization < device.Utilization {
+				node, pool, device = n, p, d
+			}
+		}
+		if device != nil {
+			return node, pool, device
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// zonesForClass groups the nodes which support the class by zone in the
+// order the zones first appear in the topology
+func zonesForClass(t *topology.Topology, class *config.Class) []*zoneInfo {
+	zones := make([]*zoneInfo, 0)
+	byName := make(map[string]*zoneInfo)
+	for _, n := range t.Cluster.StorageNodes {
+		if !n.SupportsClass(class) {
+			continue
+		}
+		z, ok := byName[n.Metadata.Zone]
+		if !ok {
+			z = &zoneInfo{name: n.Metadata.Zone}
+			byName[z.name] = z
+			zones = append(zones, z)
+		}
+		z.nodes = append(z.nodes, n)
+		z.capacity += n.TotalStorage(class)
+		z.devices += len(n.DevicesForClass(class))
+	}
+	return zones
+}
+
+// available returns true if a disk set can be added to the node
+func available(n *topology.StorageNode, class *config.Class) bool {
+	return n.Schedulable() && n.HasRoomForClass(class)
+}
+
+// hasAvailable returns true if any node in the zone can take a disk set
+func hasAvailable(z *zoneInfo, class *config.Class) bool {
+	for _, n := range z.nodes {
+		if available(n, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// leastUtilized returns the least utilized device of the class on the
+// node. If the node has a pool for the class, the device is taken from it.
+func leastUtilized(
+	n *topology.StorageNode,
+	class *config.Class,
+) (*topology.Pool, *topology.Device) {
+	devices := n.DevicesForClass(class)
+	pool, ok := n.Pools[class.Name]
+	if ok {
+		devices = n.DevicesOnPool(pool)
+	} else {
+		pool = nil
+	}
+
+	var device *topology.Device
+	for _, d := range devices {
+		if device == nil || d.Utilization < device.Utilization {
+			device = d
+		}
+	}
+	return pool, device
+}
@@ -0,0 +1,162 @@
+/*
+Package zone provides a zone aware allocator
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package zone
+
+import (
+	"testing"
+
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+	"github.com/stretchr/testify/assert"
+)
+
+func newNode(id, zone string, devices ...*topology.Device) *topology.StorageNode {
+	return &topology.StorageNode{
+		Name: id,
+		Metadata: topology.InstanceMetadata{
+			ID:   id,
+			Zone: zone,
+		},
+		Devices: devices,
+	}
+}
+
+func newDevice(id, class string, size int64, utilization int) *topology.Device {
+	return &topology.Device{
+		Class:       class,
+		Size:        size,
+		Utilization: utilization,
+		Metadata: topology.DeviceMetadata{
+			ID: id,
+		},
+	}
+}
+
+func TestZoneDetermineNodeToAddStorage(t *testing.T) {
+	class := &config.Class{Name: "c1"}
+	a := New()
+
+	// No nodes
+	_, err := a.DetermineNodeToAddStorage(&topology.Topology{}, class)
+	assert.Error(t, err)
+
+	// Zone b has the least capacity even though it has the most nodes
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				newNode("one", "a", newDevice("d1", "c1", 100, 0)),
+				newNode("two", "b",
+					newDevice("d2", "c1", 10, 0),
+					newDevice("d3", "c2", 100, 0)),
+				newNode("three", "b", newDevice("d4", "c1", 10, 0)),
+				newNode("four", "b",
+					newDevice("d5", "c2", 100, 0),
+					newDevice("d6", "c2", 100, 0)),
+				newNode("five", "c", newDevice("d7", "c1", 100, 0)),
+			},
+		},
+	}
+	node, err := a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "four", node.Metadata.ID)
+
+	// Nodes which do not support the class are ignored
+	testTopology.Cluster.StorageNodes[3].Classes = []string{"c2"}
+	node, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "three", node.Metadata.ID)
+
+	// Full nodes are skipped, and so are zones with only full nodes
+	testTopology.Cluster.StorageNodes[2].MaxDevices = 1
+	node, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.NoError(t, err)
+	assert.Equal(t, "two", node.Metadata.ID)
+
+	for _, n := range testTopology.Cluster.StorageNodes {
+		n.MaxDevices = len(n.Devices)
+	}
+	_, err = a.DetermineNodeToAddStorage(testTopology, class)
+	assert.Error(t, err)
+}
+
+func TestZoneDetermineStorageToRemove(t *testing.T) {
+	class := &config.Class{Name: "c1"}
+	a := New()
+
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				newNode("one", "a",
+					newDevice("d1", "c1", 100, 30),
+					newDevice("d2", "c1", 100, 10)),
+				newNode("two", "b", newDevice("d3", "c1", 300, 0)),
+				newNode("three", "c", newDevice("d4", "c1", 10, 0)),
+			},
+		},
+	}
+
+	// Zone b has the most capacity but only one device, so the least
+	// utilized device of zone a is removed
+	node, pool, device := a.DetermineStorageToRemove(testTopology, class)
+	assert.Equal(t, "one", node.Metadata.ID)
+	assert.Nil(t, pool)
+	assert.Equal(t, "d2", device.Metadata.ID)
+
+	// Every zone is down to its last device
+	testTopology.Cluster.StorageNodes[0].Devices =
+		testTopology.Cluster.StorageNodes[0].Devices[:1]
+	node, pool, device = a.DetermineStorageToRemove(testTopology, class)
+	assert.Nil(t, node)
+	assert.Nil(t, pool)
+	assert.Nil(t, device)
+}
+
+func TestZoneDetermineStorageToRemoveFromPool(t *testing.T) {
+	class := &config.Class{Name: "c1"}
+	a := New()
+
+	pooled := newNode("one", "a",
+		newDevice("d1", "c1", 100, 0),
+		newDevice("d2", "c1", 100, 0),
+		newDevice("d3", "c1", 100, 0))
+	pooled.Devices[0].Pool = "p1"
+	pooled.Devices[1].Pool = "p1"
+	pooled.Devices[2].Pool = "p2"
+	pooled.Pools = map[string]*topology.Pool{
+		"c1": &topology.Pool{
+			Name:    "p1",
+			Class:   "c1",
+			SetSize: 2,
+		},
+	}
+	testTopology := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{pooled},
+		},
+	}
+
+	// Three devices in the zone can give up a set of two
+	node, pool, device := a.DetermineStorageToRemove(testTopology, class)
+	assert.Equal(t, "one", node.Metadata.ID)
+	assert.Equal(t, "p1", pool.Name)
+	assert.Equal(t, "p1", device.Pool)
+
+	// Two devices cannot
+	pooled.Devices = pooled.Devices[:2]
+	_, _, device = a.DetermineStorageToRemove(testTopology, class)
+	assert.Nil(t, device)
+}
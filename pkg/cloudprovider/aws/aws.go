@@ -17,23 +17,44 @@ limitations under the License.
 package aws
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/libopenstorage/logrus"
-	awsops "github.com/libopenstorage/openstorage/pkg/storageops/aws"
 	"github.com/libopenstorage/rico/pkg/cloudprovider"
 	"github.com/libopenstorage/rico/pkg/config"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/opsworks"
 )
 
 // Provider has the client and state information to communicate with AWS
 type Provider struct {
-	ec2c *ec2.EC2
+	ec2 ec2API
+
+	// timeout bounds each call, pollInterval is the time between two
+	// checks of a volume state, and backoff is the first delay before
+	// retrying a throttled request
+	timeout      time.Duration
+	pollInterval time.Duration
+	backoff      time.Duration
+
+	// clusterID is set as a tag on every volume created
+	lock      sync.Mutex
+	clusterID string
+
+	// attachLock serializes the choice of device names and the attach
+	// requests, since the instance may not show a new attachment at once
+	attachLock sync.Mutex
+
+	// limits caches the device limit of each instance
+	limitsLock sync.Mutex
+	limits     map[string]int
 }
 
 // NewProvider provides an implementation of cloudprovider.Instance
@@ -57,24 +78,31 @@ func NewProvider() *Provider {
 		return nil
 	}
 
+	return newProvider(ec2c)
+}
+
+func newProvider(api ec2API) *Provider {
 	return &Provider{
-		ec2c: ec2c,
+		ec2:          api,
+		timeout:      defaultTimeout,
+		pollInterval: defaultPollInterval,
+		backoff:      defaultBackoff,
+		limits:       make(map[string]int),
 	}
 }
 
-// SetConfig does nothing
-func (p *Provider) SetConfig(config *config.Config) {}
-
-func (p *Provider) volumeRequestFromParameters(
-	class *config.Class,
-	volreq *ec2.Volume,
-) error {
+// SetConfig saves the cluster ID used to label devices
+func (p *Provider) SetConfig(config *config.Config) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clusterID = config.ClusterID
+}
 
-	// Get parameters
-	// TODO: Get parameters
-	voltype := opsworks.VolumeTypeGp2
-	volreq.VolumeType = &voltype
-	return nil
+// ValidateClass checks the EBS volume parameters of the class against
+// its disk size
+func (p *Provider) ValidateClass(class *config.Class) error {
+	_, err := parseParameters(class)
+	return err
 }
 
 // DeviceCreate creates and attaches a device to a specific node
@@ -83,44 +111,50 @@ func (p *Provider) DeviceCreate(
 	class *config.Class,
 ) (*cloudprovider.Device, error) {
 
-	// Create an aws ops object
-	ops := awsops.NewEc2Storage(instanceID, p.ec2c)
-
-	// Get availability zone of the instance
-	descriptionI, err := ops.Describe()
-	description := descriptionI.(*ec2.Instance)
+	// Get the volume parameters from the class
+	params, err := parseParameters(class)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a volume request according to the parameters
-	az := description.Placement.AvailabilityZone
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
 
-	// Create a volume
-	volreq := &ec2.Volume{
-		AvailabilityZone: az,
-		Size:             &class.DiskSizeGb,
-	}
-	if err = p.volumeRequestFromParameters(class, volreq); err != nil {
+	// Get availability zone of the instance
+	instance, err := p.describeInstance(ctx, instanceID)
+	if err != nil {
 		return nil, err
 	}
+	if instance.Placement == nil {
+		return nil, fmt.Errorf("Instance %s has no placement", instanceID)
+	}
+
+	// Tag the volume so it can be found by ListDevices
+	p.lock.Lock()
+	labels := cloudprovider.DeviceLabels(p.clusterID, class, instanceID, time.Now())
+	p.lock.Unlock()
+	for key, value := range labels {
+		params.tags[key] = value
+	}
 
-	d, err := ops.Create(volreq, nil)
+	// Create a volume
+	vol, err := p.createVolume(ctx,
+		params.createVolumeInput(instance.Placement.AvailabilityZone, class.DiskSizeGb))
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create volume: %v", err)
+		return nil, err
 	}
-	vol := d.(*ec2.Volume)
 
 	// Attach the volume
-	path, err := ops.Attach(*vol.VolumeId)
+	path, err := p.attachVolume(ctx, instanceID, *vol.VolumeId)
 	if err != nil {
 		reterr := fmt.Errorf("Unable to attach volume %s to %s: %v",
 			*vol.VolumeId,
 			instanceID,
 			err)
-		logrus.Errorf(err.Error())
-		if err := ops.Delete(*vol.VolumeId); err != nil {
-			logrus.Errorf("Failed to delete volume %s: %v", *vol.VolumeId, err)
+		logrus.Error(reterr)
+		p.cleanup(instanceID, *vol.VolumeId)
+		if err == cloudprovider.ErrDeviceLimit || isAttachmentLimit(err) {
+			return nil, cloudprovider.ErrDeviceLimit
 		}
 		return nil, reterr
 	}
@@ -132,25 +166,336 @@ func (p *Provider) DeviceCreate(
 	}, nil
 }
 
-// DeviceDelete detaches the volume from the specified node, then deletes it
-func (p *Provider) DeviceDelete(instanceID string, deviceID string) error {
-	// Create an aws ops object
-	ops := awsops.NewEc2Storage(instanceID, p.ec2c)
+// createVolume creates a volume and waits for it to become available
+func (p *Provider) createVolume(
+	ctx context.Context,
+	input *ec2.CreateVolumeInput,
+) (*ec2.Volume, error) {
+	var vol *ec2.Volume
+	err := p.retry(ctx, func() (err error) {
+		vol, err = p.ec2.CreateVolumeWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create volume: %v", err)
+	}
 
-	// Detach volume
-	if err := ops.Detach(deviceID); err != nil {
-		return fmt.Errorf("Failed to detach volume %s from instance %s: %v",
-			deviceID,
-			instanceID,
+	_, err = p.waitVolumeState(ctx, *vol.VolumeId, ec2.VolumeStateAvailable, newVolumeVisibility)
+	if err != nil {
+		p.cleanup("", *vol.VolumeId)
+		return nil, fmt.Errorf("Volume %s did not become available: %v",
+			*vol.VolumeId,
 			err)
 	}
+	return vol, nil
+}
+
+// attachVolume attaches the volume to the instance with a free device
+// name and waits until it is attached. It returns the device name.
+func (p *Provider) attachVolume(
+	ctx context.Context,
+	instanceID, volumeID string,
+) (string, error) {
+	p.attachLock.Lock()
+	defer p.attachLock.Unlock()
+
+	instance, err := p.describeInstance(ctx, instanceID)
+	if err != nil {
+		return "", err
+	}
+	device, err := freeDeviceName(instance)
+	if err != nil {
+		return "", err
+	}
+
+	err = p.retry(ctx, func() error {
+		_, err := p.ec2.AttachVolumeWithContext(ctx, &ec2.AttachVolumeInput{
+			Device:     aws.String(device),
+			InstanceId: aws.String(instanceID),
+			VolumeId:   aws.String(volumeID),
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	_, err = p.waitAttachment(ctx, volumeID, instanceID, ec2.VolumeAttachmentStateAttached)
+	if err != nil {
+		return "", err
+	}
+	return device, nil
+}
+
+// cleanup deletes a volume which could not be created or attached. It
+// has its own timeout since the timeout of the failed call may be over.
+func (p *Provider) cleanup(instanceID, volumeID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	if err := p.deleteVolume(ctx, instanceID, volumeID); err != nil {
+		logrus.Errorf("Failed to delete volume %s: %v", volumeID, err)
+	}
+}
+
+// ListDevices returns the volumes with a tag for every label in the
+// filter
+func (p *Provider) ListDevices(filter map[string]string) ([]*cloudprovider.Device, error) {
+	input := &ec2.DescribeVolumesInput{}
+	for key, value := range filter {
+		input.Filters = append(input.Filters, &ec2.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []*string{aws.String(value)},
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	var devices []*cloudprovider.Device
+	err := p.retry(ctx, func() error {
+		// Start over if a page is throttled
+		devices = make([]*cloudprovider.Device, 0)
+		return p.ec2.DescribeVolumesPagesWithContext(ctx, input,
+			func(output *ec2.DescribeVolumesOutput, last bool) bool {
+				for _, vol := range output.Volumes {
+					devices = append(devices, deviceFromVolume(vol))
+				}
+				return true
+			})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list volumes: %v", err)
+	}
+	return devices, nil
+}
+
+// deviceFromVolume returns the device with the ID, size, tags and
+// attachment of the volume
+func deviceFromVolume(vol *ec2.Volume) *cloudprovider.Device {
+	device := &cloudprovider.Device{
+		ID:     aws.StringValue(vol.VolumeId),
+		Size:   aws.Int64Value(vol.Size),
+		Labels: make(map[string]string, len(vol.Tags)),
+	}
+	for _, tag := range vol.Tags {
+		device.Labels[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	for _, attachment := range vol.Attachments {
+		switch aws.StringValue(attachment.State) {
+		case ec2.VolumeAttachmentStateAttached, ec2.VolumeAttachmentStateAttaching:
+			device.InstanceID = aws.StringValue(attachment.InstanceId)
+			device.Path = aws.StringValue(attachment.Device)
+		}
+	}
+	return device
+}
+
+// DeviceDelete detaches the volume from the specified node, then deletes it.
+// The detach is skipped if the instance id is empty.
+func (p *Provider) DeviceDelete(instanceID string, deviceID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	return p.deleteVolume(ctx, instanceID, deviceID)
+}
+
+// deleteVolume detaches the volume from the instance if the instance id
+// is set, waits until it is available, then deletes it
+func (p *Provider) deleteVolume(
+	ctx context.Context,
+	instanceID, volumeID string,
+) error {
+	if len(instanceID) != 0 {
+		// Detach volume. A volume which is not attached is in an
+		// incorrect state for detaching and is already available.
+		err := p.retry(ctx, func() error {
+			_, err := p.ec2.DetachVolumeWithContext(ctx, &ec2.DetachVolumeInput{
+				InstanceId: aws.String(instanceID),
+				VolumeId:   aws.String(volumeID),
+			})
+			return err
+		})
+		if err != nil && !isIncorrectState(err) {
+			if isNotFound(err) {
+				return cloudprovider.ErrDeviceNotFound
+			}
+			return fmt.Errorf("Failed to detach volume %s from instance %s: %v",
+				volumeID,
+				instanceID,
+				err)
+		}
+
+		_, err = p.waitVolumeState(ctx, volumeID, ec2.VolumeStateAvailable, 0)
+		if isNotFound(err) {
+			// Deleted while detaching
+			return cloudprovider.ErrDeviceNotFound
+		} else if err != nil {
+			return fmt.Errorf("Volume %s did not detach from instance %s: %v",
+				volumeID,
+				instanceID,
+				err)
+		}
+	}
 
 	// Delete volume
-	if err := ops.Delete(deviceID); err != nil {
+	err := p.retry(ctx, func() error {
+		_, err := p.ec2.DeleteVolumeWithContext(ctx, &ec2.DeleteVolumeInput{
+			VolumeId: aws.String(volumeID),
+		})
+		return err
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return cloudprovider.ErrDeviceNotFound
+		}
 		return fmt.Errorf("Failed to delete volume %s: %v",
-			deviceID,
+			volumeID,
 			err)
 	}
 
 	return nil
 }
+
+// DeviceResize grows the volume to the size provided and waits until the
+// new size can be used by the instance. A volume already as large is left
+// as is. The size returned is the size of the volume.
+func (p *Provider) DeviceResize(
+	instanceID, deviceID string,
+	sizeGb int64,
+) (*cloudprovider.Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	vol, err := p.describeVolume(ctx, deviceID)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, cloudprovider.ErrDeviceNotFound
+		}
+		return nil, fmt.Errorf("Failed to get volume %s: %v", deviceID, err)
+	}
+
+	size := aws.Int64Value(vol.Size)
+	if size < sizeGb {
+		err = p.retry(ctx, func() error {
+			_, err := p.ec2.ModifyVolumeWithContext(ctx, &ec2.ModifyVolumeInput{
+				VolumeId: &deviceID,
+				Size:     &sizeGb,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resize volume %s to %dGi: %v",
+				deviceID,
+				sizeGb,
+				err)
+		}
+		size = sizeGb
+	}
+	if err := p.waitModification(ctx, deviceID); err != nil {
+		return nil, err
+	}
+
+	device := &cloudprovider.Device{
+		ID:   deviceID,
+		Size: size,
+	}
+	for _, a := range vol.Attachments {
+		if a.InstanceId != nil && *a.InstanceId == instanceID && a.Device != nil {
+			device.Path = *a.Device
+		}
+	}
+	return device, nil
+}
+
+// waitModification waits until the volume can be used with its new size.
+// The size can be used once the modification is optimizing.
+func (p *Provider) waitModification(ctx context.Context, deviceID string) error {
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		var out *ec2.DescribeVolumesModificationsOutput
+		err := p.retry(ctx, func() (err error) {
+			out, err = p.ec2.DescribeVolumesModificationsWithContext(ctx,
+				&ec2.DescribeVolumesModificationsInput{
+					VolumeIds: []*string{&deviceID},
+				})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to get modification of volume %s: %v",
+				deviceID,
+				err)
+		}
+		if len(out.VolumesModifications) == 0 {
+			return nil
+		}
+		switch aws.StringValue(out.VolumesModifications[0].ModificationState) {
+		case ec2.VolumeModificationStateOptimizing,
+			ec2.VolumeModificationStateCompleted:
+			return nil
+		case ec2.VolumeModificationStateFailed:
+			return fmt.Errorf("Resize of volume %s failed: %s",
+				deviceID,
+				aws.StringValue(out.VolumesModifications[0].StatusMessage))
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Timed out waiting for volume %s to resize", deviceID)
+		case <-ticker.C:
+		}
+	}
+}
+
+// MaxDevices returns the number of data volumes which can be attached to
+// the instance according to the hypervisor of its type. Nitro instances
+// have 28 attachment slots shared by the root volume, the volumes and the
+// network interfaces, which leaves 26 for data volumes next to the
+// primary network interface. Xen instances are limited to the 40 volumes
+// supported on Linux, 39 besides the root volume.
+func (p *Provider) MaxDevices(instanceID string) (int, error) {
+	p.limitsLock.Lock()
+	defer p.limitsLock.Unlock()
+
+	if max, ok := p.limits[instanceID]; ok {
+		return max, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	description, err := p.describeInstance(ctx, instanceID)
+	if err != nil {
+		return 0, err
+	}
+	if description.InstanceType == nil {
+		return 0, fmt.Errorf("Instance %s has no type", instanceID)
+	}
+	info, err := p.describeInstanceType(ctx, *description.InstanceType)
+	if err != nil {
+		return 0, err
+	}
+
+	max := 39
+	if aws.StringValue(info.Hypervisor) == ec2.InstanceTypeHypervisorNitro {
+		max = 26
+	}
+	p.limits[instanceID] = max
+	return max, nil
+}
+
+func isAttachmentLimit(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "AttachmentLimitExceeded"
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "InvalidVolume.NotFound"
+	}
+	return false
+}
@@ -17,100 +17,593 @@ limitations under the License.
 package aws
 
 import (
-	"os"
-	"strings"
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	awsops "github.com/libopenstorage/openstorage/pkg/storageops/aws"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
 	"github.com/libopenstorage/rico/pkg/config"
 	"github.com/stretchr/testify/assert"
 )
 
-/*
- Create RICO_TEST_INSTANCES:
+// fakeEC2 implements ec2API in memory. Volumes move to their next state
+// every time they are described, and a new volume is only found from the
+// second time it is described, as with the eventual consistency of EC2.
+type fakeEC2 struct {
+	lock      sync.Mutex
+	instances map[string]*ec2.Instance
+	types     map[string]string
+	volumes   map[string]*ec2.Volume
+	hidden    map[string]bool
+	modified  map[string]string
+	next      int
 
- export RICO_TEST_INSTANCES=$(aws ec2 describe-instances \
-	 --filters Name=instance-state-name,Values=running | \
-	 jq '.Reservations[].Instances[].InstanceId' | \
-	 tr '\n' ' ' | \
-	 sed -e "s#\"##g" -e "s# #,#g" -e 's#.$##')
+	// throttle is the number of requests to reject with
+	// RequestLimitExceeded. A negative value rejects all of them.
+	throttle int
 
-*/
+	// stuck keeps new volumes in the creating state
+	stuck bool
 
-func TestAwsDeviceAddDelete(t *testing.T) {
-	inputInstances := os.Getenv("RICO_TEST_INSTANCES")
-	if len(inputInstances) == 0 {
-		t.Skipf("Must provide a comma separated list of instance ids in the " +
-			"environment variable RICO_TEST_INSTANCES")
-	}
-	instances := strings.Split(inputInstances, ",")
-	numInstances := len(instances)
-
-	a := NewProvider()
-	assert.NotNil(t, a)
-
-	tests := []struct {
-		size     int64
-		instance string
-	}{
-		{
-			size:     8,
-			instance: instances[1%numInstances],
+	// vanish deletes volumes when they are detached
+	vanish bool
+}
+
+func newFakeEC2(instances ...*ec2.Instance) *fakeEC2 {
+	f := &fakeEC2{
+		instances: make(map[string]*ec2.Instance),
+		types: map[string]string{
+			"m5.large": ec2.InstanceTypeHypervisorNitro,
+			"m4.large": ec2.InstanceTypeHypervisorXen,
 		},
-		{
-			size:     2,
-			instance: instances[2%numInstances],
+		volumes:  make(map[string]*ec2.Volume),
+		hidden:   make(map[string]bool),
+		modified: make(map[string]string),
+	}
+	for _, instance := range instances {
+		f.instances[*instance.InstanceId] = instance
+	}
+	return f
+}
+
+func newFakeInstance(id string, devices ...string) *ec2.Instance {
+	instance := &ec2.Instance{
+		InstanceId:     aws.String(id),
+		InstanceType:   aws.String("m5.large"),
+		RootDeviceName: aws.String("/dev/xvda"),
+		Placement: &ec2.Placement{
+			AvailabilityZone: aws.String("us-east-1a"),
 		},
 	}
+	for _, device := range append([]string{"/dev/xvda"}, devices...) {
+		instance.BlockDeviceMappings = append(instance.BlockDeviceMappings,
+			&ec2.InstanceBlockDeviceMapping{DeviceName: aws.String(device)})
+	}
+	return instance
+}
+
+// request must be called with the lock held
+func (f *fakeEC2) request() error {
+	if f.throttle == 0 {
+		return nil
+	}
+	if f.throttle > 0 {
+		f.throttle--
+	}
+	return awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+}
+
+// volume must be called with the lock held
+func (f *fakeEC2) volume(id *string) (*ec2.Volume, error) {
+	vol, ok := f.volumes[aws.StringValue(id)]
+	if !ok {
+		return nil, awserr.New("InvalidVolume.NotFound", "Not found", nil)
+	}
+	return vol, nil
+}
 
-	// Add Devices
-	for _, test := range tests {
-		// Add a device to the instance
-		device, err := a.DeviceCreate(test.instance, &config.Class{
-			DiskSizeGb: test.size,
+// advance moves the volume to its next state. It must be called with the
+// lock held.
+func (f *fakeEC2) advance(vol *ec2.Volume) {
+	if *vol.State == ec2.VolumeStateCreating && !f.stuck {
+		vol.State = aws.String(ec2.VolumeStateAvailable)
+	}
+	for i, a := range vol.Attachments {
+		switch *a.State {
+		case ec2.VolumeAttachmentStateAttaching:
+			a.State = aws.String(ec2.VolumeAttachmentStateAttached)
+			vol.State = aws.String(ec2.VolumeStateInUse)
+		case ec2.VolumeAttachmentStateDetaching:
+			vol.Attachments = append(vol.Attachments[:i], vol.Attachments[i+1:]...)
+			vol.State = aws.String(ec2.VolumeStateAvailable)
+			instance := f.instances[*a.InstanceId]
+			for j, m := range instance.BlockDeviceMappings {
+				if *m.DeviceName == *a.Device {
+					instance.BlockDeviceMappings = append(
+						instance.BlockDeviceMappings[:j],
+						instance.BlockDeviceMappings[j+1:]...)
+					break
+				}
+			}
+			return
+		}
+	}
+}
+
+func (f *fakeEC2) DescribeInstancesWithContext(
+	ctx aws.Context,
+	input *ec2.DescribeInstancesInput,
+	opts ...request.Option,
+) (*ec2.DescribeInstancesOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	reservation := &ec2.Reservation{}
+	for _, id := range input.InstanceIds {
+		instance, ok := f.instances[*id]
+		if !ok {
+			return nil, awserr.New("InvalidInstanceID.NotFound", "Not found", nil)
+		}
+		reservation.Instances = append(reservation.Instances, instance)
+	}
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{reservation},
+	}, nil
+}
+
+func (f *fakeEC2) DescribeInstanceTypesWithContext(
+	ctx aws.Context,
+	input *ec2.DescribeInstanceTypesInput,
+	opts ...request.Option,
+) (*ec2.DescribeInstanceTypesOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	out := &ec2.DescribeInstanceTypesOutput{}
+	for _, instanceType := range input.InstanceTypes {
+		hypervisor, ok := f.types[*instanceType]
+		if !ok {
+			return nil, awserr.New("InvalidInstanceType", "Not found", nil)
+		}
+		out.InstanceTypes = append(out.InstanceTypes, &ec2.InstanceTypeInfo{
+			InstanceType: instanceType,
+			Hypervisor:   aws.String(hypervisor),
 		})
-		assert.Nil(t, err)
-		assert.NotNil(t, device)
-		assert.NotEmpty(t, device.Path)
-		assert.NotEmpty(t, device.ID)
-		assert.Equal(t, device.Size, test.size)
-
-		// Check that the device was added
-		ops := awsops.NewEc2Storage(test.instance, a.ec2c)
-		infoI, err := ops.Describe()
-		info := infoI.(*ec2.Instance)
-
-		assert.Nil(t, err)
-		assert.NotNil(t, info)
-
-		found := false
-		for _, bd := range info.BlockDeviceMappings {
-			if *bd.Ebs.VolumeId == device.ID {
-				found = true
-				assert.Equal(t, *bd.DeviceName, device.Path)
-				break
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) CreateVolumeWithContext(
+	ctx aws.Context,
+	input *ec2.CreateVolumeInput,
+	opts ...request.Option,
+) (*ec2.Volume, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	f.next++
+	vol := &ec2.Volume{
+		VolumeId:         aws.String(fmt.Sprintf("vol-%d", f.next)),
+		AvailabilityZone: input.AvailabilityZone,
+		Size:             input.Size,
+		VolumeType:       input.VolumeType,
+		State:            aws.String(ec2.VolumeStateCreating),
+	}
+	for _, spec := range input.TagSpecifications {
+		vol.Tags = append(vol.Tags, spec.Tags...)
+	}
+	f.volumes[*vol.VolumeId] = vol
+	f.hidden[*vol.VolumeId] = true
+	created := *vol
+	return &created, nil
+}
+
+func (f *fakeEC2) DescribeVolumesWithContext(
+	ctx aws.Context,
+	input *ec2.DescribeVolumesInput,
+	opts ...request.Option,
+) (*ec2.DescribeVolumesOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	out := &ec2.DescribeVolumesOutput{}
+	for _, id := range input.VolumeIds {
+		vol, err := f.volume(id)
+		if err != nil {
+			return nil, err
+		}
+		if f.hidden[*id] {
+			delete(f.hidden, *id)
+			return nil, awserr.New("InvalidVolume.NotFound", "Not found", nil)
+		}
+		f.advance(vol)
+		out.Volumes = append(out.Volumes, vol)
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) DescribeVolumesPagesWithContext(
+	ctx aws.Context,
+	input *ec2.DescribeVolumesInput,
+	fn func(*ec2.DescribeVolumesOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return err
+	}
+
+	out := &ec2.DescribeVolumesOutput{}
+	for _, vol := range f.volumes {
+		match := true
+		for _, filter := range input.Filters {
+			value := ""
+			for _, tag := range vol.Tags {
+				if "tag:"+*tag.Key == *filter.Name {
+					value = *tag.Value
+				}
+			}
+			match = match && value == *filter.Values[0]
+		}
+		if match {
+			out.Volumes = append(out.Volumes, vol)
+		}
+	}
+	fn(out, true)
+	return nil
+}
+
+func (f *fakeEC2) AttachVolumeWithContext(
+	ctx aws.Context,
+	input *ec2.AttachVolumeInput,
+	opts ...request.Option,
+) (*ec2.VolumeAttachment, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	vol, err := f.volume(input.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if *vol.State != ec2.VolumeStateAvailable {
+		return nil, awserr.New("IncorrectState", "Volume is not available", nil)
+	}
+	instance := f.instances[*input.InstanceId]
+	for _, m := range instance.BlockDeviceMappings {
+		if *m.DeviceName == *input.Device {
+			return nil, awserr.New("InvalidParameterValue", "Device in use", nil)
+		}
+	}
+	instance.BlockDeviceMappings = append(instance.BlockDeviceMappings,
+		&ec2.InstanceBlockDeviceMapping{DeviceName: input.Device})
+
+	attachment := &ec2.VolumeAttachment{
+		Device:     input.Device,
+		InstanceId: input.InstanceId,
+		VolumeId:   input.VolumeId,
+		State:      aws.String(ec2.VolumeAttachmentStateAttaching),
+	}
+	vol.Attachments = append(vol.Attachments, attachment)
+	return attachment, nil
+}
+
+func (f *fakeEC2) DetachVolumeWithContext(
+	ctx aws.Context,
+	input *ec2.DetachVolumeInput,
+	opts ...request.Option,
+) (*ec2.VolumeAttachment, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	vol, err := f.volume(input.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range vol.Attachments {
+		if *a.InstanceId == *input.InstanceId {
+			a.State = aws.String(ec2.VolumeAttachmentStateDetaching)
+			if f.vanish {
+				delete(f.volumes, *input.VolumeId)
 			}
+			return a, nil
 		}
-		assert.True(t, found)
-
-		// Delete device
-		err = a.DeviceDelete(test.instance, device.ID)
-		assert.Nil(t, err)
-
-		// Check that the device was added
-		infoI, err = ops.Describe()
-		info = infoI.(*ec2.Instance)
-		assert.Nil(t, err)
-		assert.NotNil(t, info)
-
-		found = false
-		for _, bd := range info.BlockDeviceMappings {
-			if *bd.Ebs.VolumeId == device.ID {
-				found = true
+	}
+	return nil, awserr.New("IncorrectState", "Volume is not attached", nil)
+}
+
+func (f *fakeEC2) DeleteVolumeWithContext(
+	ctx aws.Context,
+	input *ec2.DeleteVolumeInput,
+	opts ...request.Option,
+) (*ec2.DeleteVolumeOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	vol, err := f.volume(input.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if len(vol.Attachments) != 0 {
+		return nil, awserr.New("VolumeInUse", "Volume is in use", nil)
+	}
+	delete(f.volumes, *input.VolumeId)
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+func (f *fakeEC2) ModifyVolumeWithContext(
+	ctx aws.Context,
+	input *ec2.ModifyVolumeInput,
+	opts ...request.Option,
+) (*ec2.ModifyVolumeOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	vol, err := f.volume(input.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	vol.Size = input.Size
+	f.modified[*input.VolumeId] = ec2.VolumeModificationStateModifying
+	return &ec2.ModifyVolumeOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeVolumesModificationsWithContext(
+	ctx aws.Context,
+	input *ec2.DescribeVolumesModificationsInput,
+	opts ...request.Option,
+) (*ec2.DescribeVolumesModificationsOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.request(); err != nil {
+		return nil, err
+	}
+
+	out := &ec2.DescribeVolumesModificationsOutput{}
+	for _, id := range input.VolumeIds {
+		state, ok := f.modified[*id]
+		if !ok {
+			continue
+		}
+		out.VolumesModifications = append(out.VolumesModifications,
+			&ec2.VolumeModification{
+				VolumeId:          id,
+				ModificationState: aws.String(state),
+			})
+		f.modified[*id] = ec2.VolumeModificationStateOptimizing
+	}
+	return out, nil
+}
+
+func newTestProvider(f *fakeEC2, timeout time.Duration) *Provider {
+	p := newProvider(f)
+	p.timeout = timeout
+	p.pollInterval = time.Millisecond
+	p.backoff = time.Millisecond
+	p.SetConfig(&config.Config{ClusterID: "test"})
+	return p
+}
+
+func TestDeviceCreateDelete(t *testing.T) {
+	f := newFakeEC2(newFakeInstance("i-1"))
+	f.throttle = 3
+	p := newTestProvider(f, time.Second)
+	class := &config.Class{Name: "c1", DiskSizeGb: 8}
+
+	device, err := p.DeviceCreate("i-1", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/xvdf", device.Path)
+	assert.Equal(t, int64(8), device.Size)
+	assert.Equal(t, ec2.VolumeStateInUse, *f.volumes[device.ID].State)
+
+	second, err := p.DeviceCreate("i-1", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/xvdg", second.Path)
+
+	devices, err := p.ListDevices(map[string]string{
+		cloudprovider.LabelClusterID: "test",
+		cloudprovider.LabelClass:     "c1",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+	for _, d := range devices {
+		assert.Equal(t, "i-1", d.InstanceID)
+	}
+
+	// Throttled requests are retried while deleting too
+	f.throttle = 2
+	assert.NoError(t, p.DeviceDelete("i-1", device.ID))
+	assert.Len(t, f.volumes, 1)
+	assert.Len(t, f.instances["i-1"].BlockDeviceMappings, 2)
+	assert.Equal(t, cloudprovider.ErrDeviceNotFound, p.DeviceDelete("i-1", device.ID))
+
+	// The free device name is used again
+	device, err = p.DeviceCreate("i-1", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/xvdf", device.Path)
+
+	// A volume deleted while detaching is not waited for
+	f.vanish = true
+	assert.Equal(t, cloudprovider.ErrDeviceNotFound, p.DeviceDelete("i-1", device.ID))
+}
+
+func TestDeviceCreateTimeout(t *testing.T) {
+	f := newFakeEC2(newFakeInstance("i-1"))
+	f.stuck = true
+	p := newTestProvider(f, 50*time.Millisecond)
+
+	_, err := p.DeviceCreate("i-1", &config.Class{Name: "c1", DiskSizeGb: 8})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "did not become available")
+	assert.Empty(t, f.volumes)
+}
+
+func TestDeviceCreateMaxDevices(t *testing.T) {
+	xen := newFakeInstance("i-2")
+	xen.InstanceType = aws.String("m4.large")
+	f := newFakeEC2(newFakeInstance("i-1"), xen)
+	p := newTestProvider(f, time.Second)
+
+	for _, id := range []string{"i-1", "i-2"} {
+		max, err := p.MaxDevices(id)
+		assert.NoError(t, err)
+		paths := make(map[string]bool)
+		for i := 0; i < max; i++ {
+			device, err := p.DeviceCreate(id, &config.Class{Name: "c1", DiskSizeGb: 8})
+			if !assert.NoError(t, err, "device %d of %d on %s", i+1, max, id) {
 				break
 			}
+			assert.False(t, paths[device.Path], device.Path)
+			paths[device.Path] = true
 		}
-		assert.False(t, found)
+		assert.Len(t, paths, max)
+	}
+}
+
+func TestDeviceCreateLimit(t *testing.T) {
+	devices := make([]string, 0)
+	for c := 'f'; c <= 'z'; c++ {
+		devices = append(devices, "/dev/sd"+string(c))
 	}
+	for _, first := range "bc" {
+		for c := 'a'; c <= 'z'; c++ {
+			devices = append(devices, "/dev/sd"+string(first)+string(c))
+		}
+	}
+	f := newFakeEC2(newFakeInstance("i-1", devices...))
+	p := newTestProvider(f, time.Second)
+
+	_, err := p.DeviceCreate("i-1", &config.Class{Name: "c1", DiskSizeGb: 8})
+	assert.Equal(t, cloudprovider.ErrDeviceLimit, err)
+	assert.Empty(t, f.volumes)
+}
+
+func TestDeviceResize(t *testing.T) {
+	f := newFakeEC2(newFakeInstance("i-1"))
+	p := newTestProvider(f, time.Second)
+
+	device, err := p.DeviceCreate("i-1", &config.Class{Name: "c1", DiskSizeGb: 8})
+	assert.NoError(t, err)
+
+	resized, err := p.DeviceResize("i-1", device.ID, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16), resized.Size)
+	assert.Equal(t, device.Path, resized.Path)
+	assert.Equal(t, int64(16), *f.volumes[device.ID].Size)
+
+	// A larger volume is not shrunk
+	resized, err = p.DeviceResize("i-1", device.ID, 12)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16), resized.Size)
+
+	_, err = p.DeviceResize("i-1", "vol-missing", 16)
+	assert.Equal(t, cloudprovider.ErrDeviceNotFound, err)
+}
+
+func TestRetry(t *testing.T) {
+	p := newTestProvider(newFakeEC2(), time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// Throttled requests are retried until the context is done
+	calls := 0
+	err := p.retry(ctx, func() error {
+		calls++
+		return awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+	})
+	assert.True(t, isThrottled(err))
+	assert.True(t, calls > 1)
+
+	// Other errors are returned at once
+	calls = 0
+	err = p.retry(context.Background(), func() error {
+		calls++
+		return awserr.New("InvalidVolume.NotFound", "Not found", nil)
+	})
+	assert.True(t, isNotFound(err))
+	assert.Equal(t, 1, calls)
+}
+
+func TestMaxDevices(t *testing.T) {
+	xen := newFakeInstance("i-2")
+	xen.InstanceType = aws.String("m4.large")
+	unknown := newFakeInstance("i-3")
+	unknown.InstanceType = aws.String("m1.small")
+	f := newFakeEC2(newFakeInstance("i-1"), xen, unknown)
+	f.throttle = 1
+	p := newTestProvider(f, time.Second)
+
+	max, err := p.MaxDevices("i-1")
+	assert.NoError(t, err)
+	assert.Equal(t, 26, max)
+
+	max, err = p.MaxDevices("i-2")
+	assert.NoError(t, err)
+	assert.Equal(t, 39, max)
+
+	_, err = p.MaxDevices("i-3")
+	assert.Error(t, err)
+	_, err = p.MaxDevices("i-4")
+	assert.Error(t, err)
+}
+
+func TestDeviceFromVolume(t *testing.T) {
+	vol := &ec2.Volume{
+		VolumeId: aws.String("vol-1"),
+		Size:     aws.Int64(8),
+		Tags: []*ec2.Tag{
+			{Key: aws.String(cloudprovider.LabelClusterID), Value: aws.String("test")},
+			{Key: aws.String(cloudprovider.LabelClass), Value: aws.String("c1")},
+		},
+		Attachments: []*ec2.VolumeAttachment{
+			{
+				InstanceId: aws.String("i-1"),
+				Device:     aws.String("/dev/xvdf"),
+				State:      aws.String(ec2.VolumeAttachmentStateAttached),
+			},
+		},
+	}
+	device := deviceFromVolume(vol)
+	assert.Equal(t, "vol-1", device.ID)
+	assert.Equal(t, int64(8), device.Size)
+	assert.Equal(t, "i-1", device.InstanceID)
+	assert.Equal(t, "/dev/xvdf", device.Path)
+	assert.True(t, cloudprovider.MatchLabels(device.Labels, map[string]string{
+		cloudprovider.LabelClusterID: "test",
+		cloudprovider.LabelClass:     "c1",
+	}))
+
+	vol.Attachments[0].State = aws.String(ec2.VolumeAttachmentStateDetached)
+	device = deviceFromVolume(vol)
+	assert.Empty(t, device.InstanceID)
 }
@@ -0,0 +1,291 @@
+/*
+Package aws implements the cloud interface for AWS
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ec2API is the subset of the EC2 client used by the provider. It is
+// satisfied by *ec2.EC2 and can be replaced by a fake in tests.
+type ec2API interface {
+	DescribeInstancesWithContext(aws.Context, *ec2.DescribeInstancesInput, ...request.Option) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceTypesWithContext(aws.Context, *ec2.DescribeInstanceTypesInput, ...request.Option) (*ec2.DescribeInstanceTypesOutput, error)
+	CreateVolumeWithContext(aws.Context, *ec2.CreateVolumeInput, ...request.Option) (*ec2.Volume, error)
+	DescribeVolumesWithContext(aws.Context, *ec2.DescribeVolumesInput, ...request.Option) (*ec2.DescribeVolumesOutput, error)
+	DescribeVolumesPagesWithContext(aws.Context, *ec2.DescribeVolumesInput, func(*ec2.DescribeVolumesOutput, bool) bool, ...request.Option) error
+	AttachVolumeWithContext(aws.Context, *ec2.AttachVolumeInput, ...request.Option) (*ec2.VolumeAttachment, error)
+	DetachVolumeWithContext(aws.Context, *ec2.DetachVolumeInput, ...request.Option) (*ec2.VolumeAttachment, error)
+	DeleteVolumeWithContext(aws.Context, *ec2.DeleteVolumeInput, ...request.Option) (*ec2.DeleteVolumeOutput, error)
+	ModifyVolumeWithContext(aws.Context, *ec2.ModifyVolumeInput, ...request.Option) (*ec2.ModifyVolumeOutput, error)
+	DescribeVolumesModificationsWithContext(aws.Context, *ec2.DescribeVolumesModificationsInput, ...request.Option) (*ec2.DescribeVolumesModificationsOutput, error)
+}
+
+const (
+	// defaultTimeout bounds each call to the provider, including the time
+	// spent waiting for volumes to change state
+	defaultTimeout = 5 * time.Minute
+
+	// defaultPollInterval is the time between two checks of a volume state
+	defaultPollInterval = 2 * time.Second
+
+	// defaultBackoff is the first delay before retrying a throttled
+	// request. It doubles on every attempt up to maxBackoff.
+	defaultBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+
+	// newVolumeVisibility is how long a new volume may not be found
+	// after it is created
+	newVolumeVisibility = 30 * time.Second
+)
+
+// retry calls fn until it succeeds, fails with an error other than
+// throttling, or the context is done. Throttled requests are retried with
+// an exponential backoff.
+func (p *Provider) retry(ctx context.Context, fn func() error) error {
+	backoff := p.backoff
+	for {
+		err := fn()
+		if err == nil || !isThrottled(err) {
+			return err
+		}
+		logrus.Debugf("AWS request throttled, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// describeInstance returns the instance with the given id
+func (p *Provider) describeInstance(
+	ctx context.Context,
+	instanceID string,
+) (*ec2.Instance, error) {
+	var out *ec2.DescribeInstancesOutput
+	err := p.retry(ctx, func() (err error) {
+		out, err = p.ec2.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get instance %s: %v", instanceID, err)
+	}
+	for _, reservation := range out.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.StringValue(instance.InstanceId) == instanceID {
+				return instance, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Instance %s not found", instanceID)
+}
+
+// describeInstanceType returns the description of an instance type
+func (p *Provider) describeInstanceType(
+	ctx context.Context,
+	instanceType string,
+) (*ec2.InstanceTypeInfo, error) {
+	var out *ec2.DescribeInstanceTypesOutput
+	err := p.retry(ctx, func() (err error) {
+		out, err = p.ec2.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{
+			InstanceTypes: []*string{aws.String(instanceType)},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get instance type %s: %v", instanceType, err)
+	}
+	for _, info := range out.InstanceTypes {
+		if aws.StringValue(info.InstanceType) == instanceType {
+			return info, nil
+		}
+	}
+	return nil, fmt.Errorf("Instance type %s not found", instanceType)
+}
+
+// describeVolume returns the volume with the given id. A missing volume
+// is reported as an InvalidVolume.NotFound error.
+func (p *Provider) describeVolume(
+	ctx context.Context,
+	volumeID string,
+) (*ec2.Volume, error) {
+	var out *ec2.DescribeVolumesOutput
+	err := p.retry(ctx, func() (err error) {
+		out, err = p.ec2.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Volumes) != 1 {
+		return nil, awserr.New("InvalidVolume.NotFound",
+			fmt.Sprintf("The volume '%s' does not exist.", volumeID), nil)
+	}
+	return out.Volumes[0], nil
+}
+
+// waitVolume polls the volume until ready returns true, ready fails, or
+// the context is done. A volume which is not found is polled again for
+// the visibility period, since a volume is not always visible right after
+// it is created. After that the InvalidVolume.NotFound error is returned,
+// which means the volume was deleted.
+func (p *Provider) waitVolume(
+	ctx context.Context,
+	volumeID, desc string,
+	visibility time.Duration,
+	ready func(*ec2.Volume) (bool, error),
+) (*ec2.Volume, error) {
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+
+	visible := time.Now().Add(visibility)
+	for {
+		vol, err := p.describeVolume(ctx, volumeID)
+		if err == nil {
+			done, err := ready(vol)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return vol, nil
+			}
+		} else if !isNotFound(err) {
+			return nil, fmt.Errorf("Failed to get volume %s: %v", volumeID, err)
+		} else if time.Now().After(visible) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Timed out waiting for volume %s to be %s",
+				volumeID,
+				desc)
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitVolumeState waits until the volume is in the given state. A volume
+// which is not found is polled again for the visibility period.
+func (p *Provider) waitVolumeState(
+	ctx context.Context,
+	volumeID, state string,
+	visibility time.Duration,
+) (*ec2.Volume, error) {
+	return p.waitVolume(ctx, volumeID, state, visibility, func(vol *ec2.Volume) (bool, error) {
+		switch current := aws.StringValue(vol.State); current {
+		case state:
+			return true, nil
+		case ec2.VolumeStateError:
+			return false, fmt.Errorf("Volume %s is in state %s", volumeID, current)
+		}
+		return false, nil
+	})
+}
+
+// waitAttachment waits until the attachment of the volume to the instance
+// is in the given state. A volume without an attachment to the instance
+// is detached.
+func (p *Provider) waitAttachment(
+	ctx context.Context,
+	volumeID, instanceID, state string,
+) (*ec2.Volume, error) {
+	return p.waitVolume(ctx, volumeID, state, 0, func(vol *ec2.Volume) (bool, error) {
+		current := ec2.VolumeAttachmentStateDetached
+		for _, a := range vol.Attachments {
+			if aws.StringValue(a.InstanceId) == instanceID {
+				current = aws.StringValue(a.State)
+			}
+		}
+		return current == state, nil
+	})
+}
+
+// freeDeviceName returns a device name which is not used by the instance.
+// Names use the prefix of the root device and the letters f to z
+// recommended for EBS volumes, followed by ba to cz, which gives names to
+// more volumes than MaxDevices allows on any instance type.
+func freeDeviceName(instance *ec2.Instance) (string, error) {
+	root := aws.StringValue(instance.RootDeviceName)
+	prefix := ""
+	for _, p := range []string{"/dev/sd", "/dev/xvd"} {
+		if strings.HasPrefix(root, p) {
+			prefix = p
+		}
+	}
+	if len(prefix) == 0 {
+		return "", fmt.Errorf("Unknown prefix on root device %q", root)
+	}
+
+	used := make(map[string]bool)
+	for _, mapping := range instance.BlockDeviceMappings {
+		name := aws.StringValue(mapping.DeviceName)
+		name = strings.TrimPrefix(name, "/dev/")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "xvd"), "sd")
+		used[name] = true
+	}
+	for c := 'f'; c <= 'z'; c++ {
+		if !used[string(c)] {
+			return prefix + string(c), nil
+		}
+	}
+	for _, first := range "bc" {
+		for c := 'a'; c <= 'z'; c++ {
+			if name := string(first) + string(c); !used[name] {
+				return prefix + name, nil
+			}
+		}
+	}
+	return "", cloudprovider.ErrDeviceLimit
+}
+
+func isThrottled(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "RequestLimitExceeded", "Throttling":
+			return true
+		}
+	}
+	return false
+}
+
+func isIncorrectState(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "IncorrectState"
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+/*
+Package aws implements the cloud interface for AWS
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+)
+
+// Keys supported in config.Class.Parameters
+const (
+	// ParameterType is the EBS volume type: gp2, gp3, io1, io2, st1 or
+	// sc1. Defaults to gp2.
+	ParameterType = "type"
+
+	// ParameterIOPS is the provisioned IOPS. Required by io1 and io2,
+	// optional for gp3.
+	ParameterIOPS = "iops"
+
+	// ParameterThroughput is the provisioned throughput in MiB/s.
+	// Only supported by gp3.
+	ParameterThroughput = "throughput"
+
+	// ParameterEncrypted is true to encrypt the volume
+	ParameterEncrypted = "encrypted"
+
+	// ParameterKmsKeyID is the KMS key used to encrypt the volume.
+	// Requires encrypted to be true.
+	ParameterKmsKeyID = "kmsKeyId"
+
+	// ParameterTags are the tags added to the volume as a comma
+	// separated list of key=value pairs
+	ParameterTags = "tags"
+)
+
+// volumeTypeLimits holds the rules of an EBS volume type. Sizes are in
+// GiB and throughput in MiB/s. The defaultIOPS of a volume type are
+// allowed at any size, the IOPS per GiB limit only applies above them.
+type volumeTypeLimits struct {
+	minSize         int64
+	maxSize         int64
+	iopsRequired    bool
+	minIOPS         int64
+	maxIOPS         int64
+	maxIOPSPerGb    int64
+	defaultIOPS     int64
+	minThroughput   int64
+	maxThroughput   int64
+	maxMiBPerKIOPS  int64
+	allowIOPS       bool
+	allowThroughput bool
+}
+
+var volumeTypes = map[string]volumeTypeLimits{
+	"gp2": {
+		minSize: 1,
+		maxSize: 16384,
+	},
+	"gp3": {
+		minSize:         1,
+		maxSize:         16384,
+		allowIOPS:       true,
+		minIOPS:         3000,
+		maxIOPS:         16000,
+		maxIOPSPerGb:    500,
+		defaultIOPS:     3000,
+		allowThroughput: true,
+		minThroughput:   125,
+		maxThroughput:   1000,
+		maxMiBPerKIOPS:  250,
+	},
+	"io1": {
+		minSize:      4,
+		maxSize:      16384,
+		allowIOPS:    true,
+		iopsRequired: true,
+		minIOPS:      100,
+		maxIOPS:      64000,
+		maxIOPSPerGb: 50,
+	},
+	"io2": {
+		minSize:      4,
+		maxSize:      16384,
+		allowIOPS:    true,
+		iopsRequired: true,
+		minIOPS:      100,
+		maxIOPS:      64000,
+		maxIOPSPerGb: 500,
+	},
+	"st1": {
+		minSize: 125,
+		maxSize: 16384,
+	},
+	"sc1": {
+		minSize: 125,
+		maxSize: 16384,
+	},
+}
+
+// volumeParameters are the values parsed from the class parameters
+type volumeParameters struct {
+	volumeType string
+	iops       int64
+	throughput int64
+	encrypted  bool
+	kmsKeyID   string
+	tags       map[string]string
+}
+
+// parseParameters parses and validates the parameters of the class
+// against the rules of the volume type and the disk size of the class
+func parseParameters(class *config.Class) (*volumeParameters, error) {
+	v := &volumeParameters{
+		volumeType: ec2.VolumeTypeGp2,
+		tags:       make(map[string]string),
+	}
+
+	var err error
+	for key, value := range class.Parameters {
+		switch key {
+		case ParameterType:
+			v.volumeType = value
+		case ParameterIOPS:
+			v.iops, err = strconv.ParseInt(value, 10, 64)
+		case ParameterThroughput:
+			v.throughput, err = strconv.ParseInt(value, 10, 64)
+		case ParameterEncrypted:
+			v.encrypted, err = strconv.ParseBool(value)
+		case ParameterKmsKeyID:
+			v.kmsKeyID = value
+		case ParameterTags:
+			v.tags, err = cloudprovider.ParseKeyValues(value)
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid parameter %s=%s for class %s: %v",
+				key,
+				value,
+				class.Name,
+				err)
+		}
+	}
+
+	if err := v.validate(class.DiskSizeGb); err != nil {
+		return nil, fmt.Errorf("Invalid parameters for class %s: %v", class.Name, err)
+	}
+	return v, nil
+}
+
+// validate checks the parameters against the rules of the volume type
+func (v *volumeParameters) validate(sizeGb int64) error {
+	limits, ok := volumeTypes[v.volumeType]
+	if !ok {
+		return fmt.Errorf("unsupported volume type %s", v.volumeType)
+	}
+
+	if sizeGb < limits.minSize || sizeGb > limits.maxSize {
+		return fmt.Errorf("%s volumes must be between %d and %d GiB, not %d",
+			v.volumeType,
+			limits.minSize,
+			limits.maxSize,
+			sizeGb)
+	}
+
+	if v.iops != 0 && !limits.allowIOPS {
+		return fmt.Errorf("%s volumes do not support provisioned IOPS", v.volumeType)
+	}
+	if v.iops == 0 && limits.iopsRequired {
+		return fmt.Errorf("%s volumes require iops", v.volumeType)
+	}
+	if v.iops != 0 {
+		if v.iops < limits.minIOPS || v.iops > limits.maxIOPS {
+			return fmt.Errorf("%s volumes must have between %d and %d IOPS, not %d",
+				v.volumeType,
+				limits.minIOPS,
+				limits.maxIOPS,
+				v.iops)
+		}
+		if v.iops > limits.defaultIOPS && v.iops > limits.maxIOPSPerGb*sizeGb {
+			return fmt.Errorf("%s volumes support at most %d IOPS per GiB, "+
+				"%d IOPS is too many for %d GiB",
+				v.volumeType,
+				limits.maxIOPSPerGb,
+				v.iops,
+				sizeGb)
+		}
+	}
+
+	if v.throughput != 0 && !limits.allowThroughput {
+		return fmt.Errorf("%s volumes do not support provisioned throughput", v.volumeType)
+	}
+	if v.throughput != 0 {
+		if v.throughput < limits.minThroughput || v.throughput > limits.maxThroughput {
+			return fmt.Errorf("%s volumes must have between %d and %d MiB/s, not %d",
+				v.volumeType,
+				limits.minThroughput,
+				limits.maxThroughput,
+				v.throughput)
+		}
+		iops := v.iops
+		if iops == 0 {
+			iops = limits.defaultIOPS
+		}
+		if v.throughput*1000 > limits.maxMiBPerKIOPS*iops {
+			return fmt.Errorf("%s volumes support at most %d MiB/s per 1000 IOPS, "+
+				"%d MiB/s is too much for %d IOPS",
+				v.volumeType,
+				limits.maxMiBPerKIOPS,
+				v.throughput,
+				iops)
+		}
+	}
+
+	if len(v.kmsKeyID) != 0 && !v.encrypted {
+		return fmt.Errorf("%s requires %s to be true", ParameterKmsKeyID, ParameterEncrypted)
+	}
+	return nil
+}
+
+// createVolumeInput returns the request to create a volume with these
+// parameters
+func (v *volumeParameters) createVolumeInput(
+	availabilityZone *string,
+	sizeGb int64,
+) *ec2.CreateVolumeInput {
+	input := &ec2.CreateVolumeInput{
+		AvailabilityZone: availabilityZone,
+		Size:             aws.Int64(sizeGb),
+		VolumeType:       aws.String(v.volumeType),
+	}
+	if v.iops != 0 {
+		input.Iops = aws.Int64(v.iops)
+	}
+	if v.throughput != 0 {
+		input.Throughput = aws.Int64(v.throughput)
+	}
+	if v.encrypted {
+		input.Encrypted = aws.Bool(true)
+	}
+	if len(v.kmsKeyID) != 0 {
+		input.KmsKeyId = aws.String(v.kmsKeyID)
+	}
+	if len(v.tags) != 0 {
+		keys := make([]string, 0, len(v.tags))
+		for key := range v.tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		tags := make([]*ec2.Tag, len(keys))
+		for i, key := range keys {
+			tags[i] = &ec2.Tag{
+				Key:   aws.String(key),
+				Value: aws.String(v.tags[key]),
+			}
+		}
+		input.TagSpecifications = []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeVolume),
+			Tags:         tags,
+		}}
+	}
+	return input
+}
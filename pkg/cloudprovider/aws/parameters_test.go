@@ -0,0 +1,123 @@
+/*
+Package aws implements the cloud interface for AWS
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseParameters(t *testing.T) {
+	tests := []struct {
+		size   int64
+		params map[string]string
+		valid  bool
+	}{
+		{100, nil, true},
+		{100, map[string]string{"type": "gp2"}, true},
+		{100, map[string]string{"type": "gp2", "iops": "1000"}, false},
+		{100, map[string]string{"type": "gp3"}, true},
+		{100, map[string]string{"type": "gp3", "iops": "6000", "throughput": "500"}, true},
+		{100, map[string]string{"type": "gp3", "throughput": "1000"}, false},
+		{100, map[string]string{"type": "gp3", "iops": "2000"}, false},
+		{10, map[string]string{"type": "gp3", "iops": "6000"}, false},
+		{1, map[string]string{"type": "gp3", "iops": "3000"}, true},
+		{1, map[string]string{"type": "gp3", "iops": "3000", "throughput": "750"}, true},
+		{7, map[string]string{"type": "gp3", "iops": "4000"}, false},
+		{8, map[string]string{"type": "gp3", "iops": "4000"}, true},
+		{100, map[string]string{"type": "io1"}, false},
+		{100, map[string]string{"type": "io1", "iops": "5000"}, true},
+		{100, map[string]string{"type": "io1", "iops": "6000"}, false},
+		{100, map[string]string{"type": "io2", "iops": "50000"}, true},
+		{100, map[string]string{"type": "io1", "iops": "5000", "throughput": "200"}, false},
+		{100, map[string]string{"type": "st1"}, false},
+		{500, map[string]string{"type": "st1"}, true},
+		{500, map[string]string{"type": "sc1", "iops": "100"}, false},
+		{100, map[string]string{"type": "standard"}, false},
+		{100, map[string]string{"iops": "abc"}, false},
+		{100, map[string]string{"encrypted": "true", "kmsKeyId": "key"}, true},
+		{100, map[string]string{"kmsKeyId": "key"}, false},
+		{100, map[string]string{"encrypted": "maybe"}, false},
+		{100, map[string]string{"tags": "team=storage, env=prod"}, true},
+		{100, map[string]string{"tags": "team"}, false},
+		{100, map[string]string{"unknown": "value"}, false},
+	}
+
+	for i, test := range tests {
+		class := &config.Class{
+			Name:       "test",
+			DiskSizeGb: test.size,
+			Parameters: test.params,
+		}
+		_, err := parseParameters(class)
+		assert.Equal(t, test.valid, err == nil, "test %d: %v", i, err)
+	}
+}
+
+func TestCreateVolumeInput(t *testing.T) {
+	class := &config.Class{
+		Name:       "test",
+		DiskSizeGb: 100,
+		Parameters: map[string]string{
+			"type":       "gp3",
+			"iops":       "4000",
+			"throughput": "250",
+			"encrypted":  "true",
+			"kmsKeyId":   "key",
+			"tags":       "team=storage,env=prod",
+		},
+	}
+	params, err := parseParameters(class)
+	assert.NoError(t, err)
+
+	input := params.createVolumeInput(aws.String("us-east-1a"), class.DiskSizeGb)
+	assert.Equal(t, "gp3", *input.VolumeType)
+	assert.Equal(t, int64(100), *input.Size)
+	assert.Equal(t, int64(4000), *input.Iops)
+	assert.Equal(t, int64(250), *input.Throughput)
+	assert.True(t, *input.Encrypted)
+	assert.Equal(t, "key", *input.KmsKeyId)
+	assert.Len(t, input.TagSpecifications, 1)
+	tags := input.TagSpecifications[0].Tags
+	assert.Len(t, tags, 2)
+	assert.Equal(t, "env", *tags[0].Key)
+	assert.Equal(t, "prod", *tags[0].Value)
+	assert.Equal(t, "team", *tags[1].Key)
+
+}
+
+func TestValidateClass(t *testing.T) {
+	class := config.Class{
+		Name:               "fast",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         100,
+		MaximumTotalSizeGb: 1000,
+		Parameters:         map[string]string{"type": "gp3"},
+	}
+	c := &config.Config{Classes: []config.Class{class}}
+	assert.NoError(t, c.Validate(&Provider{}))
+
+	// Invalid parameters fail the configuration
+	c.Classes[0].Parameters["iops"] = "100000"
+	err := c.Validate(&Provider{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "class fast")
+}
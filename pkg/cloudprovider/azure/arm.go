@@ -0,0 +1,249 @@
+/*
+Package azure implements the cloud interface for Azure
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package azure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Subset of the Azure Resource Manager API used by the provider
+
+type armDisk struct {
+	ID         string            `json:"id,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Location   string            `json:"location,omitempty"`
+	Zones      []string          `json:"zones,omitempty"`
+	ManagedBy  string            `json:"managedBy,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Sku        *armSku           `json:"sku,omitempty"`
+	Properties armDiskProperties `json:"properties"`
+}
+
+type armSku struct {
+	Name string `json:"name"`
+}
+
+type armDiskProperties struct {
+	CreationData *armCreationData `json:"creationData,omitempty"`
+	DiskSizeGB   int64            `json:"diskSizeGB,omitempty"`
+}
+
+type armCreationData struct {
+	CreateOption string `json:"createOption"`
+}
+
+type armDiskList struct {
+	Value    []*armDisk `json:"value"`
+	NextLink string     `json:"nextLink"`
+}
+
+type armVM struct {
+	Name       string          `json:"name,omitempty"`
+	Location   string          `json:"location,omitempty"`
+	Zones      []string        `json:"zones,omitempty"`
+	Properties armVMProperties `json:"properties"`
+}
+
+type armVMProperties struct {
+	StorageProfile armStorageProfile `json:"storageProfile"`
+}
+
+type armStorageProfile struct {
+	DataDisks []armDataDisk `json:"dataDisks"`
+}
+
+type armDataDisk struct {
+	Lun          int            `json:"lun"`
+	Name         string         `json:"name,omitempty"`
+	CreateOption string         `json:"createOption"`
+	ManagedDisk  *armManagedRef `json:"managedDisk,omitempty"`
+}
+
+type armManagedRef struct {
+	ID string `json:"id"`
+}
+
+type armOperation struct {
+	Status string    `json:"status"`
+	Error  *armError `json:"error,omitempty"`
+}
+
+type armError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiError is returned for responses other than 2xx and for failed
+// asynchronous operations
+type apiError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("Operation failed: %s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("Azure returned %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// resourceURL returns the URL of a resource in the resource group
+func (p *Provider) resourceURL(resource string) string {
+	return fmt.Sprintf("%ssubscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/%s?api-version=%s",
+		p.endpoint,
+		p.subscription,
+		p.resourceGroup,
+		resource,
+		apiVersion)
+}
+
+// do sends a request and decodes the response into out, if not nil.
+// If the response has an Azure-AsyncOperation or Location header, it
+// waits for the operation to complete whatever the status code, since
+// updating a VM returns 200 while its disks are still being changed.
+func (p *Provider) do(method, u string, in, out interface{}) error {
+	resp, data, err := p.send(method, u, in)
+	if err != nil {
+		return err
+	}
+
+	if async := resp.Header.Get("Azure-AsyncOperation"); len(async) != 0 {
+		if err := p.wait(async); err != nil {
+			return err
+		}
+	} else if location := resp.Header.Get("Location"); len(location) != 0 {
+		if data, err = p.waitLocation(location); err != nil {
+			return err
+		}
+	}
+	if out != nil && len(data) != 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// wait polls an asynchronous operation until it completes
+func (p *Provider) wait(u string) error {
+	deadline := time.Now().Add(p.timeout)
+	for {
+		op := &armOperation{}
+		_, data, err := p.send("GET", u, nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, op); err != nil {
+			return err
+		}
+
+		switch op.Status {
+		case "Succeeded":
+			return nil
+		case "Failed", "Canceled":
+			e := &apiError{Code: op.Status}
+			if op.Error != nil {
+				e.Code = op.Error.Code
+				e.Message = op.Error.Message
+			}
+			return e
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for operation %s", u)
+		}
+		time.Sleep(p.pollInterval)
+	}
+}
+
+// waitLocation polls the location of an asynchronous operation until it
+// stops returning 202 and returns the body of the final response
+func (p *Provider) waitLocation(u string) ([]byte, error) {
+	deadline := time.Now().Add(p.timeout)
+	for {
+		resp, data, err := p.send("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			return data, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for operation %s", u)
+		}
+		time.Sleep(p.pollInterval)
+	}
+}
+
+// send sends a request returning an error for responses other than 2xx
+func (p *Provider) send(method, u string, in interface{}) (*http.Response, []byte, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := p.token()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to get access token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &apiError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		var body struct {
+			Error armError `json:"error"`
+		}
+		if json.Unmarshal(data, &body) == nil && len(body.Error.Code) != 0 {
+			e.Code = body.Error.Code
+			e.Message = body.Error.Message
+		}
+		return nil, nil, e
+	}
+	return resp, data, nil
+}
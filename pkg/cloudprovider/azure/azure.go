@@ -0,0 +1,453 @@
+/*
+Package azure implements the cloud interface for Azure
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	armEndpoint = "https://management.azure.com/"
+	imdsToken   = "http://169.254.169.254/metadata/identity/oauth2/token" +
+		"?api-version=2018-02-01&resource=https%3A%2F%2Fmanagement.azure.com%2F"
+	apiVersion = "2018-06-01"
+
+	// maxLuns is the number of LUNs of the data disk controller. The size
+	// of the VM may allow fewer data disks.
+	maxLuns = 64
+
+	// Time between checks of an operation in progress
+	pollInterval = 2 * time.Second
+
+	// Time to wait for an operation to complete
+	operationTimeout = 5 * time.Minute
+
+	// Time to wait for the reply to a single request
+	requestTimeout = time.Minute
+)
+
+// httpClient is used for Resource Manager and the instance metadata service
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+var errNoFreeLun = fmt.Errorf("No free LUN")
+
+// TokenSource returns an OAuth2 access token for Azure Resource Manager
+type TokenSource func() (string, error)
+
+// Provider has the client and state information to communicate with Azure
+// Resource Manager. Instance ids are VM names and device ids are managed
+// disk names, all in the same resource group.
+type Provider struct {
+	client        *http.Client
+	endpoint      string
+	subscription  string
+	resourceGroup string
+	token         TokenSource
+	pollInterval  time.Duration
+	timeout       time.Duration
+
+	// clusterID is set as a tag on every disk created
+	lock      sync.Mutex
+	clusterID string
+
+	// vmLock serializes changes to the data disks of the VMs
+	vmLock sync.Mutex
+}
+
+// NewProvider provides an implementation of cloudprovider.Interface for the
+// subscription and resource group in AZURE_SUBSCRIPTION_ID and
+// AZURE_RESOURCE_GROUP, authenticated with the managed identity of the VM
+func NewProvider() *Provider {
+	subscription := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	if len(subscription) == 0 {
+		logrus.Errorf("AZURE_SUBSCRIPTION_ID not defined")
+		return nil
+	}
+	resourceGroup := os.Getenv("AZURE_RESOURCE_GROUP")
+	if len(resourceGroup) == 0 {
+		logrus.Errorf("AZURE_RESOURCE_GROUP not defined")
+		return nil
+	}
+
+	return NewProviderWithEndpoint(armEndpoint,
+		subscription,
+		resourceGroup,
+		managedIdentityTokenSource(),
+		httpClient)
+}
+
+// NewProviderWithEndpoint provides an implementation of
+// cloudprovider.Interface using Azure Resource Manager at the endpoint
+// provided
+func NewProviderWithEndpoint(
+	endpoint, subscription, resourceGroup string,
+	token TokenSource,
+	client *http.Client,
+) *Provider {
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+	return &Provider{
+		client:        client,
+		endpoint:      endpoint,
+		subscription:  subscription,
+		resourceGroup: resourceGroup,
+		token:         token,
+		pollInterval:  pollInterval,
+		timeout:       operationTimeout,
+	}
+}
+
+// SetConfig saves the cluster ID set as a tag on new disks
+func (p *Provider) SetConfig(config *config.Config) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clusterID = config.ClusterID
+}
+
+// ValidateClass checks the disk SKU and tags of the class
+func (p *Provider) ValidateClass(class *config.Class) error {
+	_, err := parseParameters(class)
+	return err
+}
+
+// DeviceCreate creates a managed disk in the location and zone of the VM
+// and attaches it to the first free LUN
+func (p *Provider) DeviceCreate(
+	instanceID string,
+	class *config.Class,
+) (*cloudprovider.Device, error) {
+
+	// Get the disk parameters from the class
+	params, err := parseParameters(class)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the location of the VM
+	vm, err := p.getVM(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tag the disk so it can be found by ListDevices
+	p.lock.Lock()
+	labels := cloudprovider.DeviceLabels(p.clusterID, class, instanceID, time.Now())
+	p.lock.Unlock()
+	for key, value := range labels {
+		params.tags[key] = value
+	}
+
+	// Create a disk
+	name := "rico-" + uuid.New()
+	err = p.do("PUT", p.resourceURL("disks/"+name), &armDisk{
+		Location: vm.Location,
+		Zones:    vm.Zones,
+		Tags:     params.tags,
+		Sku:      &armSku{Name: params.sku},
+		Properties: armDiskProperties{
+			CreationData: &armCreationData{CreateOption: "Empty"},
+			DiskSizeGB:   class.DiskSizeGb,
+		},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create disk: %v", err)
+	}
+
+	// Attach the disk
+	lun, err := p.attach(instanceID, name)
+	if err != nil {
+		reterr := fmt.Errorf("Unable to attach disk %s to %s: %v",
+			name,
+			instanceID,
+			err)
+		logrus.Error(reterr)
+		if err := p.do("DELETE", p.resourceURL("disks/"+name), nil, nil); err != nil {
+			logrus.Errorf("Failed to delete disk %s: %v", name, err)
+		}
+		if isAttachmentLimit(err) {
+			return nil, cloudprovider.ErrDeviceLimit
+		}
+		return nil, reterr
+	}
+
+	return &cloudprovider.Device{
+		ID:   name,
+		Path: lunPath(lun),
+		Size: class.DiskSizeGb,
+	}, nil
+}
+
+// DeviceDelete detaches the disk from the specified VM, then deletes it.
+// The detach is skipped if the instance id is empty.
+func (p *Provider) DeviceDelete(instanceID string, deviceID string) error {
+	// Azure accepts deleting a disk which does not exist
+	if err := p.do("GET", p.resourceURL("disks/"+deviceID), nil, nil); err != nil {
+		if isNotFound(err) {
+			return cloudprovider.ErrDeviceNotFound
+		}
+		return fmt.Errorf("Failed to get disk %s: %v", deviceID, err)
+	}
+
+	// Detach disk
+	if len(instanceID) != 0 {
+		if err := p.detach(instanceID, deviceID); err != nil {
+			return fmt.Errorf("Failed to detach disk %s from VM %s: %v",
+				deviceID,
+				instanceID,
+				err)
+		}
+	}
+
+	// Delete disk
+	if err := p.do("DELETE", p.resourceURL("disks/"+deviceID), nil, nil); err != nil {
+		if isNotFound(err) {
+			return cloudprovider.ErrDeviceNotFound
+		}
+		return fmt.Errorf("Failed to delete disk %s: %v", deviceID, err)
+	}
+
+	return nil
+}
+
+// ListDevices returns the disks in the resource group with a tag for
+// every label in the filter. Disks attached to a VM which cannot be read
+// are returned without an instance id or path.
+func (p *Provider) ListDevices(filter map[string]string) ([]*cloudprovider.Device, error) {
+	devices := make([]*cloudprovider.Device, 0)
+	vms := make(map[string]*armVM)
+	u := p.resourceURL("disks")
+	for len(u) != 0 {
+		list := &armDiskList{}
+		if err := p.do("GET", u, nil, list); err != nil {
+			return nil, fmt.Errorf("Failed to list disks: %v", err)
+		}
+		for _, disk := range list.Value {
+			if !cloudprovider.MatchLabels(disk.Tags, filter) {
+				continue
+			}
+			device := &cloudprovider.Device{
+				ID:     disk.Name,
+				Size:   disk.Properties.DiskSizeGB,
+				Labels: make(map[string]string, len(disk.Tags)),
+			}
+			for key, value := range disk.Tags {
+				device.Labels[key] = value
+			}
+
+			// Find the LUN the disk is attached to. If the VM cannot be
+			// read, the disk is listed without its attachment.
+			if len(disk.ManagedBy) != 0 {
+				instanceID := lastSegment(disk.ManagedBy)
+				vm, ok := vms[instanceID]
+				if !ok {
+					var err error
+					if vm, err = p.getVM(instanceID); err != nil {
+						logrus.Errorf("Unable to find the LUN of disk %s: %v",
+							disk.Name,
+							err)
+					}
+					vms[instanceID] = vm
+				}
+				if vm != nil {
+					device.InstanceID = instanceID
+					for _, dd := range vm.Properties.StorageProfile.DataDisks {
+						if strings.EqualFold(dd.Name, disk.Name) {
+							device.Path = lunPath(dd.Lun)
+						}
+					}
+				}
+			}
+			devices = append(devices, device)
+		}
+		u = list.NextLink
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices, nil
+}
+
+// attach attaches the disk to the lowest free LUN of the VM and returns
+// the LUN
+func (p *Provider) attach(instanceID, name string) (int, error) {
+	p.vmLock.Lock()
+	defer p.vmLock.Unlock()
+
+	vm, err := p.getVM(instanceID)
+	if err != nil {
+		return 0, err
+	}
+
+	used := make(map[int]bool)
+	for _, dd := range vm.Properties.StorageProfile.DataDisks {
+		used[dd.Lun] = true
+	}
+	lun := -1
+	for l := 0; l < maxLuns; l++ {
+		if !used[l] {
+			lun = l
+			break
+		}
+	}
+	if lun < 0 {
+		return 0, errNoFreeLun
+	}
+
+	disks := append(vm.Properties.StorageProfile.DataDisks, armDataDisk{
+		Lun:          lun,
+		Name:         name,
+		CreateOption: "Attach",
+		ManagedDisk: &armManagedRef{
+			ID: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s"+
+				"/providers/Microsoft.Compute/disks/%s",
+				p.subscription,
+				p.resourceGroup,
+				name),
+		},
+	})
+	if err := p.updateDataDisks(instanceID, disks); err != nil {
+		return 0, err
+	}
+	return lun, nil
+}
+
+// detach removes the disk from the data disks of the VM, if attached
+func (p *Provider) detach(instanceID, name string) error {
+	p.vmLock.Lock()
+	defer p.vmLock.Unlock()
+
+	vm, err := p.getVM(instanceID)
+	if err != nil {
+		return err
+	}
+
+	disks := make([]armDataDisk, 0)
+	for _, dd := range vm.Properties.StorageProfile.DataDisks {
+		if !strings.EqualFold(dd.Name, name) {
+			disks = append(disks, dd)
+		}
+	}
+	if len(disks) == len(vm.Properties.StorageProfile.DataDisks) {
+		return nil
+	}
+	return p.updateDataDisks(instanceID, disks)
+}
+
+func (p *Provider) updateDataDisks(instanceID string, disks []armDataDisk) error {
+	return p.do("PATCH", p.resourceURL("virtualMachines/"+instanceID), &armVM{
+		Properties: armVMProperties{
+			StorageProfile: armStorageProfile{DataDisks: disks},
+		},
+	}, nil)
+}
+
+func (p *Provider) getVM(instanceID string) (*armVM, error) {
+	vm := &armVM{}
+	if err := p.do("GET", p.resourceURL("virtualMachines/"+instanceID), nil, vm); err != nil {
+		return nil, fmt.Errorf("Failed to get VM %s: %v", instanceID, err)
+	}
+	return vm, nil
+}
+
+// lunPath returns the path of the data disk on the LUN, as created by
+// the udev rules of the Azure Linux agent
+func lunPath(lun int) string {
+	return fmt.Sprintf("/dev/disk/azure/scsi1/lun%d", lun)
+}
+
+// lastSegment returns the last part of a resource id, which is its name
+func lastSegment(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+// isAttachmentLimit returns true if the VM cannot take any more disks
+func isAttachmentLimit(err error) bool {
+	if err == errNoFreeLun {
+		return true
+	}
+	apiErr, ok := err.(*apiError)
+	return ok && strings.Contains(apiErr.Message, "maximum number of data disks")
+}
+
+// managedIdentityTokenSource returns a token source getting tokens of the
+// managed identity of the VM from the instance metadata service. Tokens
+// are reused until shortly before they expire.
+func managedIdentityTokenSource() TokenSource {
+	var (
+		lock    sync.Mutex
+		token   string
+		expires time.Time
+	)
+	return func() (string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if len(token) != 0 && time.Now().Before(expires) {
+			return token, nil
+		}
+
+		req, err := http.NewRequest("GET", imdsToken, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata", "true")
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("Instance metadata service returned %d: %s",
+				resp.StatusCode,
+				strings.TrimSpace(string(data)))
+		}
+
+		// expires_in is a string in this API
+		var t struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   string `json:"expires_in"`
+		}
+		if err := json.Unmarshal(data, &t); err != nil {
+			return "", fmt.Errorf("Unable to decode token: %v", err)
+		}
+		seconds, _ := strconv.ParseInt(t.ExpiresIn, 10, 64)
+		token = t.AccessToken
+		expires = time.Now().Add(time.Duration(seconds)*time.Second - time.Minute)
+		return token, nil
+	}
+}
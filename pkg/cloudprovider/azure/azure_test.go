@@ -0,0 +1,318 @@
+/*
+Package azure implements the cloud interface for Azure
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const resourcePrefix = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/"
+
+// fakeARM is a local mock of the Resource Manager endpoints used by the
+// provider. Creating and deleting disks and updating VMs are asynchronous
+// and each operation is in progress on the first poll. Disks are listed
+// one per page.
+type fakeARM struct {
+	lock     sync.Mutex
+	url      string
+	disks    map[string]*armDisk
+	vms      map[string]*armVM
+	maxDisks int
+	ops      int
+
+	// pending has the operations not polled to completion
+	pending map[string]bool
+}
+
+func newFakeARM() *fakeARM {
+	return &fakeARM{
+		disks: make(map[string]*armDisk),
+		vms: map[string]*armVM{
+			"vm0": {
+				Name:     "vm0",
+				Location: "eastus",
+				Zones:    []string{"1"},
+				Properties: armVMProperties{
+					StorageProfile: armStorageProfile{
+						DataDisks: []armDataDisk{{Lun: 0, Name: "os-data", CreateOption: "Attach"}},
+					},
+				},
+			},
+		},
+		maxDisks: 3,
+		pending:  make(map[string]bool),
+	}
+}
+
+// start starts an operation polled at the URL set in the header
+func (f *fakeARM) start(w http.ResponseWriter, header string) {
+	f.ops++
+	path := fmt.Sprintf("/operations/%d", f.ops)
+	if header == "Location" {
+		path = fmt.Sprintf("/locations/%d", f.ops)
+	}
+	f.pending[path] = true
+	w.Header().Set(header, f.url+path)
+}
+
+func (f *fakeARM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	fail := func(status int, code, message string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]armError{
+			"error": {Code: code, Message: message},
+		})
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		fail(http.StatusUnauthorized, "AuthenticationFailed", "no token")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/operations/") {
+		status := "Succeeded"
+		if f.pending[r.URL.Path] {
+			status = "InProgress"
+		}
+		delete(f.pending, r.URL.Path)
+		json.NewEncoder(w).Encode(&armOperation{Status: status})
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/locations/") {
+		if f.pending[r.URL.Path] {
+			delete(f.pending, r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		}
+		return
+	}
+	if r.URL.Query().Get("api-version") != apiVersion {
+		fail(http.StatusBadRequest, "InvalidApiVersion", "bad api version")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, resourcePrefix), "/")
+	switch {
+	case parts[0] == "disks" && len(parts) == 1 && r.Method == "GET":
+		names := make([]string, 0, len(f.disks))
+		for name := range f.disks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := &armDiskList{Value: make([]*armDisk, 0)}
+		page := 0
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+		if page < len(names) {
+			list.Value = append(list.Value, f.disks[names[page]])
+		}
+		if page+1 < len(names) {
+			list.NextLink = fmt.Sprintf("%s%sdisks?api-version=%s&page=%d",
+				f.url, resourcePrefix, apiVersion, page+1)
+		}
+		json.NewEncoder(w).Encode(list)
+	case parts[0] == "disks" && len(parts) == 2:
+		disk, ok := f.disks[parts[1]]
+		switch r.Method {
+		case "GET":
+			if !ok {
+				fail(http.StatusNotFound, "ResourceNotFound", "not found")
+				return
+			}
+			json.NewEncoder(w).Encode(disk)
+		case "PUT":
+			disk = &armDisk{}
+			json.NewDecoder(r.Body).Decode(disk)
+			disk.Name = parts[1]
+			disk.ID = r.URL.Path
+			f.disks[parts[1]] = disk
+			f.start(w, "Azure-AsyncOperation")
+			w.WriteHeader(http.StatusAccepted)
+		case "DELETE":
+			if ok && len(disk.ManagedBy) != 0 {
+				fail(http.StatusConflict, "OperationNotAllowed", "disk attached")
+				return
+			}
+			delete(f.disks, parts[1])
+			f.start(w, "Location")
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case parts[0] == "virtualMachines" && len(parts) == 2:
+		vm, ok := f.vms[parts[1]]
+		if !ok {
+			fail(http.StatusNotFound, "ResourceNotFound", "not found")
+			return
+		}
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(vm)
+		case "PATCH":
+			update := &armVM{}
+			json.NewDecoder(r.Body).Decode(update)
+			disks := update.Properties.StorageProfile.DataDisks
+			if len(disks) > f.maxDisks {
+				fail(http.StatusConflict, "OperationNotAllowed",
+					"The maximum number of data disks allowed to be attached to a VM of this size is 3.")
+				return
+			}
+			for _, disk := range f.disks {
+				disk.ManagedBy = ""
+			}
+			for _, dd := range disks {
+				if disk, ok := f.disks[dd.Name]; ok {
+					disk.ManagedBy = resourcePrefix + "virtualMachines/" + vm.Name
+				}
+			}
+			vm.Properties.StorageProfile.DataDisks = disks
+			f.start(w, "Azure-AsyncOperation")
+			json.NewEncoder(w).Encode(vm)
+		}
+	default:
+		fail(http.StatusNotFound, "ResourceNotFound", "not found")
+	}
+}
+
+func TestAzureDevices(t *testing.T) {
+	var _ cloudprovider.Interface = &Provider{}
+
+	f := newFakeARM()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	f.url = server.URL
+	p := NewProviderWithEndpoint(server.URL,
+		"sub",
+		"rg",
+		func() (string, error) { return "token", nil },
+		http.DefaultClient)
+	p.pollInterval = time.Millisecond
+	p.SetConfig(&config.Config{ClusterID: "test"})
+
+	class := &config.Class{
+		Name:       "premium",
+		DiskSizeGb: 64,
+		Parameters: map[string]string{
+			"sku":  "Premium_LRS",
+			"tags": "team=storage",
+		},
+	}
+
+	// Attached to the first free LUN
+	d1, err := p.DeviceCreate("vm0", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/disk/azure/scsi1/lun1", d1.Path)
+	assert.Equal(t, int64(64), d1.Size)
+	disk := f.disks[d1.ID]
+	assert.Equal(t, "Premium_LRS", disk.Sku.Name)
+	assert.Equal(t, "eastus", disk.Location)
+	assert.Equal(t, []string{"1"}, disk.Zones)
+	assert.Equal(t, "Empty", disk.Properties.CreationData.CreateOption)
+	assert.Equal(t, "storage", disk.Tags["team"])
+	assert.Equal(t, "test", disk.Tags[cloudprovider.LabelClusterID])
+	assert.Equal(t, "premium", disk.Tags[cloudprovider.LabelClass])
+	assert.Empty(t, f.pending)
+
+	d2, err := p.DeviceCreate("vm0", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/disk/azure/scsi1/lun2", d2.Path)
+
+	// The VM size allows no more disks
+	_, err = p.DeviceCreate("vm0", class)
+	assert.Equal(t, cloudprovider.ErrDeviceLimit, err)
+	assert.Len(t, f.disks, 2)
+
+	// List with the LUN mapping, across pages
+	devices, err := p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "test"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+	for _, device := range devices {
+		assert.Equal(t, "vm0", device.InstanceID)
+		if device.ID == d1.ID {
+			assert.Equal(t, d1.Path, device.Path)
+		} else {
+			assert.Equal(t, d2.Path, device.Path)
+		}
+	}
+	devices, err = p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "other"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 0)
+
+	// A VM which cannot be read does not fail the listing
+	f.disks[d2.ID].ManagedBy = resourcePrefix + "virtualMachines/vm9"
+	devices, err = p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "test"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+	for _, device := range devices {
+		if device.ID == d1.ID {
+			assert.Equal(t, "vm0", device.InstanceID)
+			assert.Equal(t, d1.Path, device.Path)
+		} else {
+			assert.Empty(t, device.InstanceID)
+			assert.Empty(t, device.Path)
+		}
+	}
+	f.disks[d2.ID].ManagedBy = resourcePrefix + "virtualMachines/vm0"
+
+	// Delete frees the LUN
+	assert.NoError(t, p.DeviceDelete("vm0", d1.ID))
+	assert.Len(t, f.disks, 1)
+	assert.Len(t, f.vms["vm0"].Properties.StorageProfile.DataDisks, 2)
+	assert.Empty(t, f.pending)
+	assert.Equal(t, cloudprovider.ErrDeviceNotFound, p.DeviceDelete("vm0", d1.ID))
+	d3, err := p.DeviceCreate("vm0", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/disk/azure/scsi1/lun1", d3.Path)
+
+	// Unknown VM
+	_, err = p.DeviceCreate("vm1", class)
+	assert.Error(t, err)
+}
+
+func TestAzureParameters(t *testing.T) {
+	tests := []struct {
+		size   int64
+		params map[string]string
+		valid  bool
+	}{
+		{8, nil, true},
+		{8, map[string]string{"sku": "StandardSSD_LRS"}, true},
+		{8, map[string]string{"sku": "Premium_ZRS"}, false},
+		{2, nil, false},
+		{40000, nil, false},
+		{8, map[string]string{"tags": "a=b"}, true},
+		{8, map[string]string{"tags": "=b"}, false},
+		{8, map[string]string{"type": "ssd"}, false},
+	}
+	p := &Provider{}
+	for i, test := range tests {
+		err := p.ValidateClass(&config.Class{
+			Name:       "test",
+			DiskSizeGb: test.size,
+			Parameters: test.params,
+		})
+		assert.Equal(t, test.valid, err == nil, "test %d: %v", i, err)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Package azure implements the cloud interface for Azure
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package azure
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+)
+
+// Keys supported in config.Class.Parameters
+const (
+	// ParameterSku is the managed disk SKU: Standard_LRS, StandardSSD_LRS,
+	// Premium_LRS or UltraSSD_LRS. Defaults to Standard_LRS.
+	ParameterSku = "sku"
+
+	// ParameterTags are the tags added to the disk as a comma separated
+	// list of key=value pairs
+	ParameterTags = "tags"
+)
+
+// Size limits of managed disks in GiB
+const (
+	minDiskSizeGb = 4
+	maxDiskSizeGb = 32767
+)
+
+var skus = map[string]bool{
+	"Standard_LRS":    true,
+	"StandardSSD_LRS": true,
+	"Premium_LRS":     true,
+	"UltraSSD_LRS":    true,
+}
+
+// diskParameters are the values parsed from the class parameters
+type diskParameters struct {
+	sku  string
+	tags map[string]string
+}
+
+// parseParameters parses and validates the parameters of the class
+func parseParameters(class *config.Class) (*diskParameters, error) {
+	d := &diskParameters{
+		sku:  "Standard_LRS",
+		tags: make(map[string]string),
+	}
+
+	for key, value := range class.Parameters {
+		var err error
+		switch key {
+		case ParameterSku:
+			if !skus[value] {
+				err = fmt.Errorf("unsupported sku")
+			}
+			d.sku = value
+		case ParameterTags:
+			d.tags, err = cloudprovider.ParseKeyValues(value)
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid parameter %s=%s for class %s: %v",
+				key,
+				value,
+				class.Name,
+				err)
+		}
+	}
+
+	if class.DiskSizeGb < minDiskSizeGb || class.DiskSizeGb > maxDiskSizeGb {
+		return nil, fmt.Errorf("Invalid parameters for class %s: "+
+			"disks must be between %d and %d GiB, not %d",
+			class.Name,
+			minDiskSizeGb,
+			maxDiskSizeGb,
+			class.DiskSizeGb)
+	}
+	return d, nil
+}
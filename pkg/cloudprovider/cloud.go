@@ -18,9 +18,45 @@ limitations under the License.
 package cloudprovider
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/libopenstorage/rico/pkg/config"
 )
 
+// Labels set by the cloud providers on every device created. Keys only
+// use lowercase letters, digits and '-' so they are valid tags or labels
+// on every cloud. Class names and instance ids are not restricted, so
+// providers whose labels limit the characters of values must encode them
+// and decode them in ListDevices.
+const (
+	// LabelClusterID is the ID of the cluster which owns the device
+	LabelClusterID = "rico-cluster-id"
+
+	// LabelClass is the name of the class of the device
+	LabelClass = "rico-class"
+
+	// LabelInstanceID is the instance the device was created for
+	LabelInstanceID = "rico-instance"
+
+	// LabelCreated is the creation time of the device in seconds
+	// since the epoch
+	LabelCreated = "rico-created"
+)
+
+var (
+	// ErrDeviceNotFound is returned by DeviceDelete when the device
+	// does not exist in the cloud
+	ErrDeviceNotFound = errors.New("Device not found")
+
+	// ErrDeviceLimit is returned by DeviceCreate when no more devices
+	// can be attached to the instance
+	ErrDeviceLimit = errors.New("Instance device limit reached")
+)
+
 // Device container generic cloud information
 type Device struct {
 
@@ -32,6 +68,62 @@ type Device struct {
 
 	// Size in GiB
 	Size int64
+
+	// InstanceID is the instance the device is attached to. Only set
+	// by ListDevices, and empty if the device is not attached.
+	InstanceID string
+
+	// Labels of the device. Only set by ListDevices.
+	Labels map[string]string
+}
+
+// DeviceLabels returns the labels a cloud provider must set on a device
+// created for the instance. The cluster ID label is left out if the
+// cluster ID is empty.
+func DeviceLabels(
+	clusterID string,
+	class *config.Class,
+	instanceID string,
+	created time.Time,
+) map[string]string {
+	labels := map[string]string{
+		LabelClass:      class.Name,
+		LabelInstanceID: instanceID,
+		LabelCreated:    strconv.FormatInt(created.Unix(), 10),
+	}
+	if len(clusterID) != 0 {
+		labels[LabelClusterID] = clusterID
+	}
+	return labels
+}
+
+// MatchLabels returns true if the labels have every key and value of
+// the filter
+func MatchLabels(labels, filter map[string]string) bool {
+	for key, value := range filter {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseKeyValues parses a comma separated list of key=value pairs, as
+// used by the class parameters which set tags or labels
+func ParseKeyValues(value string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, fmt.Errorf("%s must be key=value", pair)
+		}
+		values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return values, nil
 }
 
 // Interface provides a pluggable interface for cloud providers
@@ -40,9 +132,33 @@ type Interface interface {
 	SetConfig(config *config.Config)
 
 	// DeviceAdd creates and attaches new device to a node returning
-	// the id of the newly created device
+	// the id of the newly created device. Returns ErrDeviceLimit if the
+	// instance cannot take any more devices.
 	DeviceCreate(instanceID string, class *config.Class) (*Device, error)
 
-	// DeviceDelete detaches and deletes a cloud block device from a node
+	// DeviceDelete detaches and deletes a cloud block device from a node.
+	// Returns ErrDeviceNotFound if the device does not exist. An empty
+	// instanceID deletes a device which is not attached.
 	DeviceDelete(instanceID, deviceID string) error
+
+	// ListDevices returns the devices in the cloud with every label in
+	// the filter. Devices created by DeviceCreate carry the labels
+	// returned by DeviceLabels.
+	ListDevices(filter map[string]string) ([]*Device, error)
+}
+
+// Resizer is implemented by cloud providers which can grow a device
+// while it is attached
+type Resizer interface {
+	// DeviceResize grows the device to the size in GiB provided. It
+	// succeeds if the device already has that size.
+	DeviceResize(instanceID, deviceID string, sizeGb int64) (*Device, error)
+}
+
+// DeviceLimiter is implemented by cloud providers which know how many
+// devices can be attached to an instance
+type DeviceLimiter interface {
+	// MaxDevices returns the maximum number of storage devices which
+	// can be attached to the instance. Zero means there is no limit.
+	MaxDevices(instanceID string) (int, error)
 }
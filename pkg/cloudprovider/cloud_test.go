@@ -0,0 +1,42 @@
+/*
+Package cloudprovider provides the interfaces to the cloud provider
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cloudprovider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	values, err := ParseKeyValues(" team=storage, env = prod,,empty=")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"team":  "storage",
+		"env":   "prod",
+		"empty": "",
+	}, values)
+
+	values, err = ParseKeyValues("")
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+
+	for _, value := range []string{"team", "=storage", "team=storage,env"} {
+		_, err = ParseKeyValues(value)
+		assert.Error(t, err, value)
+	}
+}
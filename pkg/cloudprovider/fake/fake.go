@@ -17,6 +17,10 @@ limitations under the License.
 package fake
 
 import (
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/libopenstorage/rico/pkg/cloudprovider"
 	"github.com/libopenstorage/rico/pkg/config"
 
@@ -24,29 +28,136 @@ import (
 )
 
 // Fake is an in-memory fake cloud provider
-type Fake struct{}
+type Fake struct {
+	lock      sync.Mutex
+	clusterID string
+	limits    map[string]int
+	attached  map[string]int
+	devices   map[string]*cloudprovider.Device
+}
 
 // New returns a new Fake cloud provider
 func New() *Fake {
-	return &Fake{}
+	return &Fake{
+		limits:   make(map[string]int),
+		attached: make(map[string]int),
+		devices:  make(map[string]*cloudprovider.Device),
+	}
+}
+
+// SetConfig saves the cluster ID used to label new devices
+func (f *Fake) SetConfig(config *config.Config) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.clusterID = config.ClusterID
+}
+
+// SetMaxDevices sets the number of devices the fake lets DeviceCreate
+// attach to the instance. Zero means there is no limit.
+func (f *Fake) SetMaxDevices(instanceID string, max int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.limits[instanceID] = max
 }
 
-// SetConfig does nothing
-func (f *Fake) SetConfig(config *config.Config) {}
+// MaxDevices returns the limit set by SetMaxDevices
+func (f *Fake) MaxDevices(instanceID string) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.limits[instanceID], nil
+}
 
 // DeviceCreate returns a new device with a new uuid
 func (f *Fake) DeviceCreate(
 	instanceID string,
 	class *config.Class,
 ) (*cloudprovider.Device, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if max := f.limits[instanceID]; max != 0 && f.attached[instanceID] >= max {
+		return nil, cloudprovider.ErrDeviceLimit
+	}
+	f.attached[instanceID]++
+
+	device := &cloudprovider.Device{
+		ID:         uuid.New(),
+		Path:       "nothing",
+		Size:       class.DiskSizeGb,
+		InstanceID: instanceID,
+		Labels:     cloudprovider.DeviceLabels(f.clusterID, class, instanceID, time.Now()),
+	}
+	f.devices[device.ID] = device
+
 	return &cloudprovider.Device{
-		ID:   uuid.New(),
+		ID:   device.ID,
+		Path: device.Path,
+		Size: device.Size,
+	}, nil
+}
+
+// AddDevice adds a device to the fake cloud as if it had been created
+// outside of DeviceCreate
+func (f *Fake) AddDevice(device *cloudprovider.Device) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	d := *device
+	f.devices[d.ID] = &d
+	if len(d.InstanceID) != 0 {
+		f.attached[d.InstanceID]++
+	}
+}
+
+// ListDevices returns the devices with every label in the filter
+func (f *Fake) ListDevices(filter map[string]string) ([]*cloudprovider.Device, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	devices := make([]*cloudprovider.Device, 0, len(f.devices))
+	for _, device := range f.devices {
+		if !cloudprovider.MatchLabels(device.Labels, filter) {
+			continue
+		}
+		d := *device
+		d.Labels = make(map[string]string, len(device.Labels))
+		for key, value := range device.Labels {
+			d.Labels[key] = value
+		}
+		devices = append(devices, &d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices, nil
+}
+
+// DeviceResize returns the device with the new size
+func (f *Fake) DeviceResize(
+	instanceID, deviceID string,
+	sizeGb int64,
+) (*cloudprovider.Device, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if device, ok := f.devices[deviceID]; ok {
+		device.Size = sizeGb
+	}
+	return &cloudprovider.Device{
+		ID:   deviceID,
 		Path: "nothing",
-		Size: class.DiskSizeGb,
+		Size: sizeGb,
 	}, nil
 }
 
-// DeviceDelete does nothing
+// DeviceDelete releases the attachment of the device and forgets it
 func (f *Fake) DeviceDelete(instanceID, deviceID string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.devices, deviceID)
+	if f.attached[instanceID] > 0 {
+		f.attached[instanceID]--
+	}
 	return nil
 }
@@ -0,0 +1,198 @@
+/*
+Package gce implements the cloud interface for Google Compute Engine
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gce
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Subset of the Compute Engine v1 API used by the provider
+
+type computeDisk struct {
+	Name   string            `json:"name,omitempty"`
+	SizeGb int64             `json:"sizeGb,string,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Zone   string            `json:"zone,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Users  []string          `json:"users,omitempty"`
+	Status string            `json:"status,omitempty"`
+}
+
+type computeAttachedDisk struct {
+	Source     string `json:"source"`
+	DeviceName string `json:"deviceName"`
+	Mode       string `json:"mode"`
+	AutoDelete bool   `json:"autoDelete"`
+}
+
+type computeInstance struct {
+	Name  string                `json:"name"`
+	Zone  string                `json:"zone"`
+	Disks []computeAttachedDisk `json:"disks"`
+}
+
+type computeOperation struct {
+	Name   string `json:"name"`
+	Zone   string `json:"zone"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []computeError `json:"errors"`
+	} `json:"error,omitempty"`
+}
+
+type computeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type computeAggregatedDisks struct {
+	Items map[string]struct {
+		Disks []*computeDisk `json:"disks"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+type computeAggregatedInstances struct {
+	Items map[string]struct {
+		Instances []*computeInstance `json:"instances"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+// apiError is returned for responses other than 2xx
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Compute API returned %d: %s", e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// operationError is returned when an operation completes with errors
+type operationError struct {
+	Errors []computeError
+}
+
+func (e *operationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, ce := range e.Errors {
+		msgs[i] = fmt.Sprintf("%s: %s", ce.Code, ce.Message)
+	}
+	return fmt.Sprintf("Operation failed: %s", strings.Join(msgs, "; "))
+}
+
+// do sends a request to the Compute API and decodes the response into
+// out, if not nil
+func (p *Provider) do(method, resource string, query url.Values, in, out interface{}) error {
+	u := p.endpoint + path.Join("projects", p.project, resource)
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := p.token()
+	if err != nil {
+		return fmt.Errorf("Unable to get access token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		msg := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &e) == nil && len(e.Error.Message) != 0 {
+			msg = e.Error.Message
+		}
+		return &apiError{StatusCode: resp.StatusCode, Message: msg}
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// zoneOperation sends a request which returns a zone operation and waits
+// for the operation to complete
+func (p *Provider) zoneOperation(method, resource string, query url.Values, in interface{}) error {
+	op := &computeOperation{}
+	if err := p.do(method, resource, query, in, op); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(p.timeout)
+	for op.Status != "DONE" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for operation %s", op.Name)
+		}
+		time.Sleep(p.pollInterval)
+		resource := path.Join("zones", lastSegment(op.Zone), "operations", op.Name)
+		if err := p.do("GET", resource, nil, nil, op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) != 0 {
+		return &operationError{Errors: op.Error.Errors}
+	}
+	return nil
+}
+
+// lastSegment returns the last part of a resource URL, which is its name
+func lastSegment(u string) string {
+	return u[strings.LastIndex(u, "/")+1:]
+}
@@ -0,0 +1,498 @@
+/*
+Package gce implements the cloud interface for Google Compute Engine
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gce
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+
+	"github.com/pborman/uuid"
+)
+
+const (
+	computeEndpoint  = "https://compute.googleapis.com/compute/v1/"
+	metadataEndpoint = "http://metadata.google.internal/computeMetadata/v1/"
+
+	// Time between checks of an operation in progress
+	pollInterval = 2 * time.Second
+
+	// Time to wait for an operation to complete
+	operationTimeout = 5 * time.Minute
+
+	// Time to wait for the reply to a single request
+	requestTimeout = time.Minute
+)
+
+// httpClient is used for the Compute API and the metadata server
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+// TokenSource returns an OAuth2 access token for the Compute API
+type TokenSource func() (string, error)
+
+// Provider has the client and state information to communicate with the
+// Compute Engine API. Instance ids are zone/name. A bare instance name is
+// accepted and its zone looked up, but ListDevices reports instances as
+// zone/name, so nodes must use that form to be matched with their disks.
+// Device ids are zone/disk.
+type Provider struct {
+	client       *http.Client
+	endpoint     string
+	project      string
+	token        TokenSource
+	pollInterval time.Duration
+	timeout      time.Duration
+
+	// clusterID is set as a label on every disk created
+	lock      sync.Mutex
+	clusterID string
+
+	// zones caches the zone of each instance
+	zones map[string]string
+}
+
+// NewProvider provides an implementation of cloudprovider.Interface for the
+// project of the instance it runs on, authenticated as the service
+// account of the instance. The project can be set with GCE_PROJECT.
+func NewProvider() *Provider {
+	project := os.Getenv("GCE_PROJECT")
+	if len(project) == 0 {
+		var err error
+		if project, err = metadata("project/project-id"); err != nil {
+			logrus.Errorf("GCE_PROJECT not defined and unable to get it "+
+				"from the metadata server: %v", err)
+			return nil
+		}
+	}
+
+	return NewProviderWithEndpoint(computeEndpoint,
+		project,
+		metadataTokenSource(),
+		httpClient)
+}
+
+// NewProviderWithEndpoint provides an implementation of
+// cloudprovider.Interface using the Compute API at the endpoint provided
+func NewProviderWithEndpoint(
+	endpoint, project string,
+	token TokenSource,
+	client *http.Client,
+) *Provider {
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+	return &Provider{
+		client:       client,
+		endpoint:     endpoint,
+		project:      project,
+		token:        token,
+		pollInterval: pollInterval,
+		timeout:      operationTimeout,
+		zones:        make(map[string]string),
+	}
+}
+
+// SetConfig saves the cluster ID set as a label on new disks
+func (p *Provider) SetConfig(config *config.Config) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clusterID = config.ClusterID
+}
+
+// ValidateClass checks the disk type and labels of the class
+func (p *Provider) ValidateClass(class *config.Class) error {
+	_, err := parseParameters(class)
+	return err
+}
+
+// DeviceCreate creates a persistent disk in the zone of the instance and
+// attaches it to the instance
+func (p *Provider) DeviceCreate(
+	instanceID string,
+	class *config.Class,
+) (*cloudprovider.Device, error) {
+
+	// Get the disk parameters from the class
+	params, err := parseParameters(class)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the zone of the instance
+	zone, instance, err := p.instanceZone(instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Label the disk so it can be found by ListDevices. The cluster ID and
+	// instance name are valid label values, the class name is encoded.
+	p.lock.Lock()
+	labels := cloudprovider.DeviceLabels(p.clusterID, class, instance, time.Now())
+	p.lock.Unlock()
+	labels[cloudprovider.LabelClass] = encodeLabel(class.Name)
+	for key, value := range labels {
+		params.labels[key] = value
+	}
+
+	// Create a disk
+	disk := &computeDisk{
+		Name:   "rico-" + uuid.New(),
+		SizeGb: class.DiskSizeGb,
+		Type:   path.Join("zones", zone, "diskTypes", params.diskType),
+		Labels: params.labels,
+	}
+	err = p.zoneOperation("POST", path.Join("zones", zone, "disks"), nil, disk)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create disk: %v", err)
+	}
+	deviceID := path.Join(zone, disk.Name)
+
+	// Attach the disk
+	err = p.zoneOperation("POST",
+		path.Join("zones", zone, "instances", instance, "attachDisk"),
+		nil,
+		&computeAttachedDisk{
+			Source:     path.Join("projects", p.project, "zones", zone, "disks", disk.Name),
+			DeviceName: disk.Name,
+			Mode:       "READ_WRITE",
+		})
+	if err != nil {
+		reterr := fmt.Errorf("Unable to attach disk %s to %s: %v",
+			deviceID,
+			instanceID,
+			err)
+		logrus.Error(reterr)
+		if err := p.deleteDisk(zone, disk.Name); err != nil {
+			logrus.Errorf("Failed to delete disk %s: %v", deviceID, err)
+		}
+		if isAttachmentLimit(err) {
+			return nil, cloudprovider.ErrDeviceLimit
+		}
+		return nil, reterr
+	}
+
+	return &cloudprovider.Device{
+		ID:   deviceID,
+		Path: devicePath(disk.Name),
+		Size: class.DiskSizeGb,
+	}, nil
+}
+
+// DeviceDelete detaches the disk from the specified instance, then deletes
+// it. The detach is skipped if the instance id is empty or the disk has no
+// users left, so a delete interrupted after the detach can be retried.
+func (p *Provider) DeviceDelete(instanceID string, deviceID string) error {
+	zone, name, err := splitDeviceID(deviceID)
+	if err != nil {
+		return err
+	}
+
+	disk := &computeDisk{}
+	if err := p.do("GET", path.Join("zones", zone, "disks", name), nil, nil, disk); err != nil {
+		if isNotFound(err) {
+			return cloudprovider.ErrDeviceNotFound
+		}
+		return fmt.Errorf("Failed to get disk %s: %v", deviceID, err)
+	}
+
+	// Detach disk
+	if len(instanceID) != 0 && len(disk.Users) != 0 {
+		_, instance, err := p.instanceZone(instanceID)
+		if err != nil {
+			return err
+		}
+		err = p.zoneOperation("POST",
+			path.Join("zones", zone, "instances", instance, "detachDisk"),
+			url.Values{"deviceName": []string{name}},
+			nil)
+		if err != nil {
+			if isNotFound(err) {
+				return cloudprovider.ErrDeviceNotFound
+			}
+			return fmt.Errorf("Failed to detach disk %s from instance %s: %v",
+				deviceID,
+				instanceID,
+				err)
+		}
+	}
+
+	// Delete disk
+	if err := p.deleteDisk(zone, name); err != nil {
+		if isNotFound(err) {
+			return cloudprovider.ErrDeviceNotFound
+		}
+		return fmt.Errorf("Failed to delete disk %s: %v", deviceID, err)
+	}
+
+	return nil
+}
+
+// DeviceResize grows the disk to the size provided. The file system or
+// storage system on the instance sees the new size right away.
+func (p *Provider) DeviceResize(
+	instanceID, deviceID string,
+	sizeGb int64,
+) (*cloudprovider.Device, error) {
+	zone, name, err := splitDeviceID(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	disk := &computeDisk{}
+	if err := p.do("GET", path.Join("zones", zone, "disks", name), nil, nil, disk); err != nil {
+		if isNotFound(err) {
+			return nil, cloudprovider.ErrDeviceNotFound
+		}
+		return nil, fmt.Errorf("Failed to get disk %s: %v", deviceID, err)
+	}
+
+	if disk.SizeGb < sizeGb {
+		logrus.Infof("Resizing disk %s from %d to %d GB",
+			deviceID,
+			disk.SizeGb,
+			sizeGb)
+		err := p.zoneOperation("POST",
+			path.Join("zones", zone, "disks", name, "resize"),
+			nil,
+			&computeDisk{SizeGb: sizeGb})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resize disk %s: %v", deviceID, err)
+		}
+		disk.SizeGb = sizeGb
+	}
+
+	return &cloudprovider.Device{
+		ID:   deviceID,
+		Path: devicePath(name),
+		Size: disk.SizeGb,
+	}, nil
+}
+
+// ListDevices returns the disks with every label in the filter
+func (p *Provider) ListDevices(filter map[string]string) ([]*cloudprovider.Device, error) {
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expressions := make([]string, len(keys))
+	for i, key := range keys {
+		value := filter[key]
+		if key == cloudprovider.LabelClass {
+			value = encodeLabel(value)
+		}
+		expressions[i] = fmt.Sprintf("(labels.%s = \"%s\")", key, value)
+	}
+
+	devices := make([]*cloudprovider.Device, 0)
+	query := url.Values{}
+	if len(expressions) != 0 {
+		query.Set("filter", strings.Join(expressions, " "))
+	}
+	for {
+		list := &computeAggregatedDisks{}
+		if err := p.do("GET", "aggregated/disks", query, nil, list); err != nil {
+			return nil, fmt.Errorf("Failed to list disks: %v", err)
+		}
+		for _, scope := range list.Items {
+			for _, disk := range scope.Disks {
+				device := deviceFromDisk(disk)
+				if cloudprovider.MatchLabels(device.Labels, filter) {
+					devices = append(devices, device)
+				}
+			}
+		}
+		if len(list.NextPageToken) == 0 {
+			break
+		}
+		query.Set("pageToken", list.NextPageToken)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices, nil
+}
+
+// deviceFromDisk returns the device with the ID, size, labels and
+// attachment of the disk. The class label is decoded.
+func deviceFromDisk(disk *computeDisk) *cloudprovider.Device {
+	device := &cloudprovider.Device{
+		ID:     path.Join(lastSegment(disk.Zone), disk.Name),
+		Size:   disk.SizeGb,
+		Labels: make(map[string]string, len(disk.Labels)),
+	}
+	for key, value := range disk.Labels {
+		if key == cloudprovider.LabelClass {
+			value = decodeLabel(value)
+		}
+		device.Labels[key] = value
+	}
+	if len(disk.Users) != 0 {
+		device.InstanceID = instanceID(disk.Users[0])
+		device.Path = devicePath(disk.Name)
+	}
+	return device
+}
+
+// instanceID returns the zone/name id of the instance at the URL
+func instanceID(instanceURL string) string {
+	zone := lastSegment(path.Dir(path.Dir(instanceURL)))
+	return path.Join(zone, lastSegment(instanceURL))
+}
+
+// instanceZone returns the zone and name of the instance. Instance ids
+// without a zone are looked up once.
+func (p *Provider) instanceZone(instanceID string) (string, string, error) {
+	if parts := strings.SplitN(instanceID, "/", 2); len(parts) == 2 {
+		return parts[0], parts[1], nil
+	}
+
+	p.lock.Lock()
+	zone, ok := p.zones[instanceID]
+	p.lock.Unlock()
+	if ok {
+		return zone, instanceID, nil
+	}
+
+	query := url.Values{"filter": []string{fmt.Sprintf("name = \"%s\"", instanceID)}}
+	for {
+		list := &computeAggregatedInstances{}
+		if err := p.do("GET", "aggregated/instances", query, nil, list); err != nil {
+			return "", "", fmt.Errorf("Failed to find instance %s: %v", instanceID, err)
+		}
+		for _, scope := range list.Items {
+			for _, instance := range scope.Instances {
+				if instance.Name == instanceID {
+					zone = lastSegment(instance.Zone)
+					p.lock.Lock()
+					p.zones[instanceID] = zone
+					p.lock.Unlock()
+					return zone, instanceID, nil
+				}
+			}
+		}
+		if len(list.NextPageToken) == 0 {
+			break
+		}
+		query.Set("pageToken", list.NextPageToken)
+	}
+	return "", "", fmt.Errorf("Instance %s not found", instanceID)
+}
+
+func (p *Provider) deleteDisk(zone, name string) error {
+	return p.zoneOperation("DELETE", path.Join("zones", zone, "disks", name), nil, nil)
+}
+
+// splitDeviceID returns the zone and disk name of a device id
+func splitDeviceID(deviceID string) (string, string, error) {
+	parts := strings.SplitN(deviceID, "/", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("Invalid device id %s, must be zone/disk", deviceID)
+	}
+	return parts[0], parts[1], nil
+}
+
+// devicePath returns the path of the disk on the instance
+func devicePath(deviceName string) string {
+	return "/dev/disk/by-id/google-" + deviceName
+}
+
+// isAttachmentLimit returns true if the instance cannot take any more
+// disks
+func isAttachmentLimit(err error) bool {
+	switch e := err.(type) {
+	case *operationError:
+		for _, ce := range e.Errors {
+			if strings.Contains(ce.Code, "LIMIT_EXCEEDED") ||
+				strings.Contains(ce.Message, "maximum number of") {
+				return true
+			}
+		}
+	case *apiError:
+		return strings.Contains(e.Message, "maximum number of")
+	}
+	return false
+}
+
+// metadata returns a value from the metadata server
+func metadata(key string) (string, error) {
+	req, err := http.NewRequest("GET", metadataEndpoint+key, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Metadata server returned %d for %s", resp.StatusCode, key)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// metadataTokenSource returns a token source getting tokens of the
+// service account of the instance from the metadata server. Tokens are
+// reused until shortly before they expire.
+func metadataTokenSource() TokenSource {
+	var (
+		lock    sync.Mutex
+		token   string
+		expires time.Time
+	)
+	return func() (string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if len(token) != 0 && time.Now().Before(expires) {
+			return token, nil
+		}
+		data, err := metadata("instance/service-accounts/default/token")
+		if err != nil {
+			return "", err
+		}
+		var t struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			return "", fmt.Errorf("Unable to decode token: %v", err)
+		}
+		token = t.AccessToken
+		expires = time.Now().Add(time.Duration(t.ExpiresIn)*time.Second - time.Minute)
+		return token, nil
+	}
+}
@@ -0,0 +1,373 @@
+/*
+Package gce implements the cloud interface for Google Compute Engine
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gce
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/rico/pkg/allocator/roundrobin"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/inframanager"
+	fakestorage "github.com/libopenstorage/rico/pkg/storageprovider/fake"
+	"github.com/libopenstorage/rico/pkg/topology"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCompute is a local stand-in for the Compute API. Operations are
+// returned running and are done when polled.
+type fakeCompute struct {
+	lock      sync.Mutex
+	disks     map[string]*computeDisk
+	instances map[string]*computeInstance
+	maxDisks  int
+	ops       int
+}
+
+func newFakeCompute() *fakeCompute {
+	return &fakeCompute{
+		disks: make(map[string]*computeDisk),
+		instances: map[string]*computeInstance{
+			"node0": {Name: "node0", Zone: "zones/us-east1-b"},
+		},
+		maxDisks: 2,
+	}
+}
+
+func (f *fakeCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, `{"error":{"message":"unauthorized"}}`, http.StatusUnauthorized)
+		return
+	}
+
+	// /projects/<project>/<resource...>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/projects/test/"), "/")
+	reply := func(v interface{}) {
+		json.NewEncoder(w).Encode(v)
+	}
+	op := func(zone string) {
+		f.ops++
+		o := &computeOperation{
+			Name:   fmt.Sprintf("op%d", f.ops),
+			Zone:   "zones/" + zone,
+			Status: "RUNNING",
+		}
+		reply(o)
+	}
+	failedOp := func(zone string, ce computeError) {
+		o := &computeOperation{Name: "failed", Zone: "zones/" + zone, Status: "DONE"}
+		o.Error = &struct {
+			Errors []computeError `json:"errors"`
+		}{Errors: []computeError{ce}}
+		reply(o)
+	}
+	notFound := func() {
+		http.Error(w, `{"error":{"message":"not found"}}`, http.StatusNotFound)
+	}
+
+	switch {
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "aggregated" && parts[1] == "disks":
+		list := &computeAggregatedDisks{Items: make(map[string]struct {
+			Disks []*computeDisk `json:"disks"`
+		})}
+		for _, disk := range f.disks {
+			scope := list.Items[disk.Zone]
+			scope.Disks = append(scope.Disks, disk)
+			list.Items[disk.Zone] = scope
+		}
+		reply(list)
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "aggregated" && parts[1] == "instances":
+		list := &computeAggregatedInstances{Items: make(map[string]struct {
+			Instances []*computeInstance `json:"instances"`
+		})}
+		for _, instance := range f.instances {
+			scope := list.Items[instance.Zone]
+			scope.Instances = append(scope.Instances, instance)
+			list.Items[instance.Zone] = scope
+		}
+		reply(list)
+	case len(parts) < 3 || parts[0] != "zones":
+		notFound()
+	case r.Method == "GET" && parts[2] == "operations":
+		reply(&computeOperation{Name: parts[3], Zone: "zones/" + parts[1], Status: "DONE"})
+	case r.Method == "POST" && len(parts) == 3 && parts[2] == "disks":
+		disk := &computeDisk{}
+		json.NewDecoder(r.Body).Decode(disk)
+		disk.Zone = "zones/" + parts[1]
+		f.disks[disk.Name] = disk
+		op(parts[1])
+	case r.Method == "GET" && len(parts) == 4 && parts[2] == "disks":
+		disk, ok := f.disks[parts[3]]
+		if !ok {
+			notFound()
+			return
+		}
+		reply(disk)
+	case r.Method == "DELETE" && len(parts) == 4 && parts[2] == "disks":
+		if _, ok := f.disks[parts[3]]; !ok {
+			notFound()
+			return
+		}
+		delete(f.disks, parts[3])
+		op(parts[1])
+	case r.Method == "POST" && len(parts) == 5 && parts[4] == "resize":
+		disk, ok := f.disks[parts[3]]
+		if !ok {
+			notFound()
+			return
+		}
+		resize := &computeDisk{}
+		json.NewDecoder(r.Body).Decode(resize)
+		disk.SizeGb = resize.SizeGb
+		op(parts[1])
+	case r.Method == "POST" && len(parts) == 5 && parts[4] == "attachDisk":
+		instance, ok := f.instances[parts[3]]
+		if !ok {
+			notFound()
+			return
+		}
+		if len(instance.Disks) >= f.maxDisks {
+			failedOp(parts[1], computeError{
+				Code:    "LIMIT_EXCEEDED",
+				Message: "Exceeded the maximum number of disks",
+			})
+			return
+		}
+		attached := computeAttachedDisk{}
+		json.NewDecoder(r.Body).Decode(&attached)
+		name := attached.Source[strings.LastIndex(attached.Source, "/")+1:]
+		instance.Disks = append(instance.Disks, attached)
+		f.disks[name].Users = []string{"zones/" + parts[1] + "/instances/" + instance.Name}
+		op(parts[1])
+	case r.Method == "POST" && len(parts) == 5 && parts[4] == "detachDisk":
+		instance, ok := f.instances[parts[3]]
+		if !ok {
+			notFound()
+			return
+		}
+		name := r.URL.Query().Get("deviceName")
+		for i, d := range instance.Disks {
+			if d.DeviceName == name {
+				instance.Disks = append(instance.Disks[:i], instance.Disks[i+1:]...)
+				f.disks[name].Users = nil
+				op(parts[1])
+				return
+			}
+		}
+		notFound()
+	default:
+		notFound()
+	}
+}
+
+func newTestProvider(f *fakeCompute) (*Provider, *httptest.Server) {
+	server := httptest.NewServer(f)
+	p := NewProviderWithEndpoint(server.URL,
+		"test",
+		func() (string, error) { return "token", nil },
+		http.DefaultClient)
+	p.pollInterval = time.Millisecond
+	return p, server
+}
+
+func TestGceDevices(t *testing.T) {
+	var _ cloudprovider.Interface = &Provider{}
+	var _ cloudprovider.Resizer = &Provider{}
+
+	f := newFakeCompute()
+	p, server := newTestProvider(f)
+	defer server.Close()
+
+	class := &config.Class{
+		Name:       "Fast",
+		DiskSizeGb: 20,
+		Parameters: map[string]string{
+			"type":   "pd-ssd",
+			"labels": "team=storage",
+		},
+	}
+	p.SetConfig(&config.Config{ClusterID: "test"})
+
+	device, err := p.DeviceCreate("node0", class)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(device.ID, "us-east1-b/rico-"))
+	assert.Equal(t, int64(20), device.Size)
+	name := device.ID[strings.Index(device.ID, "/")+1:]
+	assert.Equal(t, "/dev/disk/by-id/google-"+name, device.Path)
+
+	disk := f.disks[name]
+	assert.Equal(t, "zones/us-east1-b/diskTypes/pd-ssd", disk.Type)
+	assert.Equal(t, "storage", disk.Labels["team"])
+	assert.Equal(t, "_46ast", disk.Labels[cloudprovider.LabelClass])
+	assert.Equal(t, "test", disk.Labels[cloudprovider.LabelClusterID])
+	assert.Len(t, f.instances["node0"].Disks, 1)
+
+	// List by label
+	devices, err := p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "test"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, device.ID, devices[0].ID)
+	assert.Equal(t, "us-east1-b/node0", devices[0].InstanceID)
+	devices, err = p.ListDevices(map[string]string{
+		cloudprovider.LabelClusterID: "test",
+		cloudprovider.LabelClass:     "Fast",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "Fast", devices[0].Labels[cloudprovider.LabelClass])
+	assert.Equal(t, "storage", devices[0].Labels["team"])
+	devices, err = p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "other"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 0)
+
+	// Resize
+	resized, err := p.DeviceResize("node0", device.ID, 40)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(40), resized.Size)
+	assert.Equal(t, int64(40), f.disks[name].SizeGb)
+
+	// Device limit
+	second, err := p.DeviceCreate("us-east1-b/node0", class)
+	assert.NoError(t, err)
+	_, err = p.DeviceCreate("node0", class)
+	assert.Equal(t, cloudprovider.ErrDeviceLimit, err)
+	assert.Len(t, f.disks, 2)
+
+	// Delete
+	assert.NoError(t, p.DeviceDelete("node0", device.ID))
+	assert.Len(t, f.disks, 1)
+	assert.Len(t, f.instances["node0"].Disks, 1)
+	assert.Equal(t, cloudprovider.ErrDeviceNotFound, p.DeviceDelete("", device.ID))
+	assert.Error(t, p.DeviceDelete("node0", "nozone"))
+
+	// A delete retried after the disk was detached
+	secondName := second.ID[strings.Index(second.ID, "/")+1:]
+	f.instances["node0"].Disks = nil
+	f.disks[secondName].Users = nil
+	assert.NoError(t, p.DeviceDelete("node0", second.ID))
+	assert.Len(t, f.disks, 0)
+
+	// Unknown instance
+	_, err = p.DeviceCreate("node1", class)
+	assert.Error(t, err)
+}
+
+func TestGceAdoptZoneNodes(t *testing.T) {
+	f := newFakeCompute()
+	f.instances["node1"] = &computeInstance{Name: "node1", Zone: "zones/us-east1-c"}
+	p, server := newTestProvider(f)
+	defer server.Close()
+
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         10,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 10,
+	}
+	nodes := []*topology.StorageNode{
+		{Metadata: topology.InstanceMetadata{ID: "us-east1-b/node0"}},
+		{Metadata: topology.InstanceMetadata{ID: "us-east1-c/node1"}},
+	}
+	storage := fakestorage.New(&topology.Topology{
+		Cluster: topology.StorageCluster{StorageNodes: nodes},
+	})
+	im := inframanager.NewManager(&config.Config{
+		ClusterID: "test",
+		Classes:   []config.Class{class},
+	}, p, storage, roundrobin.New())
+	p.SetConfig(im.Config())
+
+	// A disk attached to node1 which the storage system does not have
+	device, err := p.DeviceCreate("us-east1-c/node1", &class)
+	assert.NoError(t, err)
+
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, result.Adopted, 1)
+	assert.Equal(t, "us-east1-c/node1", result.Adopted[0].Node)
+	assert.Len(t, nodes[0].Devices, 0)
+	assert.Len(t, nodes[1].Devices, 1)
+	assert.Equal(t, device.ID, nodes[1].Devices[0].Metadata.ID)
+
+	// The adopted disk is found on its node by the garbage collector
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, result.Adopted, 0)
+	assert.Empty(t, result.GC.Orphans)
+	assert.Empty(t, result.GC.Unknown)
+	assert.Empty(t, result.GC.Mismatches)
+}
+
+func TestGceParameters(t *testing.T) {
+	tests := []struct {
+		size   int64
+		params map[string]string
+		valid  bool
+	}{
+		{10, nil, true},
+		{10, map[string]string{"type": "pd-balanced"}, true},
+		{10, map[string]string{"type": "pd-extreme"}, false},
+		{5, nil, false},
+		{100000, nil, false},
+		{10, map[string]string{"labels": "a=b,c=d"}, true},
+		{10, map[string]string{"labels": "a"}, false},
+		{10, map[string]string{"labels": "team=storage_1,env-2=prod"}, true},
+		{10, map[string]string{"labels": "Team=storage"}, false},
+		{10, map[string]string{"labels": "1team=storage"}, false},
+		{10, map[string]string{"labels": "team=Storage"}, false},
+		{10, map[string]string{"labels": "team=" + strings.Repeat("a", 64)}, false},
+		{10, map[string]string{"iops": "100"}, false},
+	}
+	p := &Provider{}
+	for i, test := range tests {
+		err := p.ValidateClass(&config.Class{
+			Name:       "test",
+			DiskSizeGb: test.size,
+			Parameters: test.params,
+		})
+		assert.Equal(t, test.valid, err == nil, "test %d: %v", i, err)
+	}
+
+	assert.Error(t, p.ValidateClass(&config.Class{
+		Name:       strings.Repeat("A", 30),
+		DiskSizeGb: 10,
+	}))
+}
+
+func TestGceLabelEncoding(t *testing.T) {
+	for _, value := range []string{"", "c1", "Fast", "us-east1-b/node0", "a_b", "_4", "é"} {
+		encoded := encodeLabel(value)
+		assert.True(t, validLabel(encoded), encoded)
+		assert.Equal(t, value, decodeLabel(encoded))
+	}
+	assert.Equal(t, "us-east1-b_2fnode0", encodeLabel("us-east1-b/node0"))
+	assert.Equal(t, "a_5fb", encodeLabel("a_b"))
+	assert.Equal(t, "c1", encodeLabel("c1"))
+	assert.Equal(t, "a_zz", decodeLabel("a_zz"))
+}
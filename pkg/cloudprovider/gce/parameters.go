@@ -0,0 +1,173 @@
+/*
+Package gce implements the cloud interface for Google Compute Engine
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gce
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+)
+
+// Keys supported in config.Class.Parameters
+const (
+	// ParameterType is the persistent disk type: pd-standard,
+	// pd-balanced or pd-ssd. Defaults to pd-standard.
+	ParameterType = "type"
+
+	// ParameterLabels are the labels added to the disk as a comma
+	// separated list of key=value pairs
+	ParameterLabels = "labels"
+)
+
+// Size limits of persistent disks in GB
+const (
+	minDiskSizeGb = 10
+	maxDiskSizeGb = 65536
+)
+
+// maxLabelLength is the maximum length of label keys and values
+const maxLabelLength = 63
+
+var diskTypes = map[string]bool{
+	"pd-standard": true,
+	"pd-balanced": true,
+	"pd-ssd":      true,
+}
+
+// diskParameters are the values parsed from the class parameters
+type diskParameters struct {
+	diskType string
+	labels   map[string]string
+}
+
+// parseParameters parses and validates the parameters of the class
+func parseParameters(class *config.Class) (*diskParameters, error) {
+	d := &diskParameters{
+		diskType: "pd-standard",
+		labels:   make(map[string]string),
+	}
+
+	for key, value := range class.Parameters {
+		var err error
+		switch key {
+		case ParameterType:
+			if !diskTypes[value] {
+				err = fmt.Errorf("unsupported disk type")
+			}
+			d.diskType = value
+		case ParameterLabels:
+			d.labels, err = parseLabels(value)
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid parameter %s=%s for class %s: %v",
+				key,
+				value,
+				class.Name,
+				err)
+		}
+	}
+
+	if len(encodeLabel(class.Name)) > maxLabelLength {
+		return nil, fmt.Errorf("Invalid parameters for class %s: "+
+			"the name is too long to be a disk label",
+			class.Name)
+	}
+	if class.DiskSizeGb < minDiskSizeGb || class.DiskSizeGb > maxDiskSizeGb {
+		return nil, fmt.Errorf("Invalid parameters for class %s: "+
+			"disks must be between %d and %d GB, not %d",
+			class.Name,
+			minDiskSizeGb,
+			maxDiskSizeGb,
+			class.DiskSizeGb)
+	}
+	return d, nil
+}
+
+// parseLabels parses a comma separated list of key=value pairs. Keys
+// and values must be valid GCE labels, they are not changed.
+func parseLabels(value string) (map[string]string, error) {
+	labels, err := cloudprovider.ParseKeyValues(value)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range labels {
+		if len(key) == 0 || key[0] < 'a' || key[0] > 'z' || !validLabel(key) {
+			return nil, fmt.Errorf("label key %s must start with a lowercase "+
+				"letter and only have lowercase letters, digits, '-' and '_'", key)
+		}
+		if !validLabel(value) {
+			return nil, fmt.Errorf("label value %s must only have lowercase "+
+				"letters, digits, '-' and '_'", value)
+		}
+	}
+	return labels, nil
+}
+
+// validLabel returns true if the value is a valid GCE label value
+func validLabel(value string) bool {
+	if len(value) > maxLabelLength {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if !labelChar(value[i]) && value[i] != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// labelChar returns true if the character is kept as is by encodeLabel
+func labelChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-'
+}
+
+// encodeLabel returns the value with the characters GCE does not allow
+// in labels, and '_', replaced by '_' and their two hex digits, so the
+// value can be decoded by decodeLabel
+func encodeLabel(value string) string {
+	b := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if labelChar(c) {
+			b = append(b, c)
+		} else {
+			b = append(b, fmt.Sprintf("_%02x", c)...)
+		}
+	}
+	return string(b)
+}
+
+// decodeLabel returns the value encoded by encodeLabel. Sequences which
+// are not '_' and two hex digits are kept as is.
+func decodeLabel(value string) string {
+	b := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] == '_' && i+2 < len(value) {
+			if c, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, value[i])
+	}
+	return string(b)
+}
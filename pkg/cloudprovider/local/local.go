@@ -0,0 +1,213 @@
+/*
+Package local implements the cloud interface with local LVM or loop devices
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package local
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+
+	"github.com/pborman/uuid"
+)
+
+// Backend is where the local devices are carved from
+type Backend string
+
+const (
+	// BackendLVM creates logical volumes in a volume group
+	BackendLVM Backend = "lvm"
+
+	// BackendLoop creates sparse files in a directory and attaches them
+	// as loop devices
+	BackendLoop Backend = "loop"
+)
+
+// Options configure the local provider
+type Options struct {
+	// Backend to create devices with
+	Backend Backend
+
+	// VolumeGroup used by BackendLVM
+	VolumeGroup string
+
+	// Directory holding the sparse files of BackendLoop
+	Directory string
+
+	// InstanceID of this machine. Devices can only be created for this
+	// instance. Defaults to the hostname.
+	InstanceID string
+}
+
+// Executor runs a command and returns its standard output
+type Executor interface {
+	Run(name string, args ...string) (string, error)
+}
+
+// execExecutor runs commands on the host
+type execExecutor struct{}
+
+func (e *execExecutor) Run(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %v: %s",
+			name,
+			strings.Join(args, " "),
+			err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// backend creates, deletes and lists the devices
+type backend interface {
+	create(name string, sizeGb int64, labels map[string]string) (string, error)
+	delete(name string) error
+	list() ([]*cloudprovider.Device, error)
+}
+
+// Provider creates devices on the machine it runs on, for bare-metal
+// nodes and tests without a cloud. Class parameters are ignored. Device
+// ids are the names of the logical volumes or sparse files.
+type Provider struct {
+	instanceID string
+	backend    backend
+
+	// lock serializes changes to the devices and protects clusterID
+	lock      sync.Mutex
+	clusterID string
+}
+
+// NewProvider returns a local provider running commands on the host
+func NewProvider(opts Options) (*Provider, error) {
+	return NewProviderWithExecutor(opts, &execExecutor{})
+}
+
+// NewProviderWithExecutor returns a local provider running commands with
+// the executor provided
+func NewProviderWithExecutor(opts Options, e Executor) (*Provider, error) {
+	if len(opts.InstanceID) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get hostname: %v", err)
+		}
+		opts.InstanceID = hostname
+	}
+
+	p := &Provider{instanceID: opts.InstanceID}
+	switch opts.Backend {
+	case BackendLVM:
+		if len(opts.VolumeGroup) == 0 {
+			return nil, fmt.Errorf("Volume group missing for the lvm backend")
+		}
+		p.backend = &lvm{exec: e, volumeGroup: opts.VolumeGroup}
+	case BackendLoop:
+		if len(opts.Directory) == 0 {
+			return nil, fmt.Errorf("Directory missing for the loop backend")
+		}
+		if err := os.MkdirAll(opts.Directory, 0700); err != nil {
+			return nil, fmt.Errorf("Unable to create directory %s: %v", opts.Directory, err)
+		}
+		p.backend = &loop{exec: e, directory: opts.Directory}
+	default:
+		return nil, fmt.Errorf("Unknown backend %s", opts.Backend)
+	}
+	return p, nil
+}
+
+// SetConfig saves the cluster ID
+func (p *Provider) SetConfig(config *config.Config) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clusterID = config.ClusterID
+}
+
+// DeviceCreate creates a device of the size of the class and returns its
+// block device path
+func (p *Provider) DeviceCreate(
+	instanceID string,
+	class *config.Class,
+) (*cloudprovider.Device, error) {
+	if instanceID != p.instanceID {
+		return nil, fmt.Errorf("Instance %s is not local, this is %s",
+			instanceID,
+			p.instanceID)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	name := "rico-" + uuid.New()
+	labels := cloudprovider.DeviceLabels(p.clusterID, class, instanceID, time.Now())
+	path, err := p.backend.create(name, class.DiskSizeGb, labels)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create device: %v", err)
+	}
+	logrus.Infof("Created device %s at %s", name, path)
+
+	return &cloudprovider.Device{
+		ID:   name,
+		Path: path,
+		Size: class.DiskSizeGb,
+	}, nil
+}
+
+// DeviceDelete removes the device
+func (p *Provider) DeviceDelete(instanceID string, deviceID string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.backend.delete(deviceID); err != nil {
+		if err == cloudprovider.ErrDeviceNotFound {
+			return err
+		}
+		return fmt.Errorf("Failed to delete device %s: %v", deviceID, err)
+	}
+	return nil
+}
+
+// ListDevices returns the devices with every label in the filter
+func (p *Provider) ListDevices(filter map[string]string) ([]*cloudprovider.Device, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	all, err := p.backend.list()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list devices: %v", err)
+	}
+	devices := make([]*cloudprovider.Device, 0, len(all))
+	for _, device := range all {
+		if !cloudprovider.MatchLabels(device.Labels, filter) {
+			continue
+		}
+		if len(device.Path) != 0 {
+			device.InstanceID = p.instanceID
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
@@ -0,0 +1,258 @@
+/*
+Package local implements the cloud interface with local LVM or loop devices
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package local
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/libopenstorage/rico/pkg/allocator/roundrobin"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/inframanager"
+	"github.com/libopenstorage/rico/pkg/storageprovider/fake"
+	"github.com/libopenstorage/rico/pkg/topology"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeExecutor simulates the lvm and losetup commands
+type fakeExecutor struct {
+	lock     sync.Mutex
+	commands []string
+	lvs      map[string]string
+	loops    map[string]string
+	fail     string
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{
+		lvs:   make(map[string]string),
+		loops: make(map[string]string),
+	}
+}
+
+func (e *fakeExecutor) Run(name string, args ...string) (string, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	command := name + " " + strings.Join(args, " ")
+	e.commands = append(e.commands, command)
+	if len(e.fail) != 0 && strings.HasPrefix(command, e.fail) {
+		return "", fmt.Errorf("%s failed", command)
+	}
+
+	last := args[len(args)-1]
+	switch name {
+	case "lvcreate":
+		var lv, size string
+		tags := make([]string, 0)
+		for i := 0; i < len(args)-1; i++ {
+			switch args[i] {
+			case "--name":
+				lv = args[i+1]
+			case "--size":
+				size = strings.TrimSuffix(args[i+1], "g")
+			case "--addtag":
+				tags = append(tags, args[i+1])
+			}
+		}
+		sort.Strings(tags)
+		e.lvs[lv] = fmt.Sprintf("%s.00|%s", size, strings.Join(tags, ","))
+	case "lvs":
+		lines := make([]string, 0)
+		for lv, rest := range e.lvs {
+			lines = append(lines, "  "+lv+"|"+rest)
+		}
+		lines = append(lines, "  root|100.00|")
+		return strings.Join(lines, "\n") + "\n", nil
+	case "lvremove":
+		delete(e.lvs, last[strings.Index(last, "/")+1:])
+	case "losetup":
+		switch args[0] {
+		case "--find":
+			path := fmt.Sprintf("/dev/loop%d", len(e.loops))
+			e.loops[path] = last
+			return path + "\n", nil
+		case "--associated":
+			for path, image := range e.loops {
+				if image == last {
+					return fmt.Sprintf("%s: [2049]:12 (%s)\n", path, image), nil
+				}
+			}
+		case "--detach":
+			delete(e.loops, last)
+		}
+	}
+	return "", nil
+}
+
+func TestLocalLVM(t *testing.T) {
+	var _ cloudprovider.Interface = &Provider{}
+
+	e := newFakeExecutor()
+	_, err := NewProviderWithExecutor(Options{Backend: BackendLVM, InstanceID: "host0"}, e)
+	assert.Error(t, err)
+	p, err := NewProviderWithExecutor(Options{
+		Backend:     BackendLVM,
+		VolumeGroup: "vg0",
+		InstanceID:  "host0",
+	}, e)
+	assert.NoError(t, err)
+	p.SetConfig(&config.Config{ClusterID: "test"})
+
+	class := &config.Class{Name: "fast disks", DiskSizeGb: 8}
+	device, err := p.DeviceCreate("host0", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vg0/"+device.ID, device.Path)
+	assert.Equal(t, int64(8), device.Size)
+	assert.Contains(t, e.commands[0], "lvcreate --yes --name "+device.ID+" --size 8g")
+	assert.Contains(t, e.commands[0], "--addtag rico-class=fast#20disks")
+
+	_, err = p.DeviceCreate("host1", class)
+	assert.Error(t, err)
+
+	devices, err := p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "test"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, device.ID, devices[0].ID)
+	assert.Equal(t, device.Path, devices[0].Path)
+	assert.Equal(t, int64(8), devices[0].Size)
+	assert.Equal(t, "host0", devices[0].InstanceID)
+	assert.Equal(t, "fast disks", devices[0].Labels[cloudprovider.LabelClass])
+
+	devices, err = p.ListDevices(map[string]string{cloudprovider.LabelClass: "fast disks"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+
+	assert.NoError(t, p.DeviceDelete("host0", device.ID))
+	assert.Len(t, e.lvs, 0)
+	assert.Equal(t, cloudprovider.ErrDeviceNotFound, p.DeviceDelete("host0", device.ID))
+
+	e.fail = "lvcreate"
+	_, err = p.DeviceCreate("host0", class)
+	assert.Error(t, err)
+}
+
+func TestLocalTagEncoding(t *testing.T) {
+	for _, value := range []string{"", "c1", "fast disks", "a=b", "#20", "a,b", "é"} {
+		encoded := encodeTag(value)
+		assert.NotContains(t, encoded, "=")
+		assert.NotContains(t, encoded, ",")
+		assert.Equal(t, value, decodeTag(encoded))
+	}
+	assert.Equal(t, "fast#20disks", encodeTag("fast disks"))
+	assert.Equal(t, "#2320", encodeTag("#20"))
+	assert.Equal(t, "a#zz", decodeTag("a#zz"))
+}
+
+func TestLocalLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rico")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	e := newFakeExecutor()
+	p, err := NewProviderWithExecutor(Options{
+		Backend:    BackendLoop,
+		Directory:  filepath.Join(dir, "devices"),
+		InstanceID: "host0",
+	}, e)
+	assert.NoError(t, err)
+	p.SetConfig(&config.Config{ClusterID: "test"})
+
+	class := &config.Class{Name: "c1", DiskSizeGb: 2}
+	device, err := p.DeviceCreate("host0", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/loop0", device.Path)
+
+	// The sparse file has the size of the device
+	info, err := os.Stat(filepath.Join(dir, "devices", device.ID+".img"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2)<<30, info.Size())
+
+	devices, err := p.ListDevices(map[string]string{cloudprovider.LabelClass: "c1"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "/dev/loop0", devices[0].Path)
+	assert.Equal(t, "host0", devices[0].InstanceID)
+	assert.Equal(t, "test", devices[0].Labels[cloudprovider.LabelClusterID])
+
+	assert.NoError(t, p.DeviceDelete("host0", device.ID))
+	assert.Len(t, e.loops, 0)
+	files, _ := filepath.Glob(filepath.Join(dir, "devices", "*"))
+	assert.Len(t, files, 0)
+	assert.Equal(t, cloudprovider.ErrDeviceNotFound, p.DeviceDelete("host0", device.ID))
+
+	// Files are removed if the loop device cannot be set up
+	e.fail = "losetup --find"
+	_, err = p.DeviceCreate("host0", class)
+	assert.Error(t, err)
+	files, _ = filepath.Glob(filepath.Join(dir, "devices", "*"))
+	assert.Len(t, files, 0)
+}
+
+func TestLocalEndToEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rico")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewProviderWithExecutor(Options{
+		Backend:    BackendLoop,
+		Directory:  dir,
+		InstanceID: "host0",
+	}, newFakeExecutor())
+	assert.NoError(t, err)
+
+	storage := fake.New(&topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{
+				{Metadata: topology.InstanceMetadata{ID: "host0"}},
+			},
+		},
+	})
+	c := &config.Config{
+		ClusterID: "ci",
+		Classes: []config.Class{
+			{
+				Name:               "c1",
+				WatermarkHigh:      75,
+				WatermarkLow:       25,
+				DiskSizeGb:         1,
+				MaximumTotalSizeGb: 4,
+				MinimumTotalSizeGb: 2,
+			},
+		},
+	}
+	im := inframanager.NewManager(c, p, storage, roundrobin.New())
+	_, err = im.SetConfig(c)
+	assert.NoError(t, err)
+
+	// Storage is added up to the minimum
+	for i := 0; i < 2; i++ {
+		_, err = im.Reconcile()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, storage.Topology.NumDevices())
+	devices, err := p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "ci"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+}
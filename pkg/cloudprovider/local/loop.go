@@ -0,0 +1,158 @@
+/*
+Package local implements the cloud interface with local LVM or loop devices
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+)
+
+// loop creates the devices as sparse files attached to loop devices.
+// The size and labels of each device are stored in a json file next to
+// its sparse file.
+type loop struct {
+	exec      Executor
+	directory string
+}
+
+type loopMetadata struct {
+	Size   int64             `json:"size"`
+	Labels map[string]string `json:"labels"`
+}
+
+func (l *loop) create(name string, sizeGb int64, labels map[string]string) (string, error) {
+	image := l.image(name)
+	f, err := os.OpenFile(image, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = f.Truncate(sizeGb << 30)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(&loopMetadata{Size: sizeGb, Labels: labels})
+		if err == nil {
+			err = ioutil.WriteFile(l.metadata(name), data, 0600)
+		}
+	}
+	var path string
+	if err == nil {
+		path, err = l.exec.Run("losetup", "--find", "--show", image)
+		path = strings.TrimSpace(path)
+	}
+	if err != nil {
+		os.Remove(image)
+		os.Remove(l.metadata(name))
+		return "", err
+	}
+	return path, nil
+}
+
+func (l *loop) delete(name string) error {
+	image := l.image(name)
+	if _, err := os.Stat(image); os.IsNotExist(err) {
+		return cloudprovider.ErrDeviceNotFound
+	}
+
+	paths, err := l.loopDevices(image)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if _, err := l.exec.Run("losetup", "--detach", path); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(image); err != nil {
+		return err
+	}
+	if err := os.Remove(l.metadata(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// list returns the sparse files in the directory and their loop devices
+func (l *loop) list() ([]*cloudprovider.Device, error) {
+	files, err := filepath.Glob(filepath.Join(l.directory, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	devices := make([]*cloudprovider.Device, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		metadata := &loopMetadata{}
+		if err := json.Unmarshal(data, metadata); err != nil {
+			return nil, fmt.Errorf("Invalid metadata in %s: %v", file, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		paths, err := l.loopDevices(l.image(name))
+		if err != nil {
+			return nil, err
+		}
+		device := &cloudprovider.Device{
+			ID:     name,
+			Size:   metadata.Size,
+			Labels: metadata.Labels,
+		}
+		if len(paths) != 0 {
+			device.Path = paths[0]
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// loopDevices returns the loop devices the file is attached to. Each line
+// of the output of losetup looks like:
+//
+//	/dev/loop0: [2049]:1234 (/var/lib/rico/rico-x.img)
+func (l *loop) loopDevices(image string) ([]string, error) {
+	out, err := l.exec.Run("losetup", "--associated", image)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0)
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			paths = append(paths, strings.TrimSpace(line[:i]))
+		}
+	}
+	return paths, nil
+}
+
+func (l *loop) image(name string) string {
+	return filepath.Join(l.directory, name+".img")
+}
+
+func (l *loop) metadata(name string) string {
+	return filepath.Join(l.directory, name+".json")
+}
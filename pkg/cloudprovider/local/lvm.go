@@ -0,0 +1,134 @@
+/*
+Package local implements the cloud interface with local LVM or loop devices
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package local
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+)
+
+// lvm creates the devices as logical volumes. Labels are stored as
+// key=value tags of the logical volumes, encoded by encodeTag.
+type lvm struct {
+	exec        Executor
+	volumeGroup string
+}
+
+func (l *lvm) create(name string, sizeGb int64, labels map[string]string) (string, error) {
+	args := []string{"--yes", "--name", name, "--size", fmt.Sprintf("%dg", sizeGb)}
+	for key, value := range labels {
+		args = append(args, "--addtag", encodeTag(key)+"="+encodeTag(value))
+	}
+	args = append(args, l.volumeGroup)
+	if _, err := l.exec.Run("lvcreate", args...); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/dev/%s/%s", l.volumeGroup, name), nil
+}
+
+func (l *lvm) delete(name string) error {
+	devices, err := l.list()
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if device.ID == name {
+			_, err := l.exec.Run("lvremove", "--yes", l.volumeGroup+"/"+name)
+			return err
+		}
+	}
+	return cloudprovider.ErrDeviceNotFound
+}
+
+// list returns the logical volumes created by the provider
+func (l *lvm) list() ([]*cloudprovider.Device, error) {
+	out, err := l.exec.Run("lvs",
+		"--noheadings",
+		"--nosuffix",
+		"--units", "g",
+		"--separator", "|",
+		"-o", "lv_name,lv_size,lv_tags",
+		l.volumeGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]*cloudprovider.Device, 0)
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 3 || !strings.HasPrefix(fields[0], "rico-") {
+			continue
+		}
+		size, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid size %s of logical volume %s", fields[1], fields[0])
+		}
+		device := &cloudprovider.Device{
+			ID:     fields[0],
+			Path:   fmt.Sprintf("/dev/%s/%s", l.volumeGroup, fields[0]),
+			Size:   int64(math.Ceil(size)),
+			Labels: make(map[string]string),
+		}
+		for _, tag := range strings.Split(fields[2], ",") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) == 2 {
+				device.Labels[decodeTag(kv[0])] = decodeTag(kv[1])
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// encodeTag writes the characters not allowed in LVM tags, and the '='
+// and '#' used by the encoding, as '#' followed by two hex digits so that
+// labels such as class names can be decoded back unchanged.
+func encodeTag(value string) string {
+	const allowed = "_+.-/!:&"
+	b := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || strings.IndexByte(allowed, c) >= 0 {
+			b = append(b, c)
+		} else {
+			b = append(b, fmt.Sprintf("#%02x", c)...)
+		}
+	}
+	return string(b)
+}
+
+// decodeTag returns the value encoded by encodeTag. Sequences which are
+// not '#' and two hex digits are kept as is.
+func decodeTag(tag string) string {
+	b := make([]byte, 0, len(tag))
+	for i := 0; i < len(tag); i++ {
+		if tag[i] == '#' && i+2 < len(tag) {
+			if c, err := strconv.ParseUint(tag[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, tag[i])
+	}
+	return string(b)
+}
@@ -59,6 +59,19 @@ func (mr *MockInterfaceMockRecorder) DeviceDelete(arg0, arg1 interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeviceDelete", reflect.TypeOf((*MockInterface)(nil).DeviceDelete), arg0, arg1)
 }
 
+// ListDevices mocks base method
+func (m *MockInterface) ListDevices(arg0 map[string]string) ([]*cloudprovider.Device, error) {
+	ret := m.ctrl.Call(m, "ListDevices", arg0)
+	ret0, _ := ret[0].([]*cloudprovider.Device)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListDevices indicates an expected call of ListDevices
+func (mr *MockInterfaceMockRecorder) ListDevices(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListDevices", reflect.TypeOf((*MockInterface)(nil).ListDevices), arg0)
+}
+
 // SetConfig mocks base method
 func (m *MockInterface) SetConfig(arg0 *config.Config) {
 	m.ctrl.Call(m, "SetConfig", arg0)
@@ -0,0 +1,276 @@
+/*
+Package openstack implements the cloud interface for OpenStack
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package openstack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Credentials are used to get a token from Keystone v3
+type Credentials struct {
+	// AuthURL is the Keystone endpoint, for example
+	// https://keystone.example.com:5000/v3
+	AuthURL string
+
+	Username          string
+	Password          string
+	UserDomainName    string
+	ProjectName       string
+	ProjectDomainName string
+
+	// Region of the endpoints to use from the service catalog. Empty
+	// means the first endpoint found.
+	Region string
+}
+
+type keystoneToken struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Catalog   []struct {
+		Type      string `json:"type"`
+		Endpoints []struct {
+			Interface string `json:"interface"`
+			Region    string `json:"region"`
+			URL       string `json:"url"`
+		} `json:"endpoints"`
+	} `json:"catalog"`
+}
+
+// Subset of the Cinder v3 and Nova v2.1 APIs used by the provider
+
+type cinderVolume struct {
+	ID               string             `json:"id,omitempty"`
+	Name             string             `json:"name,omitempty"`
+	Status           string             `json:"status,omitempty"`
+	Size             int64              `json:"size,omitempty"`
+	VolumeType       string             `json:"volume_type,omitempty"`
+	AvailabilityZone string             `json:"availability_zone,omitempty"`
+	Metadata         map[string]string  `json:"metadata,omitempty"`
+	Attachments      []cinderAttachment `json:"attachments,omitempty"`
+}
+
+type cinderAttachment struct {
+	ServerID string `json:"server_id"`
+	Device   string `json:"device"`
+}
+
+type cinderVolumeList struct {
+	Volumes []*cinderVolume `json:"volumes"`
+	Links   []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"volumes_links"`
+}
+
+type novaServer struct {
+	ID               string `json:"id"`
+	AvailabilityZone string `json:"OS-EXT-AZ:availability_zone"`
+}
+
+type novaAttachment struct {
+	ID       string `json:"id,omitempty"`
+	VolumeID string `json:"volumeId"`
+	ServerID string `json:"serverId,omitempty"`
+	Device   string `json:"device,omitempty"`
+}
+
+// service is an OpenStack service in the Keystone catalog
+type service int
+
+const (
+	volumeService service = iota
+	computeService
+)
+
+// apiError is returned for responses other than 2xx
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("OpenStack returned %d: %s", e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// authenticate gets a new token and the volume and compute endpoints
+// from Keystone
+func (p *Provider) authenticate() error {
+	domain := func(name string) map[string]string {
+		if len(name) == 0 {
+			name = "Default"
+		}
+		return map[string]string{"name": name}
+	}
+	c := p.credentials
+	body := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     c.Username,
+						"password": c.Password,
+						"domain":   domain(c.UserDomainName),
+					},
+				},
+			},
+			"scope": map[string]interface{}{
+				"project": map[string]interface{}{
+					"name":   c.ProjectName,
+					"domain": domain(c.ProjectDomainName),
+				},
+			},
+		},
+	}
+
+	resp, data, err := p.send("POST",
+		strings.TrimSuffix(c.AuthURL, "/")+"/auth/tokens",
+		"",
+		body)
+	if err != nil {
+		return fmt.Errorf("Unable to authenticate with Keystone: %v", err)
+	}
+	var out struct {
+		Token keystoneToken `json:"token"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return fmt.Errorf("Unable to decode Keystone token: %v", err)
+	}
+
+	volume := out.Token.endpoint("volumev3", c.Region)
+	compute := out.Token.endpoint("compute", c.Region)
+	if len(volume) == 0 || len(compute) == 0 {
+		return fmt.Errorf("Keystone catalog has no volumev3 or compute endpoint")
+	}
+
+	p.token = resp.Header.Get("X-Subject-Token")
+	p.expires = out.Token.ExpiresAt
+	p.volumeURL = strings.TrimSuffix(volume, "/")
+	p.computeURL = strings.TrimSuffix(compute, "/")
+	return nil
+}
+
+// endpoint returns the public URL of the service in the region
+func (t *keystoneToken) endpoint(serviceType, region string) string {
+	for _, service := range t.Catalog {
+		if service.Type != serviceType {
+			continue
+		}
+		for _, e := range service.Endpoints {
+			if e.Interface == "public" && (len(region) == 0 || e.Region == region) {
+				return e.URL
+			}
+		}
+	}
+	return ""
+}
+
+// do sends a request to the volume or compute service, authenticating
+// first if the token is missing or about to expire, and decodes the
+// response into out, if not nil
+func (p *Provider) do(method string, s service, resource string, in, out interface{}) error {
+	p.authLock.Lock()
+	if len(p.token) == 0 || time.Now().Add(time.Minute).After(p.expires) {
+		if err := p.authenticate(); err != nil {
+			p.authLock.Unlock()
+			return err
+		}
+	}
+	token := p.token
+	u := p.volumeURL + resource
+	if s == computeService {
+		u = p.computeURL + resource
+	}
+	p.authLock.Unlock()
+
+	_, data, err := p.send(method, u, token, in)
+	if err != nil {
+		return err
+	}
+	if out != nil && len(data) != 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// send sends a request returning an error for responses other than 2xx
+func (p *Provider) send(method, u, token string, in interface{}) (*http.Response, []byte, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(token) != 0 {
+		req.Header.Set("X-Auth-Token", token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, &apiError{
+			StatusCode: resp.StatusCode,
+			Message:    errorMessage(data),
+		}
+	}
+	return resp, data, nil
+}
+
+// errorMessage returns the message of an OpenStack error body, which
+// is an object keyed by the error type such as itemNotFound
+func errorMessage(data []byte) string {
+	var body map[string]struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &body) == nil {
+		for _, e := range body {
+			if len(e.Message) != 0 {
+				return e.Message
+			}
+		}
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,371 @@
+/*
+Package openstack implements the cloud interface for OpenStack
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+)
+
+const (
+	// Time between checks of the status of a volume
+	pollInterval = 2 * time.Second
+
+	// Time to wait for a volume to reach a status
+	statusTimeout = 5 * time.Minute
+
+	// Time to wait for a volume to be detached before deleting it when
+	// its attach did not complete
+	cleanupTimeout = 30 * time.Second
+
+	// Time to wait for the reply to a single request
+	requestTimeout = time.Minute
+)
+
+// Provider has the client and state information to communicate with
+// Cinder and Nova. Instance ids are Nova server ids and device ids are
+// Cinder volume ids.
+type Provider struct {
+	client         *http.Client
+	credentials    Credentials
+	pollInterval   time.Duration
+	timeout        time.Duration
+	cleanupTimeout time.Duration
+
+	// Keystone token and the endpoints from its catalog
+	authLock   sync.Mutex
+	token      string
+	expires    time.Time
+	volumeURL  string
+	computeURL string
+
+	// clusterID is set in the metadata of every volume created
+	lock      sync.Mutex
+	clusterID string
+}
+
+// NewProvider provides an implementation of cloudprovider.Interface with
+// the credentials in the standard OS_* environment variables
+func NewProvider() *Provider {
+	c := Credentials{
+		AuthURL:           os.Getenv("OS_AUTH_URL"),
+		Username:          os.Getenv("OS_USERNAME"),
+		Password:          os.Getenv("OS_PASSWORD"),
+		UserDomainName:    os.Getenv("OS_USER_DOMAIN_NAME"),
+		ProjectName:       os.Getenv("OS_PROJECT_NAME"),
+		ProjectDomainName: os.Getenv("OS_PROJECT_DOMAIN_NAME"),
+		Region:            os.Getenv("OS_REGION_NAME"),
+	}
+	if len(c.AuthURL) == 0 {
+		logrus.Errorf("OS_AUTH_URL not defined")
+		return nil
+	}
+
+	return NewProviderWithCredentials(c, &http.Client{Timeout: requestTimeout})
+}
+
+// NewProviderWithCredentials provides an implementation of
+// cloudprovider.Interface authenticating with the credentials provided
+func NewProviderWithCredentials(c Credentials, client *http.Client) *Provider {
+	return &Provider{
+		client:         client,
+		credentials:    c,
+		pollInterval:   pollInterval,
+		timeout:        statusTimeout,
+		cleanupTimeout: cleanupTimeout,
+	}
+}
+
+// SetConfig saves the cluster ID set in the metadata of new volumes
+func (p *Provider) SetConfig(config *config.Config) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clusterID = config.ClusterID
+}
+
+// ValidateClass checks the volume type, availability zone and metadata
+// parameters of the class
+func (p *Provider) ValidateClass(class *config.Class) error {
+	_, err := parseParameters(class)
+	return err
+}
+
+// DeviceCreate creates a volume, waits for it to be available, attaches
+// it to the server and waits for it to be in use
+func (p *Provider) DeviceCreate(
+	instanceID string,
+	class *config.Class,
+) (*cloudprovider.Device, error) {
+
+	// Get the volume parameters from the class
+	params, err := parseParameters(class)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the availability zone of the server by default
+	if len(params.availabilityZone) == 0 {
+		var out struct {
+			Server novaServer `json:"server"`
+		}
+		if err := p.do("GET", computeService, "/servers/"+instanceID, nil, &out); err != nil {
+			return nil, fmt.Errorf("Failed to get server %s: %v", instanceID, err)
+		}
+		params.availabilityZone = out.Server.AvailabilityZone
+	}
+
+	// Set metadata so the volume can be found by ListDevices
+	p.lock.Lock()
+	labels := cloudprovider.DeviceLabels(p.clusterID, class, instanceID, time.Now())
+	p.lock.Unlock()
+	for key, value := range labels {
+		params.metadata[key] = value
+	}
+
+	// Create a volume
+	var created struct {
+		Volume cinderVolume `json:"volume"`
+	}
+	err = p.do("POST", volumeService, "/volumes", map[string]*cinderVolume{
+		"volume": {
+			Name:             "rico-" + class.Name,
+			Size:             class.DiskSizeGb,
+			VolumeType:       params.volumeType,
+			AvailabilityZone: params.availabilityZone,
+			Metadata:         params.metadata,
+		},
+	}, &created)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create volume: %v", err)
+	}
+	id := created.Volume.ID
+	if _, err := p.waitVolume(id, "available", p.timeout); err != nil {
+		p.deleteVolume(id, false)
+		return nil, err
+	}
+
+	// Attach the volume
+	err = p.do("POST",
+		computeService,
+		"/servers/"+instanceID+"/os-volume_attachments",
+		map[string]*novaAttachment{"volumeAttachment": {VolumeID: id}},
+		nil)
+	if err != nil {
+		reterr := fmt.Errorf("Unable to attach volume %s to %s: %v",
+			id,
+			instanceID,
+			err)
+		logrus.Error(reterr)
+		p.deleteVolume(id, false)
+		if isAttachmentLimit(err) {
+			return nil, cloudprovider.ErrDeviceLimit
+		}
+		return nil, reterr
+	}
+	vol, err := p.waitVolume(id, "in-use", p.timeout)
+	if err != nil {
+		p.detach(instanceID, id)
+		p.deleteVolume(id, true)
+		return nil, err
+	}
+
+	device := deviceFromVolume(vol)
+	return &cloudprovider.Device{
+		ID:   id,
+		Path: device.Path,
+		Size: vol.Size,
+	}, nil
+}
+
+// DeviceDelete detaches the volume from the specified server, waits for
+// it to be available, then deletes it. The detach is skipped if the
+// instance id is empty or the volume has no attachments left.
+func (p *Provider) DeviceDelete(instanceID string, deviceID string) error {
+	vol, err := p.getVolume(deviceID)
+	if err != nil {
+		if isNotFound(err) {
+			return cloudprovider.ErrDeviceNotFound
+		}
+		return fmt.Errorf("Failed to get volume %s: %v", deviceID, err)
+	}
+
+	// Detach volume
+	if len(instanceID) != 0 && len(vol.Attachments) != 0 {
+		if err := p.detach(instanceID, deviceID); err != nil {
+			return fmt.Errorf("Failed to detach volume %s from server %s: %v",
+				deviceID,
+				instanceID,
+				err)
+		}
+		if _, err := p.waitVolume(deviceID, "available", p.timeout); err != nil {
+			return err
+		}
+	}
+
+	// Delete volume
+	if err := p.do("DELETE", volumeService, "/volumes/"+deviceID, nil, nil); err != nil {
+		if isNotFound(err) {
+			return cloudprovider.ErrDeviceNotFound
+		}
+		return fmt.Errorf("Failed to delete volume %s: %v", deviceID, err)
+	}
+
+	return nil
+}
+
+// ListDevices returns the volumes with metadata for every label in the
+// filter
+func (p *Provider) ListDevices(filter map[string]string) ([]*cloudprovider.Device, error) {
+	resource := "/volumes/detail"
+	if len(filter) != 0 {
+		metadata, err := json.Marshal(filter)
+		if err != nil {
+			return nil, err
+		}
+		resource += "?" + url.Values{"metadata": []string{string(metadata)}}.Encode()
+	}
+
+	devices := make([]*cloudprovider.Device, 0)
+	for len(resource) != 0 {
+		list := &cinderVolumeList{}
+		if err := p.do("GET", volumeService, resource, nil, list); err != nil {
+			return nil, fmt.Errorf("Failed to list volumes: %v", err)
+		}
+		for _, vol := range list.Volumes {
+			if cloudprovider.MatchLabels(vol.Metadata, filter) {
+				devices = append(devices, deviceFromVolume(vol))
+			}
+		}
+
+		resource = ""
+		for _, link := range list.Links {
+			if link.Rel == "next" {
+				resource = p.volumeResource(link.Href)
+			}
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices, nil
+}
+
+// deviceFromVolume returns the device with the ID, size, metadata and
+// attachment of the volume
+func deviceFromVolume(vol *cinderVolume) *cloudprovider.Device {
+	device := &cloudprovider.Device{
+		ID:     vol.ID,
+		Size:   vol.Size,
+		Labels: make(map[string]string, len(vol.Metadata)),
+	}
+	for key, value := range vol.Metadata {
+		device.Labels[key] = value
+	}
+	if len(vol.Attachments) != 0 {
+		device.InstanceID = vol.Attachments[0].ServerID
+		device.Path = vol.Attachments[0].Device
+	}
+	return device
+}
+
+// volumeResource returns the resource of a link to the volume service
+func (p *Provider) volumeResource(href string) string {
+	p.authLock.Lock()
+	defer p.authLock.Unlock()
+	return strings.TrimPrefix(href, p.volumeURL)
+}
+
+func (p *Provider) getVolume(id string) (*cinderVolume, error) {
+	var out struct {
+		Volume cinderVolume `json:"volume"`
+	}
+	if err := p.do("GET", volumeService, "/volumes/"+id, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Volume, nil
+}
+
+// waitVolume waits for the volume to reach the status provided, for at
+// most the timeout
+func (p *Provider) waitVolume(
+	id, status string,
+	timeout time.Duration,
+) (*cinderVolume, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		vol, err := p.getVolume(id)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get volume %s: %v", id, err)
+		}
+		if vol.Status == status {
+			return vol, nil
+		}
+		if strings.HasPrefix(vol.Status, "error") {
+			return nil, fmt.Errorf("Volume %s is in status %s", id, vol.Status)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out waiting for volume %s to be %s, "+
+				"it is %s",
+				id,
+				status,
+				vol.Status)
+		}
+		time.Sleep(p.pollInterval)
+	}
+}
+
+func (p *Provider) detach(instanceID, id string) error {
+	return p.do("DELETE",
+		computeService,
+		"/servers/"+instanceID+"/os-volume_attachments/"+id,
+		nil,
+		nil)
+}
+
+// deleteVolume deletes a volume left by a failed create, logging any
+// failure. A volume which was being attached is first waited for to be
+// detached, for at most cleanupTimeout. A volume which cannot be deleted
+// yet keeps its metadata, so it is found as an orphan later.
+func (p *Provider) deleteVolume(id string, attached bool) {
+	if attached {
+		if _, err := p.waitVolume(id, "available", p.cleanupTimeout); err != nil {
+			logrus.Errorf("Volume %s not available to delete: %v", id, err)
+		}
+	}
+	if err := p.do("DELETE", volumeService, "/volumes/"+id, nil, nil); err != nil {
+		logrus.Errorf("Failed to delete volume %s: %v", id, err)
+	}
+}
+
+// isAttachmentLimit returns true if the server cannot take any more
+// volumes
+func isAttachmentLimit(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && strings.Contains(strings.ToLower(apiErr.Message), "maximum number of volumes")
+}
@@ -0,0 +1,404 @@
+/*
+Package openstack implements the cloud interface for OpenStack
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package openstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOpenStack is a local fake of Keystone, Cinder and Nova. Volumes
+// move to their next status on the first poll. Volumes are listed one
+// per page.
+type fakeOpenStack struct {
+	lock       sync.Mutex
+	url        string
+	auths      int
+	volumes    map[string]*cinderVolume
+	servers    map[string]*novaServer
+	maxVolumes int
+	next       map[string]string
+	ids        int
+
+	// stuck is a status, creating or attaching, which volumes do not
+	// leave
+	stuck string
+}
+
+func newFakeOpenStack() *fakeOpenStack {
+	return &fakeOpenStack{
+		volumes: make(map[string]*cinderVolume),
+		servers: map[string]*novaServer{
+			"server0": {ID: "server0", AvailabilityZone: "nova"},
+		},
+		maxVolumes: 2,
+		next:       make(map[string]string),
+	}
+}
+
+func (f *fakeOpenStack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	reply := func(status int, v interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(status int, kind, message string) {
+		reply(status, map[string]map[string]string{kind: {"message": message}})
+	}
+
+	if r.URL.Path == "/identity/v3/auth/tokens" {
+		var body struct {
+			Auth struct {
+				Identity struct {
+					Password struct {
+						User struct {
+							Name     string `json:"name"`
+							Password string `json:"password"`
+						} `json:"user"`
+					} `json:"password"`
+				} `json:"identity"`
+			} `json:"auth"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Auth.Identity.Password.User.Password != "secret" {
+			fail(http.StatusUnauthorized, "error", "bad password")
+			return
+		}
+		f.auths++
+		w.Header().Set("X-Subject-Token", "token")
+		reply(http.StatusCreated, map[string]interface{}{
+			"token": map[string]interface{}{
+				"expires_at": time.Now().Add(time.Hour),
+				"catalog": []interface{}{
+					map[string]interface{}{
+						"type": "volumev3",
+						"endpoints": []interface{}{
+							map[string]string{"interface": "admin", "region": "r1", "url": "http://admin"},
+							map[string]string{"interface": "public", "region": "r1", "url": f.url + "/volume/v3/proj"},
+						},
+					},
+					map[string]interface{}{
+						"type": "compute",
+						"endpoints": []interface{}{
+							map[string]string{"interface": "public", "region": "r1", "url": f.url + "/compute/v2.1/"},
+						},
+					},
+				},
+			},
+		})
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != "token" {
+		fail(http.StatusUnauthorized, "error", "no token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "volume" && parts[3] == "volumes" && r.Method == "POST":
+		var body struct {
+			Volume cinderVolume `json:"volume"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.ids++
+		vol := body.Volume
+		vol.ID = fmt.Sprintf("vol%d", f.ids)
+		vol.Status = "creating"
+		f.volumes[vol.ID] = &vol
+		if f.stuck != vol.Status {
+			f.next[vol.ID] = "available"
+		}
+		reply(http.StatusAccepted, map[string]*cinderVolume{"volume": &vol})
+	case len(parts) == 5 && parts[0] == "volume" && parts[4] == "detail":
+		var filter map[string]string
+		json.Unmarshal([]byte(r.URL.Query().Get("metadata")), &filter)
+		ids := make([]string, 0)
+		for id, vol := range f.volumes {
+			if cloudprovider.MatchLabels(vol.Metadata, filter) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		list := &cinderVolumeList{Volumes: make([]*cinderVolume, 0)}
+		marker := r.URL.Query().Get("marker")
+		for i, id := range ids {
+			if id <= marker {
+				continue
+			}
+			list.Volumes = append(list.Volumes, f.volumes[id])
+			if i+1 < len(ids) {
+				q := r.URL.Query()
+				q.Set("marker", id)
+				list.Links = append(list.Links, struct {
+					Rel  string `json:"rel"`
+					Href string `json:"href"`
+				}{"next", f.url + r.URL.Path + "?" + q.Encode()})
+			}
+			break
+		}
+		reply(http.StatusOK, list)
+	case len(parts) == 5 && parts[0] == "volume" && parts[3] == "volumes":
+		vol, ok := f.volumes[parts[4]]
+		if !ok {
+			fail(http.StatusNotFound, "itemNotFound", "volume not found")
+			return
+		}
+		switch r.Method {
+		case "GET":
+			if status, ok := f.next[vol.ID]; ok {
+				vol.Status = status
+				delete(f.next, vol.ID)
+			}
+			reply(http.StatusOK, map[string]*cinderVolume{"volume": vol})
+		case "DELETE":
+			if vol.Status != "available" {
+				fail(http.StatusBadRequest, "badRequest", "volume is "+vol.Status)
+				return
+			}
+			delete(f.volumes, vol.ID)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case len(parts) == 4 && parts[0] == "compute" && parts[2] == "servers":
+		server, ok := f.servers[parts[3]]
+		if !ok {
+			fail(http.StatusNotFound, "itemNotFound", "server not found")
+			return
+		}
+		reply(http.StatusOK, map[string]*novaServer{"server": server})
+	case len(parts) >= 5 && parts[0] == "compute" && parts[4] == "os-volume_attachments":
+		if _, ok := f.servers[parts[3]]; !ok {
+			fail(http.StatusNotFound, "itemNotFound", "server not found")
+			return
+		}
+		attached := 0
+		for _, vol := range f.volumes {
+			if len(vol.Attachments) != 0 && vol.Attachments[0].ServerID == parts[3] {
+				attached++
+			}
+		}
+		if r.Method == "POST" {
+			var body struct {
+				Attachment novaAttachment `json:"volumeAttachment"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			vol, ok := f.volumes[body.Attachment.VolumeID]
+			if !ok || vol.Status != "available" {
+				fail(http.StatusBadRequest, "badRequest", "volume not available")
+				return
+			}
+			if attached >= f.maxVolumes {
+				fail(http.StatusForbidden, "forbidden",
+					fmt.Sprintf("Maximum number of volumes allowed (%d) exceeded", f.maxVolumes))
+				return
+			}
+			device := fmt.Sprintf("/dev/vd%c", 'b'+attached)
+			vol.Status = "attaching"
+			vol.Attachments = []cinderAttachment{{ServerID: parts[3], Device: device}}
+			if f.stuck != vol.Status {
+				f.next[vol.ID] = "in-use"
+			}
+			reply(http.StatusOK, map[string]*novaAttachment{"volumeAttachment": {
+				VolumeID: vol.ID,
+				ServerID: parts[3],
+				Device:   device,
+			}})
+			return
+		}
+		vol, ok := f.volumes[parts[5]]
+		if !ok || len(vol.Attachments) == 0 {
+			fail(http.StatusNotFound, "itemNotFound", "attachment not found")
+			return
+		}
+		vol.Status = "detaching"
+		vol.Attachments = nil
+		f.next[vol.ID] = "available"
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		fail(http.StatusNotFound, "itemNotFound", r.URL.Path)
+	}
+}
+
+func TestOpenStackDevices(t *testing.T) {
+	var _ cloudprovider.Interface = &Provider{}
+
+	f := newFakeOpenStack()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	f.url = server.URL
+
+	p := NewProviderWithCredentials(Credentials{
+		AuthURL:     server.URL + "/identity/v3",
+		Username:    "rico",
+		Password:    "secret",
+		ProjectName: "proj",
+		Region:      "r1",
+	}, http.DefaultClient)
+	p.pollInterval = time.Millisecond
+	p.SetConfig(&config.Config{ClusterID: "test"})
+
+	class := &config.Class{
+		Name:       "ssd",
+		DiskSizeGb: 16,
+		Parameters: map[string]string{
+			"type":     "ssd",
+			"metadata": "team=storage",
+		},
+	}
+
+	d1, err := p.DeviceCreate("server0", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vdb", d1.Path)
+	assert.Equal(t, int64(16), d1.Size)
+	vol := f.volumes[d1.ID]
+	assert.Equal(t, "in-use", vol.Status)
+	assert.Equal(t, "ssd", vol.VolumeType)
+	assert.Equal(t, "nova", vol.AvailabilityZone)
+	assert.Equal(t, "storage", vol.Metadata["team"])
+	assert.Equal(t, "test", vol.Metadata[cloudprovider.LabelClusterID])
+
+	// The availability zone from the class overrides the server's
+	class.Parameters["availabilityZone"] = "az2"
+	d2, err := p.DeviceCreate("server0", class)
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/vdc", d2.Path)
+	assert.Equal(t, "az2", f.volumes[d2.ID].AvailabilityZone)
+
+	// The server takes no more volumes and the new one is deleted
+	_, err = p.DeviceCreate("server0", class)
+	assert.Equal(t, cloudprovider.ErrDeviceLimit, err)
+	assert.Len(t, f.volumes, 2)
+
+	// List across pages
+	devices, err := p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "test"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+	assert.Equal(t, d1.ID, devices[0].ID)
+	assert.Equal(t, "server0", devices[0].InstanceID)
+	assert.Equal(t, d2.ID, devices[1].ID)
+	devices, err = p.ListDevices(map[string]string{cloudprovider.LabelClusterID: "other"})
+	assert.NoError(t, err)
+	assert.Len(t, devices, 0)
+
+	// Delete waits for the volume to be detached
+	assert.NoError(t, p.DeviceDelete("server0", d1.ID))
+	assert.Len(t, f.volumes, 1)
+	assert.Equal(t, cloudprovider.ErrDeviceNotFound, p.DeviceDelete("server0", d1.ID))
+
+	// Unknown server
+	_, err = p.DeviceCreate("server1", &config.Class{Name: "c", DiskSizeGb: 1})
+	assert.Error(t, err)
+
+	// The token was reused
+	assert.Equal(t, 1, f.auths)
+}
+
+func TestOpenStackCreateCleanup(t *testing.T) {
+	f := newFakeOpenStack()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	f.url = server.URL
+
+	p := NewProviderWithCredentials(Credentials{
+		AuthURL:     server.URL + "/identity/v3",
+		Username:    "rico",
+		Password:    "secret",
+		ProjectName: "proj",
+	}, http.DefaultClient)
+	p.pollInterval = time.Millisecond
+	p.timeout = 300 * time.Millisecond
+	class := &config.Class{Name: "c", DiskSizeGb: 1}
+
+	// A volume which is not created in time is not waited for again
+	f.stuck = "creating"
+	start := time.Now()
+	_, err := p.DeviceCreate("server0", class)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*p.timeout, time.Since(start))
+	assert.Len(t, f.volumes, 1)
+	f.volumes = make(map[string]*cinderVolume)
+
+	// A volume which is not attached in time is detached and deleted
+	f.stuck = "attaching"
+	start = time.Now()
+	_, err = p.DeviceCreate("server0", class)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*p.timeout, time.Since(start))
+	assert.Len(t, f.volumes, 0)
+}
+
+func TestOpenStackAuthentication(t *testing.T) {
+	f := newFakeOpenStack()
+	server := httptest.NewServer(f)
+	defer server.Close()
+	f.url = server.URL
+
+	p := NewProviderWithCredentials(Credentials{
+		AuthURL:  server.URL + "/identity/v3",
+		Username: "rico",
+		Password: "wrong",
+	}, http.DefaultClient)
+	_, err := p.ListDevices(nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bad password")
+
+	// No endpoint in the region
+	p = NewProviderWithCredentials(Credentials{
+		AuthURL:  server.URL + "/identity/v3",
+		Username: "rico",
+		Password: "secret",
+		Region:   "r2",
+	}, http.DefaultClient)
+	_, err = p.ListDevices(nil)
+	assert.Error(t, err)
+}
+
+func TestOpenStackParameters(t *testing.T) {
+	tests := []struct {
+		size   int64
+		params map[string]string
+		valid  bool
+	}{
+		{1, nil, true},
+		{0, nil, false},
+		{1, map[string]string{"type": "any", "availabilityZone": "nova"}, true},
+		{1, map[string]string{"metadata": "a=b,c=d"}, true},
+		{1, map[string]string{"metadata": "a"}, false},
+		{1, map[string]string{"iops": "100"}, false},
+	}
+	p := &Provider{}
+	for i, test := range tests {
+		err := p.ValidateClass(&config.Class{
+			Name:       "test",
+			DiskSizeGb: test.size,
+			Parameters: test.params,
+		})
+		assert.Equal(t, test.valid, err == nil, "test %d: %v", i, err)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Package openstack implements the cloud interface for OpenStack
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package openstack
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+)
+
+// Keys supported in config.Class.Parameters
+const (
+	// ParameterType is the Cinder volume type. Defaults to the default
+	// volume type of the cloud.
+	ParameterType = "type"
+
+	// ParameterAvailabilityZone is the Cinder availability zone of the
+	// volumes. Defaults to the availability zone of the server.
+	ParameterAvailabilityZone = "availabilityZone"
+
+	// ParameterMetadata is added to the metadata of the volume as a comma
+	// separated list of key=value pairs
+	ParameterMetadata = "metadata"
+)
+
+// volumeParameters are the values parsed from the class parameters
+type volumeParameters struct {
+	volumeType       string
+	availabilityZone string
+	metadata         map[string]string
+}
+
+// parseParameters parses and validates the parameters of the class
+func parseParameters(class *config.Class) (*volumeParameters, error) {
+	v := &volumeParameters{
+		metadata: make(map[string]string),
+	}
+
+	for key, value := range class.Parameters {
+		var err error
+		switch key {
+		case ParameterType:
+			v.volumeType = value
+		case ParameterAvailabilityZone:
+			v.availabilityZone = value
+		case ParameterMetadata:
+			v.metadata, err = cloudprovider.ParseKeyValues(value)
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid parameter %s=%s for class %s: %v",
+				key,
+				value,
+				class.Name,
+				err)
+		}
+	}
+
+	if class.DiskSizeGb < 1 {
+		return nil, fmt.Errorf("Invalid parameters for class %s: "+
+			"volumes must be at least 1 GiB",
+			class.Name)
+	}
+	return v, nil
+}
@@ -20,6 +20,22 @@ import (
 	"fmt"
 )
 
+// GrowthStrategy determines how storage is added to a class
+type GrowthStrategy string
+
+const (
+	// GrowthAdd attaches new disks. This is the default.
+	GrowthAdd GrowthStrategy = "add"
+
+	// GrowthGrow resizes the existing disks. New disks are only added
+	// when the class has none.
+	GrowthGrow GrowthStrategy = "grow"
+
+	// GrowthHybrid resizes the existing disks until they all reach
+	// MaximumDiskSizeGb, then attaches new disks
+	GrowthHybrid GrowthStrategy = "hybrid"
+)
+
 // Class defines the type of storage to use for the appropriate
 // cloud provider
 // TODO: Use json instead
@@ -44,6 +60,77 @@ type Class struct {
 
 	// Size of the disk to add
 	DiskSizeGb int64 `json:"diskSize"`
+
+	// Minimum time in seconds since the last action on this class
+	// before storage can be added again
+	ScaleUpCooldownSeconds int64 `json:"scaleUpCooldown,omitempty"`
+
+	// Minimum time in seconds since the last action on this class
+	// before storage can be removed
+	ScaleDownCooldownSeconds int64 `json:"scaleDownCooldown,omitempty"`
+
+	// Number of consecutive reconcile passes utilization must stay above
+	// WatermarkHigh or below WatermarkLow before storage is added or
+	// removed. Zero or one acts on the first sample.
+	WatermarkSamples int `json:"watermarkSamples,omitempty"`
+
+	// TargetUtilization, if set, is the utilization to reach when adding
+	// storage. As many disk sets as needed to bring the utilization of
+	// the class down to this value are added in a single reconcile,
+	// within MaximumTotalSizeGb. If not set only one disk set is added.
+	TargetUtilization int `json:"targetUtilization,omitempty"`
+
+	// GrowthStrategy determines if storage is added by attaching new
+	// disks or by growing existing ones. Growing requires both the cloud
+	// provider and the storage system to support resizing.
+	GrowthStrategy GrowthStrategy `json:"growthStrategy,omitempty"`
+
+	// MaximumDiskSizeGb is the largest size in Gi a disk is grown to.
+	// Disks grow by DiskSizeGb at a time. Zero means disks grow up to
+	// MaximumTotalSizeGb. Required for the hybrid strategy.
+	MaximumDiskSizeGb int64 `json:"maximumDiskSize,omitempty"`
+
+	// Allocation lists the allocator plugins used to place the storage
+	// of this class. Only used by the plugin framework allocator, which
+	// falls back to its own defaults if none are provided.
+	Allocation []Plugin `json:"allocation,omitempty"`
+}
+
+// Plugin selects an allocator plugin by name
+type Plugin struct {
+	// Name of the plugin in the allocator registry
+	Name string `json:"name"`
+
+	// Weight of the score of the plugin. Zero is the same as one.
+	// Ignored by filter plugins.
+	Weight int `json:"weight,omitempty"`
+
+	// Args passed to the plugin when it is created
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// Copy returns a deep copy of the class
+func (c *Class) Copy() *Class {
+	n := *c
+	if c.Parameters != nil {
+		n.Parameters = make(map[string]string, len(c.Parameters))
+		for k, v := range c.Parameters {
+			n.Parameters[k] = v
+		}
+	}
+	if c.Allocation != nil {
+		n.Allocation = make([]Plugin, len(c.Allocation))
+		for i, p := range c.Allocation {
+			n.Allocation[i] = p
+			if p.Args != nil {
+				n.Allocation[i].Args = make(map[string]string, len(p.Args))
+				for k, v := range p.Args {
+					n.Allocation[i].Args[k] = v
+				}
+			}
+		}
+	}
+	return &n
 }
 
 // String formats a string based on the information from the class
@@ -16,9 +16,85 @@ limitations under the License.
 */
 package config
 
+// RemovedClassPolicy determines what happens to the storage of a class
+// which is removed from the configuration
+type RemovedClassPolicy string
+
+const (
+	// RemovedClassFreeze leaves the devices of the class untouched and
+	// stops managing them. This is the default.
+	RemovedClassFreeze RemovedClassPolicy = "freeze"
+
+	// RemovedClassDrain removes the devices of the class, one per
+	// reconcile, until none are left
+	RemovedClassDrain RemovedClassPolicy = "drain"
+)
+
 // Config contains all the configuration settings
 type Config struct {
 
 	// Classes of storage to manage
 	Classes []Class `json:"classes"`
+
+	// RemovedClassPolicy is applied to classes removed from the
+	// configuration while the manager is running
+	RemovedClassPolicy RemovedClassPolicy `json:"removedClassPolicy,omitempty"`
+
+	// MaxDevicesPerNode limits the number of devices attached to each
+	// node. Zero means the limit is set only by the storage system or
+	// the cloud provider, if at all.
+	MaxDevicesPerNode int `json:"maxDevicesPerNode,omitempty"`
+
+	// ClusterID identifies the devices created by this cluster. It is
+	// set as a label on every device, and devices with the label are
+	// adopted on startup. Up to 63 lowercase letters, digits, '-' or
+	// '_'.
+	ClusterID string `json:"clusterId,omitempty"`
+
+	// GarbageCollection configures how devices labeled with the cluster
+	// ID but unknown to the storage system are handled
+	GarbageCollection GarbageCollection `json:"garbageCollection,omitempty"`
+
+	// JournalPath is the file recording the operations in progress, so
+	// they are recovered when the manager restarts after a crash. If
+	// empty, the journal is only kept in memory. It is only read when
+	// the manager is created.
+	JournalPath string `json:"journalPath,omitempty"`
+}
+
+// GarbageCollection configures the detection and removal of orphaned
+// devices. Orphans are only reported unless Delete is set.
+type GarbageCollection struct {
+	// Delete orphaned devices once the grace period has passed
+	Delete bool `json:"delete,omitempty"`
+
+	// GracePeriodSeconds is how long a device must stay orphaned
+	// before it is deleted. It must be set when Delete is.
+	GracePeriodSeconds int `json:"gracePeriodSeconds,omitempty"`
+
+	// MaxDeletesPerPass limits the number of orphans deleted in a
+	// single pass. Zero means one.
+	MaxDeletesPerPass int `json:"maxDeletesPerPass,omitempty"`
+}
+
+// Copy returns a deep copy of the configuration
+func (c *Config) Copy() *Config {
+	n := *c
+	if c.Classes != nil {
+		n.Classes = make([]Class, len(c.Classes))
+		for i, class := range c.Classes {
+			n.Classes[i] = *class.Copy()
+		}
+	}
+	return &n
+}
+
+// Class returns the class with the name provided, or nil if not found
+func (c *Config) Class(name string) *Class {
+	for i := range c.Classes {
+		if c.Classes[i].Name == name {
+			return &c.Classes[i]
+		}
+	}
+	return nil
 }
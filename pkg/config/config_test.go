@@ -0,0 +1,380 @@
+/*
+Package config provides the configuration to the Manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	yamlConfig := `
+classes:
+- name: gp2
+  watermarkHigh: 75
+  watermarkLow: 25
+  diskSize: 8
+  maximumTotalSize: 1024
+  minimumTotalSize: 32
+  parameters:
+    type: gp2
+- name: io1
+  watermarkHigh: 80
+  watermarkLow: 20
+  diskSize: 100
+  maximumTotalSize: 1000
+`
+	jsonConfig := `{
+		"classes": [
+			{
+				"name": "gp2",
+				"watermarkHigh": 75,
+				"watermarkLow": 25,
+				"diskSize": 8,
+				"maximumTotalSize": 1024,
+				"minimumTotalSize": 32,
+				"parameters": {"type": "gp2"}
+			},
+			{
+				"name": "io1",
+				"watermarkHigh": 80,
+				"watermarkLow": 20,
+				"diskSize": 100,
+				"maximumTotalSize": 1000
+			}
+		]
+	}`
+
+	for _, data := range []string{yamlConfig, jsonConfig} {
+		c, err := Parse([]byte(data))
+		assert.NoError(t, err)
+		assert.Len(t, c.Classes, 2)
+		assert.Equal(t, Class{
+			Name:               "gp2",
+			WatermarkHigh:      75,
+			WatermarkLow:       25,
+			DiskSizeGb:         8,
+			MaximumTotalSizeGb: 1024,
+			MinimumTotalSizeGb: 32,
+			Parameters:         map[string]string{"type": "gp2"},
+		}, c.Classes[0])
+		assert.Equal(t, "io1", c.Classes[1].Name)
+		assert.Equal(t, int64(100), c.Classes[1].DiskSizeGb)
+	}
+
+	_, err := Parse([]byte("classes: ["))
+	assert.Error(t, err)
+	_, err = Parse([]byte("classes:\n- name: gp2\n  diskSizeGb: 8\n"))
+	assert.Error(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rico.yaml")
+	_, err = Load(path)
+	assert.Error(t, err)
+
+	err = ioutil.WriteFile(path, []byte(`
+classes:
+- name: gp2
+  watermarkHigh: 75
+  watermarkLow: 25
+  diskSize: 8
+  maximumTotalSize: 1024
+`), 0644)
+	assert.NoError(t, err)
+	c, err := Load(path)
+	assert.NoError(t, err)
+	assert.Len(t, c.Classes, 1)
+
+	// Invalid values are reported with the file name
+	err = ioutil.WriteFile(path, []byte(`
+classes:
+- name: gp2
+  watermarkHigh: 75
+  watermarkLow: 85
+  diskSize: 8
+  maximumTotalSize: 1024
+`), 0644)
+	assert.NoError(t, err)
+	_, err = Load(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), path)
+}
+
+func TestValidate(t *testing.T) {
+	valid := Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 32,
+	}
+	assert.NoError(t, valid.Validate())
+
+	tests := []struct {
+		name   string
+		modify func(c *Class)
+	}{
+		{"no name", func(c *Class) { c.Name = "" }},
+		{"low above high", func(c *Class) { c.WatermarkLow = 80 }},
+		{"low equals high", func(c *Class) { c.WatermarkLow = 75 }},
+		{"high above 100", func(c *Class) { c.WatermarkHigh = 101 }},
+		{"negative low", func(c *Class) { c.WatermarkLow = -1 }},
+		{"min above max", func(c *Class) { c.MinimumTotalSizeGb = 2048 }},
+		{"no disk size", func(c *Class) { c.DiskSizeGb = 0 }},
+		{"disk above max", func(c *Class) { c.DiskSizeGb = 2048; c.MinimumTotalSizeGb = 0 }},
+		{"negative cooldown", func(c *Class) { c.ScaleUpCooldownSeconds = -1 }},
+		{"target above high", func(c *Class) { c.TargetUtilization = 80 }},
+		{"target below low", func(c *Class) { c.TargetUtilization = 20 }},
+		{"unknown growth", func(c *Class) { c.GrowthStrategy = "shrink" }},
+		{"hybrid without max", func(c *Class) { c.GrowthStrategy = GrowthHybrid }},
+		{"max disk below disk", func(c *Class) { c.MaximumDiskSizeGb = 4 }},
+		{"plugin no name", func(c *Class) { c.Allocation = []Plugin{{Weight: 1}} }},
+		{"plugin negative weight", func(c *Class) {
+			c.Allocation = []Plugin{{Name: "device-count", Weight: -1}}
+		}},
+	}
+	for _, test := range tests {
+		c := valid
+		test.modify(&c)
+		assert.Error(t, c.Validate(), test.name)
+	}
+
+	c := valid
+	c.TargetUtilization = 50
+	assert.NoError(t, c.Validate())
+
+	// Duplicate names
+	config := &Config{Classes: []Class{valid, valid}}
+	err := config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "more than once")
+	config = &Config{MaxDevicesPerNode: -1}
+	assert.Error(t, config.Validate())
+	config = &Config{ClusterID: "Prod.1"}
+	assert.Error(t, config.Validate())
+	config = &Config{ClusterID: "prod-1"}
+	assert.NoError(t, config.Validate())
+	config = &Config{GarbageCollection: GarbageCollection{Delete: true}}
+	assert.Error(t, config.Validate())
+	config = &Config{
+		ClusterID:         "prod-1",
+		GarbageCollection: GarbageCollection{Delete: true},
+	}
+	err = config.Validate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "gracePeriodSeconds")
+	config.GarbageCollection.GracePeriodSeconds = 3600
+	assert.NoError(t, config.Validate())
+	config = &Config{GarbageCollection: GarbageCollection{GracePeriodSeconds: -1}}
+	assert.Error(t, config.Validate())
+	config = &Config{}
+	assert.NoError(t, config.Validate())
+}
+
+func TestDiff(t *testing.T) {
+	c1 := Class{Name: "c1", DiskSizeGb: 8}
+	c2 := Class{Name: "c2", DiskSizeGb: 8}
+	c3 := Class{Name: "c3", DiskSizeGb: 8}
+	old := &Config{Classes: []Class{c1, c2}}
+
+	c2.Parameters = map[string]string{"type": "gp2"}
+	new := &Config{Classes: []Class{c2, c3}}
+
+	d := NewDiff(old, new)
+	assert.False(t, d.Empty())
+	assert.Equal(t, []Class{c3}, d.Added)
+	assert.Equal(t, []Class{c1}, d.Removed)
+	assert.Equal(t, []Class{c2}, d.Modified)
+	assert.Equal(t, "Added:[c3] Removed:[c1] Modified:[c2]", d.String())
+
+	assert.True(t, NewDiff(new, new.Copy()).Empty())
+}
+
+func TestCopy(t *testing.T) {
+	c := &Config{
+		Classes: []Class{
+			{
+				Name:       "c1",
+				Parameters: map[string]string{"type": "gp2"},
+				Allocation: []Plugin{
+					{Name: "max-devices-per-node", Args: map[string]string{"max": "4"}},
+				},
+			},
+		},
+	}
+	n := c.Copy()
+	n.Classes[0].Name = "c2"
+	n.Classes[0].Parameters["type"] = "io1"
+	n.Classes[0].Allocation[0].Args["max"] = "8"
+	assert.Equal(t, "4", c.Classes[0].Allocation[0].Args["max"])
+	assert.Equal(t, "c1", c.Classes[0].Name)
+	assert.Equal(t, "gp2", c.Classes[0].Parameters["type"])
+	assert.NotNil(t, n.Class("c2"))
+	assert.Nil(t, n.Class("c1"))
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rico.yaml")
+
+	configs := make(chan *Config, 10)
+	w := NewWatcher(path, 10*time.Millisecond, func(c *Config) error {
+		configs <- c
+		return nil
+	})
+
+	// File must exist and be valid
+	_, err = w.Start()
+	assert.Error(t, err)
+
+	class := "- name: %s\n  watermarkHigh: 75\n  watermarkLow: 25\n" +
+		"  diskSize: 8\n  maximumTotalSize: 1024\n"
+	write := func(data string) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	write("classes:\n" + fmt.Sprintf(class, "c1"))
+	c, err := w.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, "c1", c.Classes[0].Name)
+	defer w.Stop()
+
+	// Invalid configurations are ignored
+	write("classes:\n- name: bad\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, configs, 0)
+
+	write("classes:\n" + fmt.Sprintf(class, "c1") + fmt.Sprintf(class, "c2"))
+	select {
+	case c = <-configs:
+		assert.Len(t, c.Classes, 2)
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration change not detected")
+	}
+
+	w.Stop()
+	w.Stop()
+}
+
+func TestWatcherPartialWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rico.yaml")
+
+	class := "- name: %s\n  watermarkHigh: 75\n  watermarkLow: 25\n" +
+		"  diskSize: 8\n  maximumTotalSize: 1024\n"
+	write := func(data string) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	write("classes:\n" + fmt.Sprintf(class, "c1") + fmt.Sprintf(class, "c2"))
+
+	w := NewWatcher(path, time.Hour, func(*Config) error { return nil })
+	_, data, err := w.load()
+	assert.NoError(t, err)
+	w.data = data
+
+	// A file truncated in the middle of a write parses, but is not
+	// applied since it changes before the next check
+	write("classes:\n" + fmt.Sprintf(class, "c1"))
+	assert.Nil(t, w.check())
+	write("classes:\n" + fmt.Sprintf(class, "c1") + fmt.Sprintf(class, "c2") +
+		fmt.Sprintf(class, "c3"))
+	assert.Nil(t, w.check())
+
+	// The new content is applied once it is read twice
+	c := w.check()
+	assert.NotNil(t, c)
+	assert.Len(t, c.Classes, 3)
+	assert.Nil(t, w.check())
+}
+
+type nameValidator string
+
+func (v nameValidator) ValidateClass(class *Class) error {
+	if class.Name == string(v) {
+		return fmt.Errorf("Class %s rejected", class.Name)
+	}
+	return nil
+}
+
+func TestWatcherRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rico.yaml")
+
+	class := "- name: %s\n  watermarkHigh: 75\n  watermarkLow: 25\n" +
+		"  diskSize: 8\n  maximumTotalSize: 1024\n"
+	write := func(data string) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	first := "classes:\n" + fmt.Sprintf(class, "c1")
+	write(first)
+
+	notified := 0
+	notifyErr := fmt.Errorf("Busy")
+	w := NewWatcher(path, time.Hour, func(*Config) error {
+		notified++
+		return notifyErr
+	}, nameValidator("bad"))
+	_, data, err := w.load()
+	assert.NoError(t, err)
+	w.data = data
+
+	// Classes are checked with the validators given
+	write("classes:\n" + fmt.Sprintf(class, "bad"))
+	assert.Nil(t, w.check())
+	assert.Nil(t, w.check())
+	assert.Equal(t, 0, notified)
+
+	// A configuration notify fails for is not applied or retried
+	write("classes:\n" + fmt.Sprintf(class, "c2"))
+	assert.Nil(t, w.check())
+	assert.Nil(t, w.check())
+	assert.Equal(t, 1, notified)
+	assert.Nil(t, w.check())
+	assert.Nil(t, w.check())
+	assert.Equal(t, 1, notified)
+
+	// The previous configuration is still the one applied
+	write(first)
+	assert.Nil(t, w.check())
+	assert.Nil(t, w.check())
+	assert.Equal(t, 1, notified)
+
+	notifyErr = nil
+	write("classes:\n" + fmt.Sprintf(class, "c3"))
+	assert.Nil(t, w.check())
+	c := w.check()
+	assert.NotNil(t, c)
+	assert.Equal(t, "c3", c.Classes[0].Name)
+	assert.Equal(t, 2, notified)
+}
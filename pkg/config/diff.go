@@ -0,0 +1,76 @@
+/*
+Package config provides the configuration to the Manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Diff contains the changes to the classes between two configurations
+type Diff struct {
+	// Added classes
+	Added []Class
+
+	// Removed classes
+	Removed []Class
+
+	// Modified has the new value of classes which changed
+	Modified []Class
+}
+
+// NewDiff returns the changes to the classes from old to new
+func NewDiff(old, new *Config) *Diff {
+	d := &Diff{
+		Added:    make([]Class, 0),
+		Removed:  make([]Class, 0),
+		Modified: make([]Class, 0),
+	}
+	for _, class := range new.Classes {
+		if oldClass := old.Class(class.Name); oldClass == nil {
+			d.Added = append(d.Added, class)
+		} else if !reflect.DeepEqual(*oldClass, class) {
+			d.Modified = append(d.Modified, class)
+		}
+	}
+	for _, class := range old.Classes {
+		if new.Class(class.Name) == nil {
+			d.Removed = append(d.Removed, class)
+		}
+	}
+	return d
+}
+
+// Empty returns true if no class changed
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// String returns a string representation of the diff for fmt.Printf
+func (d *Diff) String() string {
+	names := func(classes []Class) []string {
+		n := make([]string, len(classes))
+		for i, class := range classes {
+			n[i] = class.Name
+		}
+		return n
+	}
+	return fmt.Sprintf("Added:%v Removed:%v Modified:%v",
+		names(d.Added),
+		names(d.Removed),
+		names(d.Modified))
+}
@@ -0,0 +1,52 @@
+/*
+Package config provides the configuration to the Manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+)
+
+// Load reads a JSON or YAML configuration file and validates it with the
+// validators provided
+func Load(path string, validators ...ClassValidator) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read configuration %s: %v", path, err)
+	}
+
+	c, err := Parse(data, validators...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Parse decodes a JSON or YAML configuration and validates it with the
+// validators provided. Unknown fields are rejected.
+func Parse(data []byte, validators ...ClassValidator) (*Config, error) {
+	c := &Config{}
+	if err := yaml.Unmarshal(data, c, yaml.DisallowUnknownFields); err != nil {
+		return nil, fmt.Errorf("Unable to parse configuration: %v", err)
+	}
+	if err := c.Validate(validators...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
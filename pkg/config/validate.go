@@ -0,0 +1,170 @@
+/*
+Package config provides the configuration to the Manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ClassValidator checks the parts of a class which are interpreted
+// outside of this package, such as the parameters read by a cloud
+// provider or the plugins used by an allocator
+type ClassValidator interface {
+	ValidateClass(*Class) error
+}
+
+// Validate returns an error describing every invalid value in the
+// configuration. Each class is also checked by the validators provided.
+func (c *Config) Validate(validators ...ClassValidator) error {
+	errs := make([]string, 0)
+	names := make(map[string]bool)
+	for i := range c.Classes {
+		class := &c.Classes[i]
+		if err := class.Validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, v := range validators {
+			if err := v.ValidateClass(class); err != nil {
+				errs = append(errs, fmt.Sprintf("class %s: %v", class.Name, err))
+			}
+		}
+		if len(class.Name) != 0 {
+			if names[class.Name] {
+				errs = append(errs, fmt.Sprintf("class %s: defined more than once",
+					class.Name))
+			}
+			names[class.Name] = true
+		}
+	}
+
+	switch c.RemovedClassPolicy {
+	case "", RemovedClassFreeze, RemovedClassDrain:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown removedClassPolicy %s",
+			c.RemovedClassPolicy))
+	}
+
+	if c.MaxDevicesPerNode < 0 {
+		errs = append(errs, "maxDevicesPerNode cannot be negative")
+	}
+
+	if c.GarbageCollection.GracePeriodSeconds < 0 {
+		errs = append(errs, "garbageCollection.gracePeriodSeconds cannot be negative")
+	}
+	if c.GarbageCollection.MaxDeletesPerPass < 0 {
+		errs = append(errs, "garbageCollection.maxDeletesPerPass cannot be negative")
+	}
+	if c.GarbageCollection.Delete && len(c.ClusterID) == 0 {
+		errs = append(errs, "garbageCollection.delete requires a clusterId")
+	}
+	if c.GarbageCollection.Delete && c.GarbageCollection.GracePeriodSeconds == 0 {
+		errs = append(errs, "garbageCollection.delete requires a gracePeriodSeconds "+
+			"greater than zero")
+	}
+
+	if !validLabel(c.ClusterID) {
+		errs = append(errs, fmt.Sprintf("clusterId %s must be up to 63 "+
+			"lowercase letters, digits, '-' or '_'",
+			c.ClusterID))
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("Invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Validate returns an error describing every invalid value in the class
+func (c *Class) Validate() error {
+	errs := make([]string, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(len(c.Name) != 0, "name missing")
+	check(c.WatermarkHigh >= 0 && c.WatermarkHigh <= 100,
+		"watermarkHigh %d must be between 0 and 100", c.WatermarkHigh)
+	check(c.WatermarkLow >= 0 && c.WatermarkLow <= 100,
+		"watermarkLow %d must be between 0 and 100", c.WatermarkLow)
+	check(c.WatermarkLow < c.WatermarkHigh,
+		"watermarkLow %d must be less than watermarkHigh %d",
+		c.WatermarkLow,
+		c.WatermarkHigh)
+	check(c.DiskSizeGb > 0, "diskSize must be greater than zero")
+	check(c.MinimumTotalSizeGb >= 0, "minimumTotalSize cannot be negative")
+	check(c.MinimumTotalSizeGb <= c.MaximumTotalSizeGb,
+		"minimumTotalSize %d cannot be larger than maximumTotalSize %d",
+		c.MinimumTotalSizeGb,
+		c.MaximumTotalSizeGb)
+	check(c.DiskSizeGb <= c.MaximumTotalSizeGb,
+		"diskSize %d cannot be larger than maximumTotalSize %d",
+		c.DiskSizeGb,
+		c.MaximumTotalSizeGb)
+	check(c.ScaleUpCooldownSeconds >= 0, "scaleUpCooldown cannot be negative")
+	check(c.ScaleDownCooldownSeconds >= 0, "scaleDownCooldown cannot be negative")
+	check(c.WatermarkSamples >= 0, "watermarkSamples cannot be negative")
+	if c.TargetUtilization != 0 {
+		check(c.TargetUtilization > c.WatermarkLow &&
+			c.TargetUtilization < c.WatermarkHigh,
+			"targetUtilization %d must be between watermarkLow %d "+
+				"and watermarkHigh %d",
+			c.TargetUtilization,
+			c.WatermarkLow,
+			c.WatermarkHigh)
+	}
+	switch c.GrowthStrategy {
+	case "", GrowthAdd, GrowthGrow:
+	case GrowthHybrid:
+		check(c.MaximumDiskSizeGb > 0,
+			"maximumDiskSize is required by the hybrid growthStrategy")
+	default:
+		errs = append(errs, fmt.Sprintf("unknown growthStrategy %s", c.GrowthStrategy))
+	}
+	if c.MaximumDiskSizeGb != 0 {
+		check(c.MaximumDiskSizeGb >= c.DiskSizeGb,
+			"maximumDiskSize %d cannot be smaller than diskSize %d",
+			c.MaximumDiskSizeGb,
+			c.DiskSizeGb)
+	}
+	for i, p := range c.Allocation {
+		check(len(p.Name) != 0, "allocation plugin %d name missing", i)
+		check(p.Weight >= 0, "allocation plugin %s weight cannot be negative",
+			p.Name)
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("class %s: %s", c.Name, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// validLabel returns true if the value can be used as a label value on
+// every cloud
+func validLabel(value string) bool {
+	if len(value) > 63 {
+		return false
+	}
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
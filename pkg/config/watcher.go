@@ -0,0 +1,172 @@
+/*
+Package config provides the configuration to the Manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+)
+
+// Watcher reloads a configuration file when its content changes
+type Watcher struct {
+	path       string
+	interval   time.Duration
+	notify     func(*Config) error
+	validators []ClassValidator
+	lock       sync.Mutex
+	running    bool
+	quit       chan struct{}
+	wg         sync.WaitGroup
+	data       []byte
+	pending    []byte
+	rejected   []byte
+}
+
+// NewWatcher returns a watcher which checks the file at path every
+// interval. The configuration is validated with the validators given,
+// as Load does. When the file changes and the new configuration is
+// valid, notify is called with it. Invalid configurations, and those
+// notify returns an error for, are logged and the previous configuration
+// is kept until the file changes again.
+//
+// A change is only applied once the same content has been read on two
+// checks in a row, so a file read in the middle of a write is skipped.
+// A writer pausing for longer than the interval can still leave a
+// partial file behind, so writers must replace the file atomically, for
+// example by writing a temporary file and renaming it over the path.
+func NewWatcher(
+	path string,
+	interval time.Duration,
+	notify func(*Config) error,
+	validators ...ClassValidator,
+) *Watcher {
+	return &Watcher{
+		path:       path,
+		interval:   interval,
+		notify:     notify,
+		validators: validators,
+	}
+}
+
+// Start loads the current configuration and starts watching the file.
+// The configuration loaded is returned.
+func (w *Watcher) Start() (*Config, error) {
+	if w.interval <= 0 {
+		return nil, fmt.Errorf("Watch interval must be greater than zero")
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.running {
+		return nil, fmt.Errorf("Watcher is already running")
+	}
+	c, data, err := w.load()
+	if err != nil {
+		return nil, err
+	}
+	w.data = data
+	w.quit = make(chan struct{})
+	w.running = true
+
+	w.wg.Add(1)
+	go w.loop(w.quit)
+
+	return c, nil
+}
+
+// Stop stops watching the file
+func (w *Watcher) Stop() {
+	w.lock.Lock()
+	if !w.running {
+		w.lock.Unlock()
+		return
+	}
+	close(w.quit)
+	w.running = false
+	w.lock.Unlock()
+
+	w.wg.Wait()
+}
+
+func (w *Watcher) loop(quit <-chan struct{}) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		w.check()
+	}
+}
+
+// check reads the file and applies the new configuration once the same
+// new content has been read twice in a row. It returns the configuration
+// applied, or nil if the file is unchanged, still changing or rejected.
+func (w *Watcher) check() *Config {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		logrus.Errorf("Unable to read configuration %s: %v", w.path, err)
+		return nil
+	}
+	if bytes.Equal(data, w.data) || bytes.Equal(data, w.rejected) {
+		w.pending = nil
+		return nil
+	}
+	if w.pending == nil || !bytes.Equal(data, w.pending) {
+		w.pending = data
+		return nil
+	}
+	w.pending = nil
+
+	c, err := Parse(data, w.validators...)
+	if err == nil {
+		err = w.notify(c)
+	}
+	if err != nil {
+		logrus.Errorf("Ignoring new configuration in %s: %v", w.path, err)
+		w.rejected = data
+		return nil
+	}
+	w.data = data
+	w.rejected = nil
+	logrus.Infof("Configuration %s changed", w.path)
+	return c
+}
+
+func (w *Watcher) load() (*Config, []byte, error) {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read configuration %s: %v", w.path, err)
+	}
+	c, err := Parse(data, w.validators...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", w.path, err)
+	}
+	return c, data, nil
+}
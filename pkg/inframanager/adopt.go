@@ -0,0 +1,146 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+// adopt adds to the storage system the devices labeled with the cluster
+// ID which are attached to a node but missing from the topology. These
+// are left behind when the manager is restarted without a persistent
+// journal between creating a device and adding it to the storage system.
+// It runs on the first pass only, and only if the configuration has a
+// cluster ID. Returns the results and true if any device was adopted.
+func (m *Manager) adopt(t *topology.Topology) ([]*AdoptResult, bool) {
+	results := make([]*AdoptResult, 0)
+	if m.adopted || len(m.config.ClusterID) == 0 {
+		return results, false
+	}
+
+	devices, err := m.cloud.ListDevices(map[string]string{
+		cloudprovider.LabelClusterID: m.config.ClusterID,
+	})
+	if err != nil {
+		// Try again on the next pass
+		logrus.Errorf("Unable to list devices of cluster %s: %v",
+			m.config.ClusterID,
+			err)
+		return results, false
+	}
+	m.adopted = true
+
+	known, err := m.knownDevices(t)
+	if err != nil {
+		logrus.Errorf("Unable to adopt devices: %v", err)
+		return results, false
+	}
+
+	changed := false
+	for _, device := range devices {
+		if known[device.ID] || len(device.InstanceID) == 0 {
+			continue
+		}
+		node := findNode(t, device.InstanceID)
+		if node == nil {
+			continue
+		}
+
+		ar := &AdoptResult{
+			Node:   node.Metadata.ID,
+			Device: device.ID,
+			Class:  device.Labels[cloudprovider.LabelClass],
+		}
+		results = append(results, ar)
+
+		if class := m.managedClass(ar.Class); class == nil {
+			ar.Error = fmt.Errorf("Class %s is not managed", ar.Class)
+		} else {
+			logrus.Infof("class:%s Adopting device %s on node:%s",
+				class.Name,
+				device.ID,
+				node.Metadata.ID)
+			ar.Error = m.storage.DeviceAdd(node, nil, []*topology.Device{{
+				Class: class.Name,
+				Path:  device.Path,
+				Size:  device.Size,
+				Metadata: topology.DeviceMetadata{
+					ID: device.ID,
+				},
+			}})
+			if ar.Error == nil {
+				changed = true
+			}
+		}
+		if ar.Error != nil {
+			logrus.Errorf("node:%s Failed to adopt device %s: %v",
+				node.Metadata.ID,
+				device.ID,
+				ar.Error)
+		}
+	}
+	return results, changed
+}
+
+// knownDevices returns the ids of the devices in the topology or in an
+// entry of the journal
+func (m *Manager) knownDevices(t *topology.Topology) (map[string]bool, error) {
+	known, err := m.journalDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range t.Cluster.StorageNodes {
+		for _, device := range node.Devices {
+			known[device.Metadata.ID] = true
+		}
+	}
+	return known, nil
+}
+
+// journalDevices returns the ids of the devices in an entry of the
+// journal
+func (m *Manager) journalDevices() (map[string]bool, error) {
+	entries, err := m.journal.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read journal: %v", err)
+	}
+
+	devices := make(map[string]bool)
+	for _, entry := range entries {
+		for _, device := range entry.Devices {
+			devices[device.ID] = true
+		}
+		if entry.Replaced != nil {
+			devices[entry.Replaced.ID] = true
+		}
+	}
+	return devices, nil
+}
+
+// findNode returns the node with the instance id or nil if not found
+func findNode(t *topology.Topology, instanceID string) *topology.StorageNode {
+	for _, node := range t.Cluster.StorageNodes {
+		if node.Metadata.ID == instanceID {
+			return node
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libopenstorage/rico/pkg/config"
+)
+
+// classState keeps the history of a class across reconcile passes
+type classState struct {
+	// lastAction is the time of the last successful add or remove
+	lastAction time.Time
+
+	// above is the number of consecutive samples at or above the
+	// high watermark
+	above int
+
+	// below is the number of consecutive samples at or below the
+	// low watermark
+	below int
+}
+
+// sample records the utilization of the class in this pass
+func (s *classState) sample(class *config.Class, utilization int) {
+	if utilization >= class.WatermarkHigh {
+		s.above++
+	} else {
+		s.above = 0
+	}
+	if utilization <= class.WatermarkLow {
+		s.below++
+	} else {
+		s.below = 0
+	}
+}
+
+// acted records a successful action on the class
+func (s *classState) acted(now time.Time) {
+	s.lastAction = now
+	s.above = 0
+	s.below = 0
+}
+
+// deferAdd returns the reason adding storage must wait, or an empty
+// string if it can be done now
+func (s *classState) deferAdd(class *config.Class, now time.Time) string {
+	return s.deferAction(s.above, class.ScaleUpCooldownSeconds, class, now)
+}
+
+// deferRemove returns the reason removing storage must wait, or an
+// empty string if it can be done now
+func (s *classState) deferRemove(class *config.Class, now time.Time) string {
+	return s.deferAction(s.below, class.ScaleDownCooldownSeconds, class, now)
+}
+
+func (s *classState) deferAction(
+	samples int,
+	cooldownSeconds int64,
+	class *config.Class,
+	now time.Time,
+) string {
+	if samples < class.WatermarkSamples {
+		return fmt.Sprintf("%d of %d samples past the watermark",
+			samples,
+			class.WatermarkSamples)
+	}
+	return s.cooldown(cooldownSeconds, now)
+}
+
+// cooldown returns the reason the class must wait after its last action,
+// or an empty string if the cooldown has passed
+func (s *classState) cooldown(cooldownSeconds int64, now time.Time) string {
+	if !s.lastAction.IsZero() {
+		cooldown := time.Duration(cooldownSeconds) * time.Second
+		if wait := s.lastAction.Add(cooldown).Sub(now); wait > 0 {
+			return fmt.Sprintf("cooling down for another %v", wait)
+		}
+	}
+	return ""
+}
+
+// classState returns the state of the class, creating it if needed
+func (m *Manager) classState(name string) *classState {
+	s, ok := m.classes[name]
+	if !ok {
+		s = &classState{}
+		m.classes[name] = s
+	}
+	return s
+}
@@ -0,0 +1,170 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+// collectGarbage compares the devices labeled with the cluster ID in the
+// cloud against the topology. Devices in the cloud which are neither in
+// the topology nor in the journal are orphans. They are deleted, at most
+// MaxDeletesPerPass at a time, once they have been orphaned for the
+// grace period, if the configuration allows it. Devices in the topology
+// but not in the cloud, and devices whose node, size or class differ,
+// are only reported. Returns nil if there is no cluster ID.
+func (m *Manager) collectGarbage(t *topology.Topology) *GCResult {
+	if len(m.config.ClusterID) == 0 {
+		return nil
+	}
+
+	gc := &GCResult{
+		Orphans:    make([]string, 0),
+		Deleted:    make([]string, 0),
+		Unknown:    make([]string, 0),
+		Mismatches: make([]string, 0),
+		Errors:     make(map[string]error),
+	}
+
+	devices, err := m.cloud.ListDevices(map[string]string{
+		cloudprovider.LabelClusterID: m.config.ClusterID,
+	})
+	if err != nil {
+		gc.Err = fmt.Errorf("Unable to list devices of cluster %s: %v",
+			m.config.ClusterID,
+			err)
+		return gc
+	}
+	inJournal, err := m.journalDevices()
+	if err != nil {
+		gc.Err = err
+		return gc
+	}
+
+	inCloud := make(map[string]*cloudprovider.Device, len(devices))
+	for _, device := range devices {
+		inCloud[device.ID] = device
+	}
+
+	// Check every device in the topology against the cloud
+	inTopology := make(map[string]bool)
+	for _, node := range t.Cluster.StorageNodes {
+		for _, device := range node.Devices {
+			id := device.Metadata.ID
+			inTopology[id] = true
+			cd, ok := inCloud[id]
+			if !ok {
+				gc.Unknown = append(gc.Unknown, id)
+				continue
+			}
+			if inJournal[id] {
+				continue
+			}
+			if mismatch := compareDevice(node, device, cd); len(mismatch) != 0 {
+				gc.Mismatches = append(gc.Mismatches, mismatch)
+			}
+		}
+	}
+
+	// Track how long each orphan has been seen
+	now := m.now()
+	orphans := make(map[string]time.Time)
+	for _, device := range devices {
+		if inTopology[device.ID] || inJournal[device.ID] {
+			continue
+		}
+		since, ok := m.orphans[device.ID]
+		if !ok {
+			since = now
+			logrus.Warnf("Device %s on instance %s is orphaned",
+				device.ID,
+				device.InstanceID)
+		}
+		orphans[device.ID] = since
+		gc.Orphans = append(gc.Orphans, device.ID)
+	}
+	m.orphans = orphans
+	sort.Strings(gc.Orphans)
+
+	if !m.config.GarbageCollection.Delete {
+		return gc
+	}
+
+	limit := m.config.GarbageCollection.MaxDeletesPerPass
+	if limit == 0 {
+		limit = 1
+	}
+	grace := time.Duration(m.config.GarbageCollection.GracePeriodSeconds) * time.Second
+	for _, id := range gc.Orphans {
+		if len(gc.Deleted)+len(gc.Errors) >= limit {
+			break
+		}
+		if now.Sub(orphans[id]) < grace {
+			continue
+		}
+
+		device := inCloud[id]
+		logrus.Infof("Deleting orphaned device %s on instance %s",
+			id,
+			device.InstanceID)
+		err := m.cloud.DeviceDelete(device.InstanceID, id)
+		if err != nil && err != cloudprovider.ErrDeviceNotFound {
+			logrus.Errorf("Failed to delete orphaned device %s: %v", id, err)
+			gc.Errors[id] = err
+			continue
+		}
+		gc.Deleted = append(gc.Deleted, id)
+		delete(m.orphans, id)
+	}
+
+	return gc
+}
+
+// compareDevice returns a description of the differences between the
+// device in the topology and in the cloud, or an empty string if they
+// agree
+func compareDevice(
+	node *topology.StorageNode,
+	device *topology.Device,
+	cd *cloudprovider.Device,
+) string {
+	if cd.InstanceID != node.Metadata.ID {
+		return fmt.Sprintf("device:%s is on node %s but attached to instance %s",
+			cd.ID,
+			node.Metadata.ID,
+			cd.InstanceID)
+	}
+	if cd.Size != device.Size {
+		return fmt.Sprintf("device:%s has size %d but the cloud reports %d",
+			cd.ID,
+			device.Size,
+			cd.Size)
+	}
+	if class := cd.Labels[cloudprovider.LabelClass]; class != device.Class {
+		return fmt.Sprintf("device:%s has class %s but is labeled %s",
+			cd.ID,
+			device.Class,
+			class)
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/journal"
+	"github.com/libopenstorage/rico/pkg/storageprovider"
+	"github.com/libopenstorage/rico/pkg/topology"
+
+	"github.com/pborman/uuid"
+)
+
+// resizers returns the resize support of the cloud provider and the
+// storage system, or false if either does not support it
+func (m *Manager) resizers() (cloudprovider.Resizer, storageprovider.Resizer, bool) {
+	cloudResizer, ok := m.cloud.(cloudprovider.Resizer)
+	if !ok {
+		return nil, nil, false
+	}
+	storageResizer, ok := m.storage.(storageprovider.Resizer)
+	if !ok {
+		return nil, nil, false
+	}
+	return cloudResizer, storageResizer, true
+}
+
+// planGrow returns an action growing the least utilized device of the
+// class which is below its maximum size, or nil if none can be grown.
+// Only one device is grown per pass.
+func (m *Manager) planGrow(
+	t *topology.Topology,
+	class *config.Class,
+) (*PlannedAction, error) {
+	if _, _, ok := m.resizers(); !ok {
+		if class.GrowthStrategy == config.GrowthHybrid {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Cloud provider and storage system must " +
+			"support resizing to grow disks")
+	}
+
+	var (
+		node   *topology.StorageNode
+		device *topology.Device
+	)
+	for _, n := range t.Cluster.StorageNodes {
+		if !n.Schedulable() {
+			continue
+		}
+		for _, d := range n.Devices {
+			if d.Class != class.Name || d.Failed() {
+				continue
+			}
+			if class.MaximumDiskSizeGb > 0 && d.Size >= class.MaximumDiskSizeGb {
+				continue
+			}
+			if device == nil || d.Utilization < device.Utilization {
+				node, device = n, d
+			}
+		}
+	}
+	if device == nil {
+		return nil, nil
+	}
+
+	// Grow by a disk size within the limits of the device and the class
+	size := device.Size + class.DiskSizeGb
+	if class.MaximumDiskSizeGb > 0 && size > class.MaximumDiskSizeGb {
+		size = class.MaximumDiskSizeGb
+	}
+	if room := class.MaximumTotalSizeGb - t.TotalStorage(class); size-device.Size > room {
+		size = device.Size + room
+	}
+	if size <= device.Size {
+		return nil, nil
+	}
+
+	return &PlannedAction{
+		Class:      class.Name,
+		Action:     ActionGrow,
+		Node:       node,
+		Pool:       devicePool(node, device),
+		Device:     device,
+		NumDevices: 1,
+		DiskSizeGb: size,
+	}, nil
+}
+
+// growStorage resizes the cloud device and has the storage system use
+// the new size
+func (m *Manager) growStorage(
+	class *config.Class,
+	node *topology.StorageNode,
+	pool *topology.Pool,
+	device *topology.Device,
+	sizeGb int64,
+) error {
+	// The entry keeps the target size so an interrupted grow is
+	// resumed by recovery
+	entry := &journal.Entry{
+		ID:         uuid.New(),
+		Operation:  journal.OperationGrow,
+		State:      journal.StateGrowing,
+		Class:      class.Name,
+		InstanceID: node.Metadata.ID,
+		Devices: []journal.Device{{
+			ID:   device.Metadata.ID,
+			Path: device.Path,
+			Size: sizeGb,
+		}},
+		Created: time.Now(),
+	}
+	if pool != nil {
+		entry.Pool = pool.Name
+	}
+	if err := m.journal.Save(entry); err != nil {
+		return fmt.Errorf("Unable to journal grow of device %s: %v",
+			device.Metadata.ID,
+			err)
+	}
+
+	return m.grow(entry, node, pool, device)
+}
+
+// grow continues the grow recorded in the entry from its current state.
+// The entry is deleted once the storage system uses the new size, or if
+// the cloud refused to resize the device.
+func (m *Manager) grow(
+	entry *journal.Entry,
+	node *topology.StorageNode,
+	pool *topology.Pool,
+	device *topology.Device,
+) error {
+	cloudResizer, storageResizer, ok := m.resizers()
+	if !ok {
+		m.journalDelete(entry)
+		return fmt.Errorf("Cloud provider and storage system must " +
+			"support resizing to grow disks")
+	}
+	sizeGb := entry.Devices[0].Size
+
+	if entry.State == journal.StateGrowing {
+		logrus.Infof("class:%s Growing device %s/%s:%s from %dGi to %dGi",
+			entry.Class,
+			node.Metadata.ID,
+			device.Path,
+			device.Metadata.ID,
+			device.Size,
+			sizeGb)
+		_, err := cloudResizer.DeviceResize(node.Metadata.ID, device.Metadata.ID, sizeGb)
+		if err != nil {
+			m.journalDelete(entry)
+			return fmt.Errorf("Failed to grow device %s: %v", device.Metadata.ID, err)
+		}
+		entry.State = journal.StateExpanding
+		m.journalSave(entry)
+	}
+
+	// Leave the entry in the journal on failure so the next reconcile
+	// asks the storage system again
+	logrus.Infof("class:%s Notifying storage system of new size of %s on node:%s",
+		entry.Class,
+		device.Metadata.ID,
+		node.Metadata.ID)
+	if err := storageResizer.DeviceResize(node, pool, device, sizeGb); err != nil {
+		return fmt.Errorf("Storage system failed to use new size of device %s: %v",
+			device.Metadata.ID,
+			err)
+	}
+
+	m.journalDelete(entry)
+	return nil
+}
+
+// recoverGrow finishes a grow unless the device is gone or the storage
+// system already reports the new size. Returns true if the grow was
+// attempted again.
+func (m *Manager) recoverGrow(t *topology.Topology, entry *journal.Entry) (bool, error) {
+	if len(entry.Devices) == 0 {
+		return false, m.journal.Delete(entry.ID)
+	}
+	target := entry.Devices[0]
+
+	for _, node := range t.Cluster.StorageNodes {
+		if node.Metadata.ID != entry.InstanceID {
+			continue
+		}
+		for _, device := range node.Devices {
+			if device.Metadata.ID != target.ID {
+				continue
+			}
+			if device.Size >= target.Size {
+				logrus.Infof("class:%s Device %s already has %dGi, grow completed",
+					entry.Class,
+					target.ID,
+					device.Size)
+				return false, m.journal.Delete(entry.ID)
+			}
+			return true, m.grow(entry, node, devicePool(node, device), device)
+		}
+	}
+
+	logrus.Infof("class:%s Device %s no longer exists, grow abandoned",
+		entry.Class,
+		target.ID)
+	return false, m.journal.Delete(entry.ID)
+}
@@ -18,104 +18,555 @@ package inframanager
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/libopenstorage/logrus"
 	"github.com/libopenstorage/rico/pkg/allocator"
 	"github.com/libopenstorage/rico/pkg/cloudprovider"
 	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/journal"
 	"github.com/libopenstorage/rico/pkg/storageprovider"
 	"github.com/libopenstorage/rico/pkg/topology"
+
+	"github.com/pborman/uuid"
 )
 
 // Manager is an implementation of inframanager.Interface
 type Manager struct {
-	config    config.Config
-	lock      sync.Mutex
-	running   bool
-	quit      chan struct{}
-	reconcile chan struct{}
-	cloud     cloudprovider.Interface
-	storage   storageprovider.Interface
-	allocator allocator.Interface
+	config     config.Config
+	lock       sync.Mutex
+	running    bool
+	quit       chan struct{}
+	reconcile  chan struct{}
+	lastResult *Result
+	wg         sync.WaitGroup
+	passLock   sync.Mutex
+	cloud      cloudprovider.Interface
+	storage    storageprovider.Interface
+	allocator  allocator.Interface
+	journal    journal.Interface
+	journalErr error
+	classes    map[string]*classState
+	draining   map[string]config.Class
+	nodeStates map[string]topology.NodeState
+	adopted    bool
+	orphans    map[string]time.Time
+	backoff    time.Duration
+	now        func() time.Time
 }
 
-// NewManager returns a new infrastructure manager implementation
+// NewManager returns a new infrastructure manager implementation. The
+// journal is stored in the file at JournalPath when it is set in the
+// configuration, otherwise in memory. If the file cannot be loaded,
+// Recover and every reconcile pass fail until SetJournal is called.
 func NewManager(
-	config *config.Config,
+	c *config.Config,
 	cloud cloudprovider.Interface,
 	storage storageprovider.Interface,
 	allocator allocator.Interface,
 ) *Manager {
-	return &Manager{
-		config:    *config,
-		cloud:     cloud,
-		storage:   storage,
-		allocator: allocator,
+	m := &Manager{
+		config:     *c.Copy(),
+		cloud:      cloud,
+		storage:    storage,
+		allocator:  allocator,
+		journal:    journal.NewMemory(),
+		classes:    make(map[string]*classState),
+		draining:   make(map[string]config.Class),
+		nodeStates: make(map[string]topology.NodeState),
+		orphans:    make(map[string]time.Time),
+		backoff:    deleteBackoff,
+		now:        time.Now,
+	}
+	m.setAllocatorConfig(c)
+	if len(c.JournalPath) != 0 {
+		j, err := journal.NewFile(c.JournalPath)
+		if err != nil {
+			logrus.Error(err)
+			m.journalErr = err
+		} else {
+			m.journal = j
+		}
+	}
+	return m
+}
+
+// SetJournal sets the journal used to record operations in progress. It
+// must be called before the manager is started. Any operation left
+// in the journal is recovered on the next reconcile pass.
+func (m *Manager) SetJournal(j journal.Interface) {
+	m.journal = j
+	m.journalErr = nil
+}
+
+// SetConfig validates and applies a new configuration. The classes are
+// also validated by the cloud provider and the allocator if they
+// implement config.ClassValidator. It waits for any reconcile pass in
+// progress, so the configuration only changes between passes, and then
+// hands the new configuration to the cloud and storage providers and
+// the allocator. Classes no longer in the configuration are frozen or
+// drained according to its RemovedClassPolicy. Returns the changes made
+// to the classes.
+func (m *Manager) SetConfig(c *config.Config) (*config.Diff, error) {
+	if err := c.Validate(m.ClassValidators()...); err != nil {
+		return nil, err
+	}
+	newConfig := c.Copy()
+
+	m.passLock.Lock()
+	defer m.passLock.Unlock()
+
+	m.lock.Lock()
+	diff := config.NewDiff(&m.config, newConfig)
+	if newConfig.JournalPath != m.config.JournalPath {
+		logrus.Warnf("Journal path changed to %q, it will be used after a restart",
+			newConfig.JournalPath)
+	}
+	m.config = *newConfig
+	m.lock.Unlock()
+
+	for _, class := range diff.Removed {
+		delete(m.classes, class.Name)
+		if newConfig.RemovedClassPolicy == config.RemovedClassDrain {
+			logrus.Infof("class:%s Removed from configuration, draining", class.Name)
+			m.draining[class.Name] = class
+		} else {
+			logrus.Infof("class:%s Removed from configuration, frozen", class.Name)
+		}
+	}
+	for _, class := range diff.Added {
+		if _, ok := m.draining[class.Name]; ok {
+			logrus.Infof("class:%s Added back to configuration, "+
+				"no longer draining",
+				class.Name)
+			delete(m.draining, class.Name)
+		}
+	}
+
+	m.cloud.SetConfig(newConfig.Copy())
+	m.storage.SetConfig(newConfig.Copy())
+	m.setAllocatorConfig(newConfig)
+	logrus.Infof("Configuration updated: %v", diff)
+
+	return diff, nil
+}
+
+// setAllocatorConfig hands a copy of the configuration to the allocator
+// if it implements allocator.Configurable
+func (m *Manager) setAllocatorConfig(c *config.Config) {
+	if configurable, ok := m.allocator.(allocator.Configurable); ok {
+		configurable.SetConfig(c.Copy())
 	}
 }
 
-// SetConfig saves a new configuration value
-func (m *Manager) SetConfig(config *config.Config) {
-	// TODO - LOCK
-	m.config = *config
+// ClassValidators returns the cloud provider and the allocator if they
+// check the classes of a configuration. They are the validators used by
+// SetConfig, to be passed to config.Load or config.NewWatcher.
+func (m *Manager) ClassValidators() []config.ClassValidator {
+	validators := make([]config.ClassValidator, 0, 2)
+	if v, ok := m.cloud.(config.ClassValidator); ok {
+		validators = append(validators, v)
+	}
+	if v, ok := m.allocator.(config.ClassValidator); ok {
+		validators = append(validators, v)
+	}
+	return validators
 }
 
 // Config returns a copy of the current configuration
 func (m *Manager) Config() *config.Config {
-	c := m.config
-	return &c
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.config.Copy()
 }
 
-// Reconcile adds or removes storage from the system
-func (m *Manager) Reconcile() error {
-	return m.do()
+// Draining returns the names of the classes removed from the
+// configuration which still have devices being removed
+func (m *Manager) Draining() []string {
+	m.passLock.Lock()
+	defer m.passLock.Unlock()
+
+	return m.drainingNames()
 }
 
-func (m *Manager) do() error {
+func (m *Manager) drainingNames() []string {
+	names := make([]string, 0, len(m.draining))
+	for name := range m.draining {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start runs a reconcile pass every interval in the background until
+// Stop is called. A first pass is queued immediately.
+func (m *Manager) Start(interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Reconcile interval must be greater than zero")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.running {
+		return fmt.Errorf("Manager is already running")
+	}
+	m.quit = make(chan struct{})
+	m.reconcile = make(chan struct{}, 1)
+	m.reconcile <- struct{}{}
+	m.running = true
+
+	m.wg.Add(1)
+	go m.loop(interval, m.quit, m.reconcile)
+
+	return nil
+}
+
+// Stop terminates the background reconcile loop. It blocks until any
+// add or remove in progress has finished.
+func (m *Manager) Stop() {
+	m.lock.Lock()
+	if !m.running {
+		m.lock.Unlock()
+		return
+	}
+	close(m.quit)
+	m.running = false
+	m.lock.Unlock()
+
+	// Wait for the loop to exit, then for any pass started by a
+	// direct call to Reconcile()
+	m.wg.Wait()
+	m.passLock.Lock()
+	m.passLock.Unlock()
+}
+
+// Trigger requests a reconcile pass from the background loop. Requests
+// received while a pass is pending are merged into that single pass.
+func (m *Manager) Trigger() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if !m.running {
+		return
+	}
+	select {
+	case m.reconcile <- struct{}{}:
+	default:
+		// A pass is already pending
+	}
+}
+
+func (m *Manager) loop(
+	interval time.Duration,
+	quit <-chan struct{},
+	reconcile <-chan struct{},
+) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		case <-reconcile:
+		}
+
+		// Do not start a new pass if Stop() was called meanwhile
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		if _, err := m.Reconcile(); err != nil {
+			logrus.Errorf("Reconcile failed: %v", err)
+		}
+	}
+}
+
+// Reconcile adds or removes storage from the system. Each class is
+// reconciled independently and the outcome for each one is returned in
+// the result. The error summarizes any class which failed.
+func (m *Manager) Reconcile() (*Result, error) {
+	m.passLock.Lock()
+	defer m.passLock.Unlock()
+
+	result, err := m.do()
+	if result != nil {
+		m.lock.Lock()
+		m.lastResult = result
+		m.lock.Unlock()
+	}
+	return result, err
+}
+
+// LastResult returns the result of the last reconcile pass, or nil if
+// no pass has completed
+func (m *Manager) LastResult() *Result {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.lastResult
+}
+
+func (m *Manager) do() (*Result, error) {
+	result := &Result{
+		Start:   time.Now(),
+		Classes: make([]*ClassResult, 0, len(m.config.Classes)),
+	}
+
+	// Operations cannot be recorded without the journal
+	if m.journalErr != nil {
+		return nil, m.journalErr
+	}
 
 	// Get topology from the storage system
 	t, err := m.storage.GetTopology()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Verify the topology was filled in correctly
 	if err := t.Verify(); err != nil {
-		return err
+		return nil, err
+	}
+
+	// Finish any operation which was interrupted. Entries recovered
+	// before an error may have changed the storage system.
+	changed, err := m.recover(t)
+	if err != nil {
+		logrus.Errorf("Unable to recover all journal entries: %v", err)
+	}
+	if changed {
+		if t, err = m.storage.GetTopology(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Add the devices of this cluster left out of the storage system
+	adopted, changed := m.adopt(t)
+	result.Adopted = adopted
+	if changed {
+		if t, err = m.storage.GetTopology(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Find and delete devices no longer used by the storage system
+	result.GC = m.collectGarbage(t)
+	if result.GC != nil && len(result.GC.Deleted) != 0 {
+		if t, err = m.storage.GetTopology(); err != nil {
+			return nil, err
+		}
 	}
+	t = m.applyNodeStates(t)
 
-	// Check the utilization of each class
+	// Empty the nodes being decommissioned before placing new storage
+	nodes, decommissioned := m.decommission(t)
+	result.Nodes = nodes
+
+	// Replace failed devices
+	replacements, replaced := m.replaceFailed(t)
+	result.Replacements = replacements
+	if decommissioned || replaced {
+		if t, err = m.storage.GetTopology(); err != nil {
+			return nil, err
+		}
+		t = m.applyNodeStates(t)
+	}
+	t = m.applyDeviceLimits(t)
+
+	// Check the utilization of each class. A failure in one class
+	// must not stop the others from being reconciled.
 	for _, class := range m.config.Classes {
-		utilization := t.Utilization(&class)
-		totalStorage := t.TotalStorage(&class)
-
-		// Do not add any more storage if at the max
-		if (utilization >= class.WatermarkHigh &&
-			totalStorage+class.DiskSizeGb <= class.MaximumTotalSizeGb) ||
-			totalStorage < class.MinimumTotalSizeGb {
-			m.addStorage(t, &class)
-		} else if (utilization <= class.WatermarkLow &&
-			totalStorage-class.DiskSizeGb >= class.MinimumTotalSizeGb) ||
-			totalStorage > class.MaximumTotalSizeGb {
-			return m.removeStorage(t, &class)
-		} else {
-			logrus.Infof("class:%s No change", class.Name)
+		class := class
+		cr := m.reconcileClass(t, &class)
+		if cr.Outcome == OutcomeFailed || cr.Outcome == OutcomePartial {
+			logrus.Errorf("class:%s Failed to %s storage: %v",
+				class.Name,
+				cr.Action,
+				cr.Error)
 		}
+		result.Classes = append(result.Classes, cr)
 	}
-	return nil
+
+	// Remove storage from classes no longer in the configuration
+	for _, name := range m.drainingNames() {
+		class := m.draining[name]
+		cr := m.drainClass(t, &class)
+		if cr.Outcome == OutcomeFailed {
+			logrus.Errorf("class:%s Failed to drain storage: %v",
+				class.Name,
+				cr.Error)
+		}
+		result.Classes = append(result.Classes, cr)
+	}
+	result.End = time.Now()
+
+	return result, result.Err()
 }
 
-func (m *Manager) addStorage(t *topology.Topology, class *config.Class) error {
-	// Pick a node
-	node, err := m.allocator.DetermineNodeToAddStorage(t, class)
+func (m *Manager) reconcileClass(
+	t *topology.Topology,
+	class *config.Class,
+) *ClassResult {
+	cr := &ClassResult{
+		Class:   class.Name,
+		Action:  ActionNone,
+		Outcome: OutcomeNoChange,
+	}
+
+	state := m.classState(class.Name)
+	actions, err := m.planClass(t, class, state)
+	action := actions[0]
+	cr.Action = action.Action
+	if err == nil && len(action.Deferred) != 0 {
+		logrus.Infof("class:%s Deferring %s: %s",
+			class.Name,
+			action.Action,
+			action.Deferred)
+		cr.Outcome = OutcomeDeferred
+		return cr
+	} else if err == nil {
+		switch action.Action {
+		case ActionAdd:
+			// Each disk set is added on its own. Sets already added
+			// are kept if a later one fails. A set refused because the
+			// node is at its device limit is moved to the next node.
+			added := 0
+			full := make(map[string]bool)
+			for i := 0; i < len(actions); i++ {
+				a := actions[i]
+				rollback, addErr := m.addStorage(class, a.Node, a.Pool, a.NumDevices)
+				if rollback != nil {
+					cr.Rollbacks = append(cr.Rollbacks, rollback)
+				}
+				if _, ok := addErr.(*deviceLimitError); ok {
+					full[a.Node.Metadata.ID] = true
+					if next := m.nextNode(t, class, full); next != nil {
+						logrus.Infof("class:%s Node %s is full, using node %s",
+							class.Name,
+							a.Node.Metadata.ID,
+							next.Node.Metadata.ID)
+						actions[i] = next
+						i--
+						continue
+					}
+				}
+				if addErr != nil {
+					err = addErr
+					break
+				}
+				added++
+			}
+			if err != nil && added != 0 {
+				cr.Outcome = OutcomePartial
+				cr.Error = fmt.Errorf("Added %d of %d disk sets: %v",
+					added,
+					len(actions),
+					err)
+				state.acted(m.now())
+				return cr
+			}
+		case ActionGrow:
+			if action.Device == nil {
+				logrus.Infof("class:%s No device found to grow", class.Name)
+				cr.Outcome = OutcomeSkipped
+				return cr
+			}
+			err = m.growStorage(class,
+				action.Node,
+				action.Pool,
+				action.Device,
+				action.DiskSizeGb)
+		case ActionRemove:
+			if action.Device == nil {
+				logrus.Infof("class:%s No device found to remove", class.Name)
+				cr.Outcome = OutcomeSkipped
+				return cr
+			}
+			_, err = m.removeStorage(class, action.Node, action.Pool, action.Device)
+		default:
+			logrus.Infof("class:%s No change", class.Name)
+			return cr
+		}
+	}
+
 	if err != nil {
-		return err
+		cr.Outcome = OutcomeFailed
+		cr.Error = err
+	} else {
+		cr.Outcome = OutcomeSuccess
+		state.acted(m.now())
+	}
+	return cr
+}
+
+// drainClass removes one device of a class which is no longer in the
+// configuration. The class stops draining once it has no devices left.
+func (m *Manager) drainClass(
+	t *topology.Topology,
+	class *config.Class,
+) *ClassResult {
+	cr := &ClassResult{
+		Class:    class.Name,
+		Action:   ActionNone,
+		Outcome:  OutcomeNoChange,
+		Draining: true,
 	}
 
-	// Determine how many disks we need to add to this node
-	// TODO: NumDisks to be added
-	numDisks, p := node.SetSizeForClass(class)
+	node, pool, device := m.allocator.DetermineStorageToRemove(t, class)
+	if device == nil {
+		logrus.Infof("class:%s Drained", class.Name)
+		delete(m.draining, class.Name)
+		return cr
+	}
+
+	cr.Action = ActionRemove
+	if _, err := m.removeStorage(class, node, pool, device); err != nil {
+		cr.Outcome = OutcomeFailed
+		cr.Error = err
+	} else {
+		cr.Outcome = OutcomeSuccess
+	}
+	return cr
+}
+
+// addStorage creates numDisks devices on the node and adds them to the
+// storage system. It is all-or-nothing: on failure the devices already
+// created are detached and deleted and the rollback is returned.
+func (m *Manager) addStorage(
+	class *config.Class,
+	node *topology.StorageNode,
+	p *topology.Pool,
+	numDisks int,
+) (*Rollback, error) {
+	// The entry lists each device as it is created so recovery can
+	// delete the devices of an interrupted add
+	entry := &journal.Entry{
+		ID:         uuid.New(),
+		Operation:  journal.OperationAdd,
+		State:      journal.StateCreating,
+		Class:      class.Name,
+		InstanceID: node.Metadata.ID,
+		Devices:    make([]journal.Device, 0, numDisks),
+		Created:    time.Now(),
+	}
+	if p != nil {
+		entry.Pool = p.Name
+	}
+	if err := m.journal.Save(entry); err != nil {
+		return nil, fmt.Errorf("Unable to journal add to node %s: %v",
+			node.Metadata.ID,
+			err)
+	}
 
 	// Add disks to the node
 	devices := make([]*topology.Device, 0)
@@ -127,10 +578,14 @@ func (m *Manager) addStorage(t *topology.Topology, class *config.Class) error {
 			node.Metadata.ID)
 		// Create and attach a disk to the node
 		device, err := m.cloud.DeviceCreate(node.Metadata.ID, class)
-		if err != nil {
-			return fmt.Errorf("Failed to add disk to node %s: %v",
-				node.Metadata.ID,
-				err)
+		if err == cloudprovider.ErrDeviceLimit {
+			return m.rollbackAdd(class, node, devices, entry),
+				&deviceLimitError{instanceID: node.Metadata.ID}
+		} else if err != nil {
+			return m.rollbackAdd(class, node, devices, entry),
+				fmt.Errorf("Failed to add disk to node %s: %v",
+					node.Metadata.ID,
+					err)
 		}
 		devices = append(devices, &topology.Device{
 			Class: class.Name,
@@ -139,52 +594,137 @@ func (m *Manager) addStorage(t *topology.Topology, class *config.Class) error {
 			Metadata: topology.DeviceMetadata{
 				ID: device.ID,
 			}})
+		entry.Devices = append(entry.Devices, journal.Device{
+			ID:   device.ID,
+			Path: device.Path,
+			Size: device.Size,
+		})
+		if err := m.journal.Save(entry); err != nil {
+			return m.rollbackAdd(class, node, devices, entry),
+				fmt.Errorf("Unable to journal device %s: %v", device.ID, err)
+		}
 	}
 
 	// Notify storage system device has been added
-	// TODO: Clean up on error
 	logrus.Infof("class:%s Notifying storage system addition of %d to node:%s",
 		class.Name,
 		numDisks,
 		node.Metadata.ID)
-	return m.storage.DeviceAdd(node, p, devices)
-}
+	entry.State = journal.StateAdding
+	if err := m.journal.Save(entry); err != nil {
+		return m.rollbackAdd(class, node, devices, entry),
+			fmt.Errorf("Unable to journal add to node %s: %v",
+				node.Metadata.ID,
+				err)
+	}
+	if err := m.storage.DeviceAdd(node, p, devices); err != nil {
+		return m.rollbackAdd(class, node, devices, entry),
+			fmt.Errorf("Storage system failed to add devices to node %s: %v",
+				node.Metadata.ID,
+				err)
+	}
 
-func (m *Manager) removeStorage(t *topology.Topology, class *config.Class) error {
-	// Pick a device
-	node, pool, device := m.allocator.DetermineStorageToRemove(t, class)
+	m.journalDelete(entry)
+	return nil, nil
+}
 
-	// Nothing to do
-	if device == nil {
-		logrus.Infof("class:%s No device found to remove", class.Name)
+// rollbackAdd detaches and deletes devices created by a failed add.
+// Devices which could not be deleted are left in the journal entry to
+// be retried by the next reconcile. Returns nil if there was nothing to
+// roll back.
+func (m *Manager) rollbackAdd(
+	class *config.Class,
+	node *topology.StorageNode,
+	devices []*topology.Device,
+	entry *journal.Entry,
+) *Rollback {
+	if len(devices) == 0 {
+		m.journalDelete(entry)
 		return nil
 	}
 
+	rollback := &Rollback{
+		InstanceID: node.Metadata.ID,
+		Deleted:    make([]string, 0, len(devices)),
+		Errors:     make(map[string]error),
+	}
+	for _, d := range devices {
+		logrus.Infof("class:%s Rolling back device %s/%s:%s",
+			class.Name,
+			node.Metadata.ID,
+			d.Path,
+			d.Metadata.ID)
+		err := m.cloud.DeviceDelete(node.Metadata.ID, d.Metadata.ID)
+		if err != nil && err != cloudprovider.ErrDeviceNotFound {
+			logrus.Errorf("class:%s Failed to roll back device %s on node %s: %v",
+				class.Name,
+				d.Metadata.ID,
+				node.Metadata.ID,
+				err)
+			rollback.Errors[d.Metadata.ID] = err
+			continue
+		}
+		rollback.Deleted = append(rollback.Deleted, d.Metadata.ID)
+		entry.RemoveDevice(d.Metadata.ID)
+	}
+
+	if len(entry.Devices) == 0 {
+		m.journalDelete(entry)
+	} else {
+		m.journalSave(entry)
+	}
+
+	return rollback
+}
+
+// removeStorage removes the device from the storage system, then
+// detaches and deletes the devices the storage system released. Returns
+// the devices released.
+func (m *Manager) removeStorage(
+	class *config.Class,
+	node *topology.StorageNode,
+	pool *topology.Pool,
+	device *topology.Device,
+) ([]*topology.Device, error) {
 	// Remove drive from the storage system
 	logrus.Infof("class:%s Removing device %s/%s:%s from storage",
 		class.Name,
 		node.Metadata.ID,
 		device.Path,
 		device.Metadata.ID)
+	entry := &journal.Entry{
+		ID:         uuid.New(),
+		Operation:  journal.OperationRemove,
+		State:      journal.StateRemoving,
+		Class:      class.Name,
+		InstanceID: node.Metadata.ID,
+		Devices:    []journal.Device{journalDevice(device)},
+		Created:    time.Now(),
+	}
+	if pool != nil {
+		entry.Pool = pool.Name
+	}
+	if err := m.journal.Save(entry); err != nil {
+		return nil, fmt.Errorf("Unable to journal removal of device %s: %v",
+			device.Metadata.ID,
+			err)
+	}
 	cloudDevices, err := m.storage.DeviceRemove(node, pool, device)
 	if err != nil {
-		return err
+		m.journalDelete(entry)
+		return nil, err
 	}
 
-	// Delete cloud drive
-	var deleteErr error
-	for _, d := range cloudDevices {
-		logrus.Infof("class:%s Detaching/deleting device %s/%s:%s from storage",
-			class.Name,
-			node.Metadata.ID,
-			d.Path,
-			d.Metadata.ID)
-		err = m.cloud.DeviceDelete(node.Metadata.ID, device.Metadata.ID)
-		if err != nil {
-			deleteErr = err
-			logrus.Errorf("Failed to remove cloud device %s: %v",
-				d.Metadata.ID, err)
-		}
+	// The storage system no longer uses these devices. They may be in
+	// other pools than the device selected.
+	entry.State = journal.StateDeleting
+	entry.Devices = make([]journal.Device, len(cloudDevices))
+	for i, d := range cloudDevices {
+		entry.Devices[i] = journalDevice(d)
 	}
-	return deleteErr
+	m.journalSave(entry)
+
+	// Delete each cloud drive. Those which fail are left in the journal
+	// so the next reconcile can finish.
+	return cloudDevices, m.deleteJournalDevices(entry, deleteAttempts)
 }
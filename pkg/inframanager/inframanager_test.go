@@ -17,16 +17,27 @@ limitations under the License.
 package inframanager
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/libopenstorage/rico/pkg/allocator/framework"
 	"github.com/libopenstorage/rico/pkg/allocator/roundrobin"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
 	"github.com/libopenstorage/rico/pkg/cloudprovider/aws"
+	fakecloud "github.com/libopenstorage/rico/pkg/cloudprovider/fake"
+	"github.com/libopenstorage/rico/pkg/cloudprovider/mock"
 	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/journal"
 	"github.com/libopenstorage/rico/pkg/storageprovider/fake"
+	storagemock "github.com/libopenstorage/rico/pkg/storageprovider/mock"
 	"github.com/libopenstorage/rico/pkg/topology"
 )
 
@@ -80,7 +91,7 @@ func TestWithAws(t *testing.T) {
 	assert.Equal(t, 0, topology.NumDevices())
 	loops := int(class.MinimumTotalSizeGb/class.DiskSizeGb) * 3
 	for i := 0; i < loops; i++ {
-		err := im.do()
+		_, err := im.do()
 		assert.NoError(t, err)
 	}
 	topology, _ = storage.GetTopology()
@@ -90,7 +101,7 @@ func TestWithAws(t *testing.T) {
 	// Start with a high watermark
 	for i := 0; i < (2 * numInstances); i++ {
 		storage.SetUtilization(&class, 80)
-		err := im.do()
+		_, err := im.do()
 		assert.NoError(t, err)
 		topology, _ = storage.GetTopology()
 		assert.Equal(t, numDevices+i+1, topology.NumDevices())
@@ -102,7 +113,7 @@ func TestWithAws(t *testing.T) {
 	// no changes to the devices
 	for i := 0; i < loops; i++ {
 		storage.SetUtilization(&class, 50)
-		err := im.do()
+		_, err := im.do()
 		assert.NoError(t, err)
 
 		topology, _ = storage.GetTopology()
@@ -112,7 +123,7 @@ func TestWithAws(t *testing.T) {
 	// Low watermark tests
 	for i := 0; i < numDevices; i++ {
 		storage.SetUtilization(&class, 10)
-		err := im.do()
+		_, err := im.do()
 		assert.NoError(t, err)
 
 		topology, _ := storage.GetTopology()
@@ -129,7 +140,7 @@ func TestWithAws(t *testing.T) {
 		topology, _ = storage.GetTopology()
 		numDevices = topology.NumDevices()
 
-		err := im.do()
+		_, err := im.do()
 		assert.NoError(t, err)
 
 		topology, _ = storage.GetTopology()
@@ -140,3 +151,1337 @@ func TestWithAws(t *testing.T) {
 		}
 	}
 }
+
+func newFakeManager(numNodes int, classes ...config.Class) (*Manager, *fake.Fake) {
+	nodes := make([]*topology.StorageNode, numNodes)
+	for i := range nodes {
+		nodes[i] = &topology.StorageNode{
+			Metadata: topology.InstanceMetadata{
+				ID: fmt.Sprintf("node%d", i),
+			},
+		}
+	}
+	storage := fake.New(&topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: nodes,
+		},
+	})
+	im := NewManager(&config.Config{Classes: classes},
+		fakecloud.New(),
+		storage,
+		roundrobin.New())
+	return im, storage
+}
+
+func TestStartStop(t *testing.T) {
+	class := config.Class{
+		Name:               "gp2",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 32,
+	}
+	im, storage := newFakeManager(2, class)
+
+	// Stop without Start does nothing
+	im.Stop()
+
+	err := im.Start(0)
+	assert.Error(t, err)
+
+	err = im.Start(5 * time.Millisecond)
+	assert.NoError(t, err)
+	err = im.Start(5 * time.Millisecond)
+	assert.Error(t, err)
+
+	// Give the loop time to reach the minimum
+	time.Sleep(200 * time.Millisecond)
+	im.Trigger()
+	im.Stop()
+	im.Stop()
+
+	topology, _ := storage.GetTopology()
+	assert.Equal(t, int(class.MinimumTotalSizeGb/class.DiskSizeGb), topology.NumDevices())
+
+	// Trigger after Stop does nothing
+	im.Trigger()
+
+	// Can be restarted
+	err = im.Start(time.Hour)
+	assert.NoError(t, err)
+	im.Stop()
+}
+
+func TestReconcileClassIsolation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	bad := config.Class{
+		Name:               "bad",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 8,
+	}
+	low := config.Class{
+		Name:               "low",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 0,
+	}
+	good := config.Class{
+		Name:               "good",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 8,
+	}
+	im, storage := newFakeManager(1, bad, low, good)
+	storage.Topology.Cluster.StorageNodes[0].Devices = []*topology.Device{
+		&topology.Device{
+			Class:       "low",
+			Size:        8,
+			Utilization: 1,
+			Metadata: topology.DeviceMetadata{
+				ID: "lowdevice",
+			},
+		},
+	}
+
+	cloud := mock.NewMockInterface(ctrl)
+	cloud.EXPECT().
+		DeviceCreate("node0", &bad).
+		Return(nil, fmt.Errorf("no capacity"))
+	cloud.EXPECT().
+		DeviceDelete("node0", "lowdevice").
+		Return(nil)
+	cloud.EXPECT().
+		DeviceCreate("node0", &good).
+		Return(&cloudprovider.Device{ID: "gooddevice", Size: 8}, nil)
+	im.cloud = cloud
+
+	result, err := im.Reconcile()
+	assert.Error(t, err)
+	assert.NotNil(t, result)
+	assert.Len(t, result.Classes, 3)
+	assert.Equal(t, result, im.LastResult())
+
+	cr := result.Class("bad")
+	assert.Equal(t, ActionAdd, cr.Action)
+	assert.Equal(t, OutcomeFailed, cr.Outcome)
+	assert.Error(t, cr.Error)
+
+	cr = result.Class("low")
+	assert.Equal(t, ActionRemove, cr.Action)
+	assert.Equal(t, OutcomeSuccess, cr.Outcome)
+	assert.NoError(t, cr.Error)
+
+	cr = result.Class("good")
+	assert.Equal(t, ActionAdd, cr.Action)
+	assert.Equal(t, OutcomeSuccess, cr.Outcome)
+	assert.NoError(t, cr.Error)
+
+	assert.Len(t, result.Failed(), 1)
+	topology, _ := storage.GetTopology()
+	assert.Equal(t, 1, topology.NumDevices())
+	assert.Equal(t, "gooddevice", topology.Cluster.StorageNodes[0].Devices[0].Metadata.ID)
+}
+
+func TestPlan(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	add := config.Class{
+		Name:               "add",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 8,
+	}
+	remove := config.Class{
+		Name:               "remove",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+	}
+	nochange := config.Class{
+		Name:               "nochange",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+	}
+	im, storage := newFakeManager(1, add, remove, nochange)
+	node := storage.Topology.Cluster.StorageNodes[0]
+	node.Devices = []*topology.Device{
+		&topology.Device{
+			Class:       "remove",
+			Size:        8,
+			Utilization: 1,
+			Metadata: topology.DeviceMetadata{
+				ID: "removedevice",
+			},
+		},
+		&topology.Device{
+			Class:       "nochange",
+			Size:        8,
+			Utilization: 50,
+			Metadata: topology.DeviceMetadata{
+				ID: "nochangedevice",
+			},
+		},
+	}
+
+	// Any call to the cloud will fail the test
+	im.cloud = mock.NewMockInterface(ctrl)
+
+	actions, err := im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 2)
+
+	assert.Equal(t, ActionAdd, actions[0].Action)
+	assert.Equal(t, "add", actions[0].Class)
+	assert.Equal(t, node, actions[0].Node)
+	assert.Equal(t, 1, actions[0].NumDevices)
+	assert.Equal(t, "create 1 add disks of 8Gi on node node0", actions[0].String())
+
+	assert.Equal(t, ActionRemove, actions[1].Action)
+	assert.Equal(t, "remove", actions[1].Class)
+	assert.Equal(t, "removedevice", actions[1].Device.Metadata.ID)
+	assert.Equal(t, "remove remove device removedevice from node node0", actions[1].String())
+
+	// Nothing changed
+	topology, _ := storage.GetTopology()
+	assert.Equal(t, 2, topology.NumDevices())
+}
+
+func TestPlanInvalidSetSize(t *testing.T) {
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		TargetUtilization:  50,
+	}
+	im, storage := newFakeManager(1, class)
+	storage.Topology.Cluster.StorageNodes[0].Pools = map[string]*topology.Pool{
+		"c1": &topology.Pool{Name: "p1", SetSize: -1, Class: "c1"},
+	}
+	storage.SetUtilization(&class, 90)
+
+	// Rejected by the topology
+	_, err := im.Plan()
+	assert.Error(t, err)
+
+	// A set adding nothing never reaches the target
+	_, err = im.planAdd(storage.Topology, &class, 90)
+	assert.Error(t, err)
+}
+
+func TestAddStorageRollback(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 8,
+	}
+	node := &topology.StorageNode{
+		Metadata: topology.InstanceMetadata{
+			ID: "node0",
+		},
+		Pools: map[string]*topology.Pool{
+			"c1": &topology.Pool{
+				Name:    "p1",
+				SetSize: 3,
+				Class:   "c1",
+			},
+		},
+	}
+	topo := &topology.Topology{
+		Cluster: topology.StorageCluster{
+			StorageNodes: []*topology.StorageNode{node},
+		},
+	}
+	cloud := mock.NewMockInterface(ctrl)
+	storage := storagemock.NewMockInterface(ctrl)
+	im := NewManager(&config.Config{Classes: []config.Class{class}},
+		cloud,
+		storage,
+		roundrobin.New())
+
+	// Third DeviceCreate fails
+	storage.EXPECT().GetTopology().Return(topo, nil)
+	gomock.InOrder(
+		cloud.EXPECT().DeviceCreate("node0", &class).
+			Return(&cloudprovider.Device{ID: "d1", Size: 8}, nil),
+		cloud.EXPECT().DeviceCreate("node0", &class).
+			Return(&cloudprovider.Device{ID: "d2", Size: 8}, nil),
+		cloud.EXPECT().DeviceCreate("node0", &class).
+			Return(nil, fmt.Errorf("attach failed")),
+	)
+	cloud.EXPECT().DeviceDelete("node0", "d1").Return(nil)
+	cloud.EXPECT().DeviceDelete("node0", "d2").Return(fmt.Errorf("busy"))
+
+	result, err := im.Reconcile()
+	assert.Error(t, err)
+	cr := result.Class("c1")
+	assert.Equal(t, OutcomeFailed, cr.Outcome)
+	assert.Len(t, cr.Rollbacks, 1)
+	assert.False(t, cr.Rollbacks[0].Succeeded())
+	assert.Equal(t, "node0", cr.Rollbacks[0].InstanceID)
+	assert.Equal(t, []string{"d1"}, cr.Rollbacks[0].Deleted)
+	assert.Error(t, cr.Rollbacks[0].Errors["d2"])
+
+	// Storage system fails to add the devices. The device which could
+	// not be rolled back is retried from the journal first.
+	storage.EXPECT().GetTopology().Return(topo, nil).Times(2)
+	cloud.EXPECT().DeviceDelete("node0", "d2").Return(nil)
+	cloud.EXPECT().DeviceCreate("node0", &class).
+		Return(&cloudprovider.Device{ID: "d3", Size: 8}, nil).
+		Times(3)
+	storage.EXPECT().DeviceAdd(node, node.Pools["c1"], gomock.Any()).
+		Return(fmt.Errorf("pool offline"))
+	cloud.EXPECT().DeviceDelete("node0", "d3").Return(nil).Times(3)
+
+	result, err = im.Reconcile()
+	assert.Error(t, err)
+	cr = result.Class("c1")
+	assert.Equal(t, OutcomeFailed, cr.Outcome)
+	assert.Len(t, cr.Rollbacks, 1)
+	assert.True(t, cr.Rollbacks[0].Succeeded())
+	assert.Len(t, cr.Rollbacks[0].Deleted, 3)
+
+	// Nothing to roll back when the first device fails
+	storage.EXPECT().GetTopology().Return(topo, nil)
+	cloud.EXPECT().DeviceCreate("node0", &class).
+		Return(nil, fmt.Errorf("quota"))
+
+	result, err = im.Reconcile()
+	assert.Error(t, err)
+	assert.Empty(t, result.Class("c1").Rollbacks)
+}
+
+func TestRecoverFromJournal(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	dir, err := ioutil.TempDir("", "rico")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.json")
+
+	// Operations left by a process which died
+	j, err := journal.NewFile(path)
+	assert.NoError(t, err)
+	for _, e := range []*journal.Entry{
+		{
+			ID:         "added",
+			Operation:  journal.OperationAdd,
+			State:      journal.StateAdding,
+			InstanceID: "node0",
+			Devices:    []journal.Device{{ID: "a1"}},
+		},
+		{
+			ID:         "creating",
+			Operation:  journal.OperationAdd,
+			State:      journal.StateCreating,
+			InstanceID: "node0",
+			Devices:    []journal.Device{{ID: "a2"}},
+		},
+		{
+			ID:         "notremoved",
+			Operation:  journal.OperationRemove,
+			State:      journal.StateRemoving,
+			InstanceID: "node0",
+			Devices:    []journal.Device{{ID: "r1"}},
+		},
+		{
+			ID:         "removed",
+			Operation:  journal.OperationRemove,
+			State:      journal.StateRemoving,
+			InstanceID: "node0",
+			Devices:    []journal.Device{{ID: "r2"}},
+		},
+		{
+			ID:         "deleting",
+			Operation:  journal.OperationRemove,
+			State:      journal.StateDeleting,
+			InstanceID: "node0",
+			Devices:    []journal.Device{{ID: "r3"}, {ID: "r4"}},
+		},
+	} {
+		assert.NoError(t, j.Save(e))
+	}
+
+	// Restart with the journal file in the configuration
+	im, storage := newFakeManager(1)
+	im = NewManager(&config.Config{JournalPath: path},
+		im.cloud,
+		storage,
+		im.allocator)
+	storage.Topology.Cluster.StorageNodes[0].Devices = []*topology.Device{
+		&topology.Device{
+			Class:    "c1",
+			Metadata: topology.DeviceMetadata{ID: "a1"},
+		},
+		&topology.Device{
+			Class:    "c1",
+			Metadata: topology.DeviceMetadata{ID: "r1"},
+		},
+	}
+	cloud := mock.NewMockInterface(ctrl)
+	cloud.EXPECT().DeviceDelete("node0", "a2").Return(nil)
+	cloud.EXPECT().DeviceDelete("node0", "r2").Return(nil)
+	cloud.EXPECT().DeviceDelete("node0", "r3").Return(cloudprovider.ErrDeviceNotFound)
+	cloud.EXPECT().DeviceDelete("node0", "r4").Return(fmt.Errorf("timeout"))
+	im.cloud = cloud
+
+	err = im.Recover()
+	assert.Error(t, err)
+	entries, err := im.journal.Entries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "deleting", entries[0].ID)
+	assert.Equal(t, []journal.Device{{ID: "r4"}}, entries[0].Devices)
+
+	// Finished on the next try
+	cloud.EXPECT().DeviceDelete("node0", "r4").Return(nil)
+	err = im.Recover()
+	assert.NoError(t, err)
+	entries, _ = im.journal.Entries()
+	assert.Len(t, entries, 0)
+
+	// Still in use by the storage system
+	assert.Equal(t, 2, storage.Topology.NumDevices())
+}
+
+func TestJournalPathInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rico")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+
+	// Nothing is changed without the journal
+	im, storage := newFakeManager(1)
+	im = NewManager(&config.Config{JournalPath: path},
+		im.cloud,
+		storage,
+		im.allocator)
+	assert.Error(t, im.Recover())
+	_, err = im.Reconcile()
+	assert.Error(t, err)
+
+	im.SetJournal(journal.NewMemory())
+	assert.NoError(t, im.Recover())
+}
+
+func TestCooldownAndHysteresis(t *testing.T) {
+	class := config.Class{
+		Name:                     "c1",
+		WatermarkHigh:            75,
+		WatermarkLow:             25,
+		DiskSizeGb:               8,
+		MaximumTotalSizeGb:       1024,
+		MinimumTotalSizeGb:       8,
+		ScaleUpCooldownSeconds:   60,
+		ScaleDownCooldownSeconds: 600,
+		WatermarkSamples:         3,
+	}
+	im, storage := newFakeManager(1, class)
+	now := time.Unix(1000, 0)
+	im.now = func() time.Time { return now }
+	numDevices := func() int {
+		topology, _ := storage.GetTopology()
+		return topology.NumDevices()
+	}
+
+	// Below the minimum size is not subject to cooldown or samples
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, OutcomeSuccess, result.Class("c1").Outcome)
+	assert.Equal(t, 1, numDevices())
+
+	// Needs three samples above the watermark
+	storage.SetUtilization(&class, 80)
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Hour)
+		result, err = im.Reconcile()
+		assert.NoError(t, err)
+		assert.Equal(t, ActionAdd, result.Class("c1").Action)
+		assert.Equal(t, OutcomeDeferred, result.Class("c1").Outcome)
+		assert.Equal(t, 1, numDevices())
+	}
+
+	// A sample under the watermark starts the count again
+	storage.SetUtilization(&class, 50)
+	_, err = im.Reconcile()
+	assert.NoError(t, err)
+	storage.SetUtilization(&class, 80)
+	for i := 0; i < 2; i++ {
+		result, err = im.Reconcile()
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeDeferred, result.Class("c1").Outcome)
+	}
+
+	// Plan shows the action but does not count as a sample
+	actions, err := im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 1)
+	assert.Empty(t, actions[0].Deferred)
+
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, OutcomeSuccess, result.Class("c1").Outcome)
+	assert.Equal(t, 2, numDevices())
+
+	// Samples keep coming, but the cooldown holds the next add
+	storage.SetUtilization(&class, 80)
+	for i := 0; i < 3; i++ {
+		now = now.Add(10 * time.Second)
+		result, err = im.Reconcile()
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeDeferred, result.Class("c1").Outcome)
+	}
+	actions, err = im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 1)
+	assert.Contains(t, actions[0].Deferred, "cooling down")
+	now = now.Add(30 * time.Second)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, OutcomeSuccess, result.Class("c1").Outcome)
+	assert.Equal(t, 3, numDevices())
+
+	// Scale down cooldown is measured from the last add
+	storage.SetUtilization(&class, 10)
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Minute)
+		result, err = im.Reconcile()
+		assert.NoError(t, err)
+		assert.Equal(t, ActionRemove, result.Class("c1").Action)
+		assert.Equal(t, OutcomeDeferred, result.Class("c1").Outcome)
+	}
+	now = now.Add(6 * time.Minute)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, OutcomeSuccess, result.Class("c1").Outcome)
+	assert.Equal(t, 2, numDevices())
+}
+
+func TestMultiStepScaleUp(t *testing.T) {
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		TargetUtilization:  50,
+	}
+	im, storage := newFakeManager(3, class)
+	for i, node := range storage.Topology.Cluster.StorageNodes {
+		node.Devices = []*topology.Device{
+			&topology.Device{
+				Class: "c1",
+				Size:  8,
+				Metadata: topology.DeviceMetadata{
+					ID: fmt.Sprintf("d%d", i),
+				},
+			},
+		}
+	}
+	storage.SetUtilization(&class, 90)
+
+	// 90% of 24Gi needs 44Gi to be at 50%, which is three more disks
+	actions, err := im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 3)
+	nodes := make(map[string]bool)
+	for _, action := range actions {
+		assert.Equal(t, ActionAdd, action.Action)
+		assert.Equal(t, 1, action.NumDevices)
+		nodes[action.Node.Metadata.ID] = true
+	}
+	assert.Len(t, nodes, 3)
+	assert.Equal(t, 3, storage.Topology.NumDevices())
+
+	// Limited by the maximum size
+	im.config.Classes[0].MaximumTotalSizeGb = 40
+	actions, err = im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 2)
+
+	// Without a target only one set is added
+	im.config.Classes[0].TargetUtilization = 0
+	actions, err = im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 1)
+
+	im.config.Classes[0].TargetUtilization = 50
+	im.config.Classes[0].MaximumTotalSizeGb = 1024
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, OutcomeSuccess, result.Class("c1").Outcome)
+	assert.Equal(t, 6, storage.Topology.NumDevices())
+	for _, node := range storage.Topology.Cluster.StorageNodes {
+		assert.Len(t, node.Devices, 2)
+	}
+}
+
+func TestPartialScaleUp(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		TargetUtilization:  50,
+	}
+	im, storage := newFakeManager(3, class)
+	for i, node := range storage.Topology.Cluster.StorageNodes {
+		node.Devices = []*topology.Device{
+			&topology.Device{
+				Class: "c1",
+				Size:  8,
+				Metadata: topology.DeviceMetadata{
+					ID: fmt.Sprintf("d%d", i),
+				},
+			},
+		}
+	}
+	storage.SetUtilization(&class, 90)
+
+	// The third of three sets fails
+	cloud := mock.NewMockInterface(ctrl)
+	gomock.InOrder(
+		cloud.EXPECT().DeviceCreate(gomock.Any(), gomock.Any()).
+			Return(&cloudprovider.Device{ID: "a", Size: 8}, nil),
+		cloud.EXPECT().DeviceCreate(gomock.Any(), gomock.Any()).
+			Return(&cloudprovider.Device{ID: "b", Size: 8}, nil),
+		cloud.EXPECT().DeviceCreate(gomock.Any(), gomock.Any()).
+			Return(nil, fmt.Errorf("quota")),
+	)
+	im.cloud = cloud
+
+	result, err := im.Reconcile()
+	assert.Error(t, err)
+	cr := result.Class("c1")
+	assert.Equal(t, OutcomePartial, cr.Outcome)
+	assert.Contains(t, cr.Error.Error(), "Added 2 of 3 disk sets")
+	assert.Empty(t, cr.Rollbacks)
+	assert.Equal(t, 5, storage.Topology.NumDevices())
+}
+
+func TestSetConfigValidatesPlugins(t *testing.T) {
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+	}
+	im, _ := newFakeManager(1, class)
+	im.allocator = framework.New(framework.NewDefaultRegistry(), nil)
+
+	class.Allocation = []config.Plugin{{Name: "zone-sprad"}}
+	_, err := im.SetConfig(&config.Config{Classes: []config.Class{class}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "zone-sprad")
+
+	class.Allocation = []config.Plugin{{Name: framework.ZoneSpreadName}}
+	_, err = im.SetConfig(&config.Config{Classes: []config.Class{class}})
+	assert.NoError(t, err)
+}
+
+func TestSetConfig(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	c1 := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+	}
+	c2 := c1
+	c2.Name = "c2"
+	c3 := c1
+	c3.Name = "c3"
+
+	im, storage := newFakeManager(1, c1, c2, c3)
+	node := storage.Topology.Cluster.StorageNodes[0]
+	for i := 0; i < 2; i++ {
+		for _, class := range []string{"c1", "c2"} {
+			node.Devices = append(node.Devices, &topology.Device{
+				Class:       class,
+				Size:        8,
+				Utilization: 50,
+				Metadata: topology.DeviceMetadata{
+					ID: fmt.Sprintf("%s-%d", class, i),
+				},
+			})
+		}
+	}
+	cloud := mock.NewMockInterface(ctrl)
+	im.cloud = cloud
+
+	// Invalid configurations are rejected
+	bad := c1
+	bad.WatermarkLow = 90
+	_, err := im.SetConfig(&config.Config{Classes: []config.Class{bad}})
+	assert.Error(t, err)
+	assert.Len(t, im.Config().Classes, 3)
+
+	// Remove c1 and c2 and drain them
+	modified := c3
+	modified.WatermarkHigh = 80
+	newConfig := &config.Config{
+		Classes:            []config.Class{modified},
+		RemovedClassPolicy: config.RemovedClassDrain,
+	}
+	cloud.EXPECT().SetConfig(newConfig)
+	diff, err := im.SetConfig(newConfig)
+	assert.NoError(t, err)
+	assert.Len(t, diff.Removed, 2)
+	assert.Len(t, diff.Modified, 1)
+	assert.Len(t, diff.Added, 0)
+	assert.Equal(t, []string{"c1", "c2"}, im.Draining())
+
+	// Changes to the config provided do not affect the manager
+	newConfig.Classes[0].WatermarkHigh = 90
+	assert.Equal(t, 80, im.Config().Classes[0].WatermarkHigh)
+
+	// Adding c2 back stops it from draining and c1 is frozen
+	cloud.EXPECT().SetConfig(gomock.Any())
+	_, err = im.SetConfig(&config.Config{
+		Classes:            []config.Class{c2, c3},
+		RemovedClassPolicy: config.RemovedClassFreeze,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c1"}, im.Draining())
+
+	// c1 is drained one device per pass
+	cloud.EXPECT().DeviceDelete("node0", gomock.Any()).Return(nil).Times(2)
+	for i := 0; i < 2; i++ {
+		actions, err := im.Plan()
+		assert.NoError(t, err)
+		assert.Len(t, actions, 1)
+		assert.Equal(t, "c1", actions[0].Class)
+
+		result, err := im.Reconcile()
+		assert.NoError(t, err)
+		cr := result.Class("c1")
+		assert.True(t, cr.Draining)
+		assert.Equal(t, ActionRemove, cr.Action)
+		assert.Equal(t, OutcomeSuccess, cr.Outcome)
+	}
+	_, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, im.Draining(), 0)
+
+	topology, _ := storage.GetTopology()
+	assert.Len(t, topology.Cluster.StorageNodes[0].DevicesForClass(&c1), 0)
+	assert.Len(t, topology.Cluster.StorageNodes[0].DevicesForClass(&c2), 2)
+}
+
+func TestDeviceLimits(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 8,
+	}
+	im, storage := newFakeManager(2, class)
+
+	// The cloud refuses node0, which the allocator picks first
+	cloud := mock.NewMockInterface(ctrl)
+	gomock.InOrder(
+		cloud.EXPECT().
+			DeviceCreate("node0", gomock.Any()).
+			Return(nil, cloudprovider.ErrDeviceLimit),
+		cloud.EXPECT().
+			DeviceCreate("node1", gomock.Any()).
+			Return(&cloudprovider.Device{ID: "d1", Size: 8}, nil),
+	)
+	im.cloud = cloud
+
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, OutcomeSuccess, result.Class("c1").Outcome)
+	assert.Len(t, storage.Topology.Cluster.StorageNodes[0].Devices, 0)
+	assert.Len(t, storage.Topology.Cluster.StorageNodes[1].Devices, 1)
+
+	// All nodes full
+	cloud.EXPECT().
+		DeviceCreate(gomock.Any(), gomock.Any()).
+		Return(nil, cloudprovider.ErrDeviceLimit).
+		Times(2)
+	storage.Topology.Cluster.StorageNodes[1].Devices = nil
+	result, err = im.Reconcile()
+	assert.Error(t, err)
+	assert.Equal(t, OutcomeFailed, result.Class("c1").Outcome)
+
+	// Limits from the configuration and the cloud are applied before
+	// planning so full nodes are never picked
+	fc := fakecloud.New()
+	fc.SetMaxDevices("node1", 1)
+	im.cloud = fc
+	im.config.MaxDevicesPerNode = 2
+	storage.Topology.Cluster.StorageNodes[0].Devices = []*topology.Device{
+		{Class: "c1", Size: 8, Metadata: topology.DeviceMetadata{ID: "a"}},
+		{Class: "c1", Size: 8, Metadata: topology.DeviceMetadata{ID: "b"}},
+	}
+	storage.Topology.Cluster.StorageNodes[1].Devices = []*topology.Device{
+		{Class: "c1", Size: 8, Metadata: topology.DeviceMetadata{ID: "c"}},
+	}
+	storage.SetUtilization(&class, 90)
+	actions, err := im.Plan()
+	assert.Error(t, err)
+	assert.Len(t, actions, 0)
+
+	fc.SetMaxDevices("node1", 0)
+	actions, err = im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, "node1", actions[0].Node.Metadata.ID)
+}
+
+func TestNodeStates(t *testing.T) {
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 16,
+	}
+	im, storage := newFakeManager(3, class)
+	nodes := storage.Topology.Cluster.StorageNodes
+	nodes[0].Devices = []*topology.Device{
+		{Class: "c1", Size: 8, Utilization: 50, Metadata: topology.DeviceMetadata{ID: "a"}},
+		{Class: "other", Size: 8, Metadata: topology.DeviceMetadata{ID: "b"}},
+	}
+	nodes[1].Devices = []*topology.Device{
+		{Class: "c1", Size: 8, Utilization: 50, Metadata: topology.DeviceMetadata{ID: "c"}},
+	}
+
+	assert.Error(t, im.SetNodeState("node0", "unknown"))
+	assert.NoError(t, im.SetNodeState("node0", topology.NodeStateDecommissioning))
+	assert.NoError(t, im.SetNodeState("node2", topology.NodeStateCordoned))
+
+	// The plan removes every device of node0
+	actions, err := im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 2)
+	for _, action := range actions {
+		assert.Equal(t, ActionRemove, action.Action)
+		assert.Equal(t, "node0", action.Node.Metadata.ID)
+	}
+
+	// Removing device a would take c1 below its minimum, so capacity
+	// is added first on node1 since node2 is cordoned
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, result.Nodes, 1)
+	assert.Equal(t, "node0", result.Nodes[0].Node)
+	assert.Empty(t, result.Nodes[0].Removed)
+	assert.Equal(t, 2, result.Nodes[0].Remaining)
+	assert.Len(t, nodes[0].Devices, 2)
+	assert.Len(t, nodes[1].Devices, 2)
+	assert.Len(t, nodes[2].Devices, 0)
+
+	// One device is removed per pass
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, result.Nodes[0].Removed)
+	assert.Equal(t, 1, result.Nodes[0].Remaining)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, result.Nodes[0].Removed)
+	assert.Equal(t, 0, result.Nodes[0].Remaining)
+	assert.Len(t, nodes[0].Devices, 0)
+	assert.Len(t, nodes[1].Devices, 2)
+	assert.Len(t, nodes[2].Devices, 0)
+
+	// Nodes in maintenance are not touched when scaling down
+	storage.SetUtilization(&class, 10)
+	im.config.Classes[0].MinimumTotalSizeGb = 0
+	assert.NoError(t, im.SetNodeState("node0", ""))
+	assert.NoError(t, im.SetNodeState("node1", topology.NodeStateMaintenance))
+	assert.Len(t, im.NodeStates(), 2)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, result.Nodes, 0)
+	assert.Equal(t, OutcomeSkipped, result.Class("c1").Outcome)
+	assert.Len(t, nodes[1].Devices, 2)
+}
+
+func TestDecommissionCooldown(t *testing.T) {
+	class := config.Class{
+		Name:                     "c1",
+		WatermarkHigh:            75,
+		WatermarkLow:             25,
+		DiskSizeGb:               8,
+		MaximumTotalSizeGb:       1024,
+		ScaleDownCooldownSeconds: 60,
+	}
+	im, storage := newFakeManager(2, class)
+	now := time.Now()
+	im.now = func() time.Time { return now }
+	nodes := storage.Topology.Cluster.StorageNodes
+	nodes[0].Devices = []*topology.Device{
+		{Class: "c1", Size: 8, Utilization: 50, Metadata: topology.DeviceMetadata{ID: "a"}},
+		{Class: "c1", Size: 8, Utilization: 50, Metadata: topology.DeviceMetadata{ID: "b"}},
+	}
+	nodes[1].Devices = []*topology.Device{
+		{Class: "c1", Size: 8, Utilization: 50, Metadata: topology.DeviceMetadata{ID: "c"}},
+	}
+	assert.NoError(t, im.SetNodeState("node0", topology.NodeStateDecommissioning))
+
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, result.Nodes[0].Removed)
+
+	// The next removal waits for the cooldown of the class
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Empty(t, result.Nodes[0].Removed)
+	assert.Equal(t, 1, result.Nodes[0].Remaining)
+	assert.Contains(t, result.Nodes[0].Deferred, "cooling down")
+
+	now = now.Add(time.Minute)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, result.Nodes[0].Removed)
+	assert.Len(t, nodes[0].Devices, 0)
+}
+
+func TestReplaceFailedDevices(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+	}
+	im, storage := newFakeManager(3, class)
+	nodes := storage.Topology.Cluster.StorageNodes
+	nodes[0].Devices = []*topology.Device{
+		{
+			Class:       "c1",
+			Size:        8,
+			Utilization: 50,
+			Health:      topology.DeviceFailed,
+			Metadata:    topology.DeviceMetadata{ID: "failed"},
+		},
+		{
+			Class:       "c1",
+			Size:        8,
+			Utilization: 50,
+			Health:      topology.DeviceDegraded,
+			Metadata:    topology.DeviceMetadata{ID: "degraded"},
+		},
+	}
+	nodes[1].State = topology.NodeStateMaintenance
+	nodes[1].Devices = []*topology.Device{
+		{
+			Class:       "c1",
+			Size:        8,
+			Utilization: 50,
+			Health:      topology.DeviceFailed,
+			Metadata:    topology.DeviceMetadata{ID: "maintenance"},
+		},
+	}
+	nodes[2].State = topology.NodeStateCordoned
+	nodes[2].Devices = []*topology.Device{
+		{
+			Class:       "c1",
+			Size:        8,
+			Utilization: 50,
+			Health:      topology.DeviceFailed,
+			Metadata:    topology.DeviceMetadata{ID: "cordoned"},
+		},
+	}
+
+	actions, err := im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, ActionReplace, actions[0].Action)
+	assert.Equal(t, "failed", actions[0].Device.Metadata.ID)
+
+	cloud := mock.NewMockInterface(ctrl)
+	gomock.InOrder(
+		cloud.EXPECT().
+			DeviceCreate("node0", gomock.Any()).
+			Return(&cloudprovider.Device{ID: "new", Size: 8}, nil),
+		cloud.EXPECT().DeviceDelete("node0", "failed").Return(nil),
+	)
+	im.cloud = cloud
+
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, result.Replacements, 1)
+	assert.Equal(t, "failed", result.Replacements[0].Device)
+	assert.Equal(t, "new", result.Replacements[0].Replacement)
+	assert.Equal(t, "new", nodes[0].Devices[0].Metadata.ID)
+	assert.False(t, nodes[0].Devices[0].Failed())
+	assert.Equal(t, "maintenance", nodes[1].Devices[0].Metadata.ID)
+	assert.Equal(t, "cordoned", nodes[2].Devices[0].Metadata.ID)
+	entries, _ := im.journal.Entries()
+	assert.Len(t, entries, 0)
+
+	// The replacement is deleted if the storage system cannot use it
+	nodes[0].Devices[0].Health = topology.DeviceFailed
+	s := storagemock.NewMockInterface(ctrl)
+	s.EXPECT().GetTopology().Return(storage.Topology, nil)
+	im.storage = s
+	result, err = im.Reconcile()
+	assert.Error(t, err)
+	assert.Error(t, result.Replacements[0].Error)
+
+	// Recover a replace interrupted after the storage system rebuilt
+	// onto the replacement
+	im.storage = storage
+	assert.NoError(t, im.journal.Save(&journal.Entry{
+		ID:         "replacing",
+		Operation:  journal.OperationReplace,
+		State:      journal.StateReplacing,
+		Class:      "c1",
+		InstanceID: "node0",
+		Devices:    []journal.Device{{ID: "new"}},
+		Replaced:   &journal.Device{ID: "old"},
+	}))
+	cloud.EXPECT().DeviceDelete("node0", "old").Return(nil)
+	assert.NoError(t, im.Recover())
+	entries, _ = im.journal.Entries()
+	assert.Len(t, entries, 0)
+}
+
+func TestGrowthStrategies(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MaximumDiskSizeGb:  16,
+		GrowthStrategy:     config.GrowthGrow,
+	}
+	im, storage := newFakeManager(1, class)
+	node := storage.Topology.Cluster.StorageNodes[0]
+	node.Devices = []*topology.Device{
+		{Class: "c1", Size: 8, Utilization: 90, Metadata: topology.DeviceMetadata{ID: "d1"}},
+	}
+
+	// The device is grown instead of adding a new one
+	actions, err := im.Plan()
+	assert.NoError(t, err)
+	assert.Len(t, actions, 1)
+	assert.Equal(t, ActionGrow, actions[0].Action)
+	assert.Equal(t, int64(16), actions[0].DiskSizeGb)
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, ActionGrow, result.Class("c1").Action)
+	assert.Equal(t, OutcomeSuccess, result.Class("c1").Outcome)
+	assert.Len(t, node.Devices, 1)
+	assert.Equal(t, int64(16), node.Devices[0].Size)
+	assert.Equal(t, 45, node.Devices[0].Utilization)
+
+	// At its maximum size the device cannot grow any more
+	storage.SetUtilization(&class, 90)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, ActionGrow, result.Class("c1").Action)
+	assert.Equal(t, OutcomeSkipped, result.Class("c1").Outcome)
+
+	// Hybrid adds a disk once all of them are at their maximum size
+	im.config.Classes[0].GrowthStrategy = config.GrowthHybrid
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, ActionAdd, result.Class("c1").Action)
+	assert.Len(t, node.Devices, 2)
+
+	// Without resize support only hybrid classes get storage
+	storage.SetUtilization(&class, 90)
+	cloud := mock.NewMockInterface(ctrl)
+	cloud.EXPECT().
+		DeviceCreate("node0", gomock.Any()).
+		Return(&cloudprovider.Device{ID: "d3", Size: 8}, nil)
+	im.cloud = cloud
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, ActionAdd, result.Class("c1").Action)
+	assert.Len(t, node.Devices, 3)
+
+	storage.SetUtilization(&class, 90)
+	im.config.Classes[0].GrowthStrategy = config.GrowthGrow
+	_, err = im.Reconcile()
+	assert.Error(t, err)
+
+	// Recover a grow interrupted after the cloud resized the device
+	im.cloud = fakecloud.New()
+	assert.NoError(t, im.journal.Save(&journal.Entry{
+		ID:         "expanding",
+		Operation:  journal.OperationGrow,
+		State:      journal.StateExpanding,
+		Class:      "c1",
+		InstanceID: "node0",
+		Devices:    []journal.Device{{ID: "d3", Size: 12}},
+	}))
+	assert.NoError(t, im.Recover())
+	entries, _ := im.journal.Entries()
+	assert.Len(t, entries, 0)
+	assert.Equal(t, int64(12), node.Devices[2].Size)
+}
+
+func TestAdoptDevices(t *testing.T) {
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+		MinimumTotalSizeGb: 16,
+	}
+	im, storage := newFakeManager(2, class)
+	nodes := storage.Topology.Cluster.StorageNodes
+	nodes[0].Devices = []*topology.Device{
+		{
+			Class:       "c1",
+			Size:        8,
+			Utilization: 50,
+			Metadata:    topology.DeviceMetadata{ID: "known"},
+		},
+	}
+
+	owned := func(id, instanceID, class string) *cloudprovider.Device {
+		return &cloudprovider.Device{
+			ID:         id,
+			Size:       8,
+			InstanceID: instanceID,
+			Labels: cloudprovider.DeviceLabels("test",
+				&config.Class{Name: class},
+				instanceID,
+				time.Now()),
+		}
+	}
+	fc := fakecloud.New()
+	fc.AddDevice(owned("known", "node0", "c1"))
+	fc.AddDevice(owned("lost", "node1", "c1"))
+	fc.AddDevice(owned("unmanaged", "node1", "other"))
+	fc.AddDevice(owned("detached", "", "c1"))
+	fc.AddDevice(owned("gone", "node9", "c1"))
+	fc.AddDevice(&cloudprovider.Device{ID: "foreign", Size: 8, InstanceID: "node1"})
+	im.cloud = fc
+
+	// Nothing is adopted without a cluster ID
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, result.Adopted, 0)
+
+	config := im.Config()
+	config.ClusterID = "test"
+	_, err = im.SetConfig(config)
+	assert.NoError(t, err)
+
+	result, err = im.Reconcile()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "1 of 2 devices not adopted")
+	assert.Len(t, result.Adopted, 2)
+	assert.Equal(t, "lost", result.Adopted[0].Device)
+	assert.NoError(t, result.Adopted[0].Error)
+	assert.Equal(t, "unmanaged", result.Adopted[1].Device)
+	assert.Error(t, result.Adopted[1].Error)
+	assert.Len(t, nodes[1].Devices, 1)
+	assert.Equal(t, "lost", nodes[1].Devices[0].Metadata.ID)
+	assert.Equal(t, "c1", nodes[1].Devices[0].Class)
+
+	// Adoption only happens once
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, result.Adopted, 0)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+	}
+	im, storage := newFakeManager(2, class)
+	nodes := storage.Topology.Cluster.StorageNodes
+	for _, id := range []string{"known", "resized", "legacy"} {
+		nodes[0].Devices = append(nodes[0].Devices, &topology.Device{
+			Class:       "c1",
+			Size:        8,
+			Utilization: 50,
+			Metadata:    topology.DeviceMetadata{ID: id},
+		})
+	}
+
+	owned := func(id, instanceID string, size int64) *cloudprovider.Device {
+		return &cloudprovider.Device{
+			ID:         id,
+			Size:       size,
+			InstanceID: instanceID,
+			Labels: cloudprovider.DeviceLabels("test",
+				&class,
+				instanceID,
+				time.Now()),
+		}
+	}
+	fc := fakecloud.New()
+	fc.AddDevice(owned("known", "node0", 8))
+	fc.AddDevice(owned("resized", "node0", 16))
+	fc.AddDevice(owned("orphan1", "", 8))
+	fc.AddDevice(owned("orphan2", "node9", 8))
+	im.cloud = fc
+	im.adopted = true
+
+	now := time.Now()
+	im.now = func() time.Time { return now }
+
+	// Without a cluster ID nothing is checked
+	result, err := im.Reconcile()
+	assert.NoError(t, err)
+	assert.Nil(t, result.GC)
+
+	// Orphans are only reported by default
+	c := im.Config()
+	c.ClusterID = "test"
+	_, err = im.SetConfig(c)
+	assert.NoError(t, err)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orphan1", "orphan2"}, result.GC.Orphans)
+	assert.Empty(t, result.GC.Deleted)
+	assert.Equal(t, []string{"legacy"}, result.GC.Unknown)
+	assert.Len(t, result.GC.Mismatches, 1)
+	assert.Contains(t, result.GC.Mismatches[0], "resized")
+
+	// Orphans are deleted one at a time after the grace period
+	c.GarbageCollection = config.GarbageCollection{
+		Delete:             true,
+		GracePeriodSeconds: 3600,
+	}
+	_, err = im.SetConfig(c)
+	assert.NoError(t, err)
+	now = now.Add(30 * time.Minute)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Empty(t, result.GC.Deleted)
+
+	now = now.Add(30 * time.Minute)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orphan1"}, result.GC.Deleted)
+
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orphan2"}, result.GC.Deleted)
+
+	devices, err := fc.ListDevices(nil)
+	assert.NoError(t, err)
+	assert.Len(t, devices, 2)
+	result, err = im.Reconcile()
+	assert.NoError(t, err)
+	assert.Empty(t, result.GC.Orphans)
+}
+
+func TestRemoveMultipleDevices(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	class := config.Class{
+		Name:               "c1",
+		WatermarkHigh:      75,
+		WatermarkLow:       25,
+		DiskSizeGb:         8,
+		MaximumTotalSizeGb: 1024,
+	}
+	im, _ := newFakeManager(1, class)
+	im.backoff = 0
+	node := &topology.StorageNode{
+		Metadata: topology.InstanceMetadata{ID: "node0"},
+	}
+	pool := &topology.Pool{Name: "p1"}
+	selected := &topology.Device{
+		Class:    "c1",
+		Pool:     "p1",
+		Metadata: topology.DeviceMetadata{ID: "d1"},
+	}
+	released := []*topology.Device{
+		selected,
+		{Class: "c1", Pool: "p1", Metadata: topology.DeviceMetadata{ID: "d2"}},
+		{Class: "c1", Pool: "p2", Metadata: topology.DeviceMetadata{ID: "d3"}},
+		{Class: "c1", Pool: "p2", Metadata: topology.DeviceMetadata{ID: "d4"}},
+	}
+
+	storage := storagemock.NewMockInterface(ctrl)
+	storage.EXPECT().DeviceRemove(node, pool, selected).Return(released, nil)
+	im.storage = storage
+
+	// Each device is deleted once, and the failed one is retried
+	cloud := mock.NewMockInterface(ctrl)
+	cloud.EXPECT().DeviceDelete("node0", "d1").Return(nil)
+	gomock.InOrder(
+		cloud.EXPECT().DeviceDelete("node0", "d2").Return(fmt.Errorf("busy")),
+		cloud.EXPECT().DeviceDelete("node0", "d2").Return(nil),
+	)
+	cloud.EXPECT().DeviceDelete("node0", "d3").Return(fmt.Errorf("busy")).Times(deleteAttempts)
+	cloud.EXPECT().DeviceDelete("node0", "d4").Return(cloudprovider.ErrDeviceNotFound)
+	im.cloud = cloud
+
+	devices, err := im.removeStorage(&class, node, pool, selected)
+	assert.Equal(t, released, devices)
+	assert.Error(t, err)
+	deleteErr, ok := err.(*DeleteError)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"d1", "d2", "d4"}, deleteErr.Deleted)
+	assert.Len(t, deleteErr.Errors, 1)
+	assert.Contains(t, err.Error(), "1 of 4 devices")
+
+	// The device left is deleted by the next pass
+	entries, err := im.journal.Entries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, []journal.Device{{ID: "d3"}}, entries[0].Devices)
+
+	cloud.EXPECT().DeviceDelete("node0", "d3").Return(nil)
+	changed, err := im.recoverRemove(&topology.Topology{}, entries[0])
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	entries, err = im.journal.Entries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
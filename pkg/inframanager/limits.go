@@ -0,0 +1,118 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+// deviceLimitError is returned by addStorage when the cloud refused to
+// attach any more devices to the node
+type deviceLimitError struct {
+	instanceID string
+}
+
+func (e *deviceLimitError) Error() string {
+	return fmt.Sprintf("Failed to add disk to node %s: %v",
+		e.instanceID,
+		cloudprovider.ErrDeviceLimit)
+}
+
+// applyDeviceLimits sets the device limit of each node to the lowest of
+// the limits from the storage system, the configuration and the cloud
+// provider. The topology is copied if any limit needs to be set.
+func (m *Manager) applyDeviceLimits(t *topology.Topology) *topology.Topology {
+	limiter, _ := m.cloud.(cloudprovider.DeviceLimiter)
+	if limiter == nil && m.config.MaxDevicesPerNode == 0 {
+		return t
+	}
+
+	t = t.Copy()
+	for _, n := range t.Cluster.StorageNodes {
+		n.MaxDevices = lowerLimit(n.MaxDevices, m.config.MaxDevicesPerNode)
+		if limiter == nil {
+			continue
+		}
+		max, err := limiter.MaxDevices(n.Metadata.ID)
+		if err != nil {
+			logrus.Warnf("node:%s Unable to get device limit: %v",
+				n.Metadata.ID,
+				err)
+			continue
+		}
+		n.MaxDevices = lowerLimit(n.MaxDevices, max)
+	}
+	return t
+}
+
+// lowerLimit returns the lowest of two limits where zero means no limit
+func lowerLimit(a, b int) int {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// nextNode returns an action adding a disk set for the class to the node
+// the allocator picks once the full nodes are removed from the topology,
+// or nil if there is none
+func (m *Manager) nextNode(
+	t *topology.Topology,
+	class *config.Class,
+	full map[string]bool,
+) *PlannedAction {
+	candidates := t.Copy()
+	nodes := make([]*topology.StorageNode, 0, len(candidates.Cluster.StorageNodes))
+	for _, n := range candidates.Cluster.StorageNodes {
+		if !full[n.Metadata.ID] {
+			nodes = append(nodes, n)
+		}
+	}
+	candidates.Cluster.StorageNodes = nodes
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	node, err := m.allocator.DetermineNodeToAddStorage(candidates, class)
+	if err != nil {
+		logrus.Warnf("class:%s No other node to add storage to: %v",
+			class.Name,
+			err)
+		return nil
+	}
+
+	// Return the node from the topology provided, not the copy
+	for _, n := range t.Cluster.StorageNodes {
+		if n.Metadata.ID == node.Metadata.ID {
+			numDisks, p := n.SetSizeForClass(class)
+			return &PlannedAction{
+				Class:      class.Name,
+				Action:     ActionAdd,
+				Node:       n,
+				Pool:       p,
+				NumDevices: numDisks,
+				DiskSizeGb: class.DiskSizeGb,
+			}
+		}
+	}
+	return nil
+}
@@ -16,8 +16,32 @@ limitations under the License.
 */
 package inframanager
 
+import (
+	"time"
+
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
 // Interface is the interface to an infrastructure manager implementation
 type Interface interface {
-	// Reconcile checks the system and takes action if any is needed
-	Reconcile() error
+	// Reconcile checks the system and takes action if any is needed.
+	// The result contains the action and outcome for each class.
+	Reconcile() (*Result, error)
+
+	// Plan returns the actions Reconcile would take without taking them
+	Plan() ([]*PlannedAction, error)
+
+	// Start reconciles the system periodically in the background
+	Start(interval time.Duration) error
+
+	// Stop terminates the background reconcile loop and waits for
+	// any action in progress to complete
+	Stop()
+
+	// Trigger requests a reconcile pass as soon as possible
+	Trigger()
+
+	// SetNodeState overrides the state of a node reported by the
+	// storage system. An empty state removes the override.
+	SetNodeState(instanceID string, state topology.NodeState) error
 }
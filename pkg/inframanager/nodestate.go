@@ -0,0 +1,253 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+// SetNodeState overrides the state of a node reported by the storage
+// system. An empty state removes the override.
+func (m *Manager) SetNodeState(instanceID string, state topology.NodeState) error {
+	switch state {
+	case "", topology.NodeStateReady, topology.NodeStateCordoned,
+		topology.NodeStateMaintenance, topology.NodeStateDecommissioning:
+	default:
+		return fmt.Errorf("Unknown node state %s", state)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if state == "" {
+		delete(m.nodeStates, instanceID)
+	} else {
+		m.nodeStates[instanceID] = state
+	}
+	logrus.Infof("node:%s State set to %s", instanceID, state)
+	return nil
+}
+
+// NodeStates returns the node states set with SetNodeState
+func (m *Manager) NodeStates() map[string]topology.NodeState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	states := make(map[string]topology.NodeState, len(m.nodeStates))
+	for id, state := range m.nodeStates {
+		states[id] = state
+	}
+	return states
+}
+
+// applyNodeStates returns a copy of the topology with the states set
+// by the operator, or the topology itself if there are none
+func (m *Manager) applyNodeStates(t *topology.Topology) *topology.Topology {
+	states := m.NodeStates()
+	if len(states) == 0 {
+		return t
+	}
+
+	t = t.Copy()
+	for _, n := range t.Cluster.StorageNodes {
+		if state, ok := states[n.Metadata.ID]; ok {
+			n.State = state
+		}
+	}
+	return t
+}
+
+// decommission removes the devices from the nodes being decommissioned,
+// one removal per node and pass. Removals follow the scale down cooldown
+// of the device class. A removal which would take a class below its
+// minimum size adds a disk set on another node first, and the device is
+// removed on a later pass. A node stops at the first failure to be
+// retried on the next pass. Returns true if the storage system changed.
+func (m *Manager) decommission(t *topology.Topology) ([]*NodeResult, bool) {
+	results := make([]*NodeResult, 0)
+	changed := false
+
+	// Storage removed from each class in this pass
+	lost := make(map[string]int64)
+	for _, node := range t.Cluster.StorageNodes {
+		if node.State != topology.NodeStateDecommissioning {
+			continue
+		}
+
+		nr := &NodeResult{
+			Node:      node.Metadata.ID,
+			Removed:   make([]string, 0),
+			Remaining: len(node.Devices),
+		}
+		results = append(results, nr)
+		if len(node.Devices) == 0 {
+			logrus.Infof("node:%s Decommissioned", node.Metadata.ID)
+			continue
+		}
+
+		// removeStorage changes the devices of the node
+		devices := make([]*topology.Device, len(node.Devices))
+		copy(devices, node.Devices)
+		for _, device := range devices {
+			class := m.deviceClass(device)
+			state := m.classState(class.Name)
+			if reason := state.cooldown(class.ScaleDownCooldownSeconds, m.now()); len(reason) != 0 {
+				if len(nr.Deferred) == 0 {
+					nr.Deferred = reason
+				}
+				continue
+			}
+
+			if m.belowMinimum(t, device, lost[class.Name]) {
+				logrus.Infof("node:%s Adding storage to class %s before removing device %s",
+					node.Metadata.ID,
+					class.Name,
+					device.Metadata.ID)
+				added, err := m.addReplacementStorage(t, class)
+				if added {
+					changed = true
+					state.acted(m.now())
+				}
+				if err != nil {
+					nr.Error = fmt.Errorf("Unable to add storage to replace device %s: %v",
+						device.Metadata.ID,
+						err)
+					logrus.Errorf("node:%s Failed to decommission: %v",
+						node.Metadata.ID,
+						nr.Error)
+				}
+				break
+			}
+
+			// A pool may release more than the device requested
+			released, err := m.removeStorage(class,
+				node,
+				devicePool(node, device),
+				device)
+			for _, d := range released {
+				nr.Removed = append(nr.Removed, d.Metadata.ID)
+				lost[d.Class] += d.Size
+			}
+			nr.Remaining = len(devices) - len(released)
+			if len(released) != 0 {
+				changed = true
+				state.acted(m.now())
+			}
+			if err != nil {
+				nr.Error = fmt.Errorf("Unable to remove device %s: %v",
+					device.Metadata.ID,
+					err)
+				logrus.Errorf("node:%s Failed to decommission: %v",
+					node.Metadata.ID,
+					nr.Error)
+			}
+			break
+		}
+		if len(nr.Removed) == 0 && nr.Error == nil && len(nr.Deferred) != 0 {
+			logrus.Infof("node:%s Deferring decommission: %s",
+				node.Metadata.ID,
+				nr.Deferred)
+		}
+	}
+	return results, changed
+}
+
+// belowMinimum returns true if removing the device would take its class
+// below the minimum size. Only classes in the configuration have a
+// minimum. The lost size is the storage of the class already removed
+// from the topology in this pass.
+func (m *Manager) belowMinimum(
+	t *topology.Topology,
+	device *topology.Device,
+	lost int64,
+) bool {
+	class := m.config.Class(device.Class)
+	if class == nil || class.MinimumTotalSizeGb == 0 {
+		return false
+	}
+	return t.TotalStorage(class)-lost-device.Size < class.MinimumTotalSizeGb
+}
+
+// addReplacementStorage adds a disk set to the class on a node picked by
+// the allocator. Returns true if the set was added.
+func (m *Manager) addReplacementStorage(
+	t *topology.Topology,
+	class *config.Class,
+) (bool, error) {
+	node, err := m.allocator.DetermineNodeToAddStorage(t, class)
+	if err != nil {
+		return false, err
+	}
+	numDisks, p := node.SetSizeForClass(class)
+	if numDisks <= 0 {
+		return false, fmt.Errorf("Node %s has no disks to add for class %s",
+			node.Metadata.ID,
+			class.Name)
+	}
+	if _, err := m.addStorage(class, node, p, numDisks); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// planDecommission returns an action for each device on the nodes being
+// decommissioned
+func (m *Manager) planDecommission(t *topology.Topology) []*PlannedAction {
+	actions := make([]*PlannedAction, 0)
+	for _, node := range t.Cluster.StorageNodes {
+		if node.State != topology.NodeStateDecommissioning {
+			continue
+		}
+		for _, device := range node.Devices {
+			actions = append(actions, &PlannedAction{
+				Class:  device.Class,
+				Action: ActionRemove,
+				Node:   node,
+				Pool:   devicePool(node, device),
+				Device: device,
+			})
+		}
+	}
+	return actions
+}
+
+// deviceClass returns the class of the device from the configuration or
+// from the classes being drained. Devices of unknown classes get a class
+// with only the name set.
+func (m *Manager) deviceClass(device *topology.Device) *config.Class {
+	if class := m.managedClass(device.Class); class != nil {
+		return class
+	}
+	return &config.Class{Name: device.Class}
+}
+
+// devicePool returns the pool of the node which the device belongs to
+func devicePool(node *topology.StorageNode, device *topology.Device) *topology.Pool {
+	if len(device.Pool) == 0 {
+		return nil
+	}
+	for _, pool := range node.Pools {
+		if pool.Name == device.Pool {
+			return pool
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+// PlannedAction describes a change the manager would make to a class
+type PlannedAction struct {
+	// Class name
+	Class string
+
+	// Action to take
+	Action Action
+
+	// Node where the action takes place
+	Node *topology.StorageNode
+
+	// Pool on the node, if any
+	Pool *topology.Pool
+
+	// Device to remove, replace or grow. Only set when Action is
+	// ActionRemove, ActionReplace or ActionGrow
+	Device *topology.Device
+
+	// NumDevices to create. Only set when Action is ActionAdd
+	NumDevices int
+
+	// DiskSizeGb is the size of each device to create, or the new size
+	// of the device when Action is ActionGrow
+	DiskSizeGb int64
+
+	// Deferred is the reason the action is being held back by the
+	// cooldown or hysteresis settings of the class. The action is only
+	// taken when this is empty.
+	Deferred string
+}
+
+// String returns a description of the action for fmt.Printf
+func (a *PlannedAction) String() string {
+	switch a.Action {
+	case ActionAdd:
+		if len(a.Deferred) != 0 {
+			return fmt.Sprintf("defer adding %s storage: %s", a.Class, a.Deferred)
+		}
+		return fmt.Sprintf("create %d %s disks of %dGi on node %s",
+			a.NumDevices,
+			a.Class,
+			a.DiskSizeGb,
+			a.Node.Metadata.ID)
+	case ActionRemove:
+		if len(a.Deferred) != 0 {
+			return fmt.Sprintf("defer removing %s storage: %s", a.Class, a.Deferred)
+		}
+		return fmt.Sprintf("remove %s device %s from node %s",
+			a.Class,
+			a.Device.Metadata.ID,
+			a.Node.Metadata.ID)
+	case ActionGrow:
+		if len(a.Deferred) != 0 {
+			return fmt.Sprintf("defer growing %s storage: %s", a.Class, a.Deferred)
+		}
+		return fmt.Sprintf("grow %s device %s on node %s from %dGi to %dGi",
+			a.Class,
+			a.Device.Metadata.ID,
+			a.Node.Metadata.ID,
+			a.Device.Size,
+			a.DiskSizeGb)
+	case ActionReplace:
+		return fmt.Sprintf("replace failed %s device %s on node %s",
+			a.Class,
+			a.Device.Metadata.ID,
+			a.Node.Metadata.ID)
+	}
+	return fmt.Sprintf("no change to %s", a.Class)
+}
+
+// Plan returns the ordered list of actions the next reconcile pass would
+// take without making any changes to the cloud or to the storage system.
+// Actions held back by the cooldown or hysteresis settings of a class are
+// included with Deferred set.
+func (m *Manager) Plan() ([]*PlannedAction, error) {
+	m.passLock.Lock()
+	defer m.passLock.Unlock()
+
+	t, err := m.storage.GetTopology()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Verify(); err != nil {
+		return nil, err
+	}
+	t = m.applyNodeStates(t)
+	t = m.applyDeviceLimits(t)
+
+	actions := m.planDecommission(t)
+	actions = append(actions, m.planReplacements(t)...)
+	errs := make([]string, 0)
+	for _, class := range m.config.Classes {
+		class := class
+
+		// Work on a copy so the plan does not count as a sample
+		state := *m.classState(class.Name)
+		classActions, err := m.planClass(t, &class, &state)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("class:%s %v", class.Name, err))
+			continue
+		}
+		for _, action := range classActions {
+			if action.Action == ActionNone ||
+				((action.Action == ActionRemove || action.Action == ActionGrow) &&
+					action.Device == nil) {
+				continue
+			}
+			actions = append(actions, action)
+		}
+	}
+	for _, name := range m.drainingNames() {
+		class := m.draining[name]
+		node, pool, device := m.allocator.DetermineStorageToRemove(t, &class)
+		if device == nil {
+			continue
+		}
+		actions = append(actions, &PlannedAction{
+			Class:  class.Name,
+			Action: ActionRemove,
+			Node:   node,
+			Pool:   pool,
+			Device: device,
+		})
+	}
+	if len(errs) != 0 {
+		return actions, fmt.Errorf("Unable to plan: %s", strings.Join(errs, "; "))
+	}
+
+	return actions, nil
+}
+
+// planClass decides what needs to be done to a class according to its
+// watermarks and size limits. The utilization is recorded as a sample in
+// the state provided. At least one action is always returned and the
+// first one has the decided Action set, even on error. Adding storage
+// may return one action per disk set. A remove or grow action with no
+// Device means there was nothing found to remove or grow.
+func (m *Manager) planClass(
+	t *topology.Topology,
+	class *config.Class,
+	state *classState,
+) ([]*PlannedAction, error) {
+	action := &PlannedAction{
+		Class:  class.Name,
+		Action: ActionNone,
+	}
+	utilization := t.Utilization(class)
+	totalStorage := t.TotalStorage(class)
+	state.sample(class, utilization)
+
+	// Size limits are always enforced. Watermarks are subject to
+	// the cooldown and hysteresis settings of the class.
+	belowMin := totalStorage < class.MinimumTotalSizeGb
+	aboveMax := totalStorage > class.MaximumTotalSizeGb
+
+	if (utilization >= class.WatermarkHigh &&
+		totalStorage+class.DiskSizeGb <= class.MaximumTotalSizeGb) ||
+		belowMin {
+		// Do not add any more storage if at the max
+		action.Action = ActionAdd
+		if !belowMin {
+			action.Deferred = state.deferAdd(class, m.now())
+			if len(action.Deferred) != 0 {
+				return []*PlannedAction{action}, nil
+			}
+		}
+
+		// Grow existing disks first if the class allows it
+		if class.GrowthStrategy == config.GrowthGrow ||
+			class.GrowthStrategy == config.GrowthHybrid {
+			grow, err := m.planGrow(t, class)
+			if err != nil {
+				return []*PlannedAction{action}, err
+			}
+			if grow != nil {
+				return []*PlannedAction{grow}, nil
+			}
+			// Disks are only added to a grow class which has none
+			if class.GrowthStrategy == config.GrowthGrow && totalStorage != 0 {
+				action.Action = ActionGrow
+				return []*PlannedAction{action}, nil
+			}
+		}
+
+		actions, err := m.planAdd(t, class, utilization)
+		if err != nil {
+			return []*PlannedAction{action}, err
+		}
+		return actions, nil
+	} else if (utilization <= class.WatermarkLow &&
+		totalStorage-class.DiskSizeGb >= class.MinimumTotalSizeGb) ||
+		aboveMax {
+		action.Action = ActionRemove
+		if !aboveMax {
+			action.Deferred = state.deferRemove(class, m.now())
+			if len(action.Deferred) != 0 {
+				return []*PlannedAction{action}, nil
+			}
+		}
+
+		// Pick a device
+		action.Node, action.Pool, action.Device =
+			m.allocator.DetermineStorageToRemove(t, class)
+	}
+
+	return []*PlannedAction{action}, nil
+}
+
+// planAdd returns one action per disk set to add. Without a target
+// utilization a single set is added. Otherwise sets are placed by the
+// allocator one at a time on a copy of the topology, so they are spread
+// across nodes, until the class reaches its target utilization or
+// maximum size.
+func (m *Manager) planAdd(
+	t *topology.Topology,
+	class *config.Class,
+	utilization int,
+) ([]*PlannedAction, error) {
+	if class.DiskSizeGb <= 0 {
+		return nil, fmt.Errorf("Disk size must be greater than zero")
+	}
+
+	total := t.TotalStorage(class)
+	required := requiredStorage(class, utilization, total)
+	planned := t
+	if class.TargetUtilization > 0 {
+		planned = t.Copy()
+	}
+
+	actions := make([]*PlannedAction, 0)
+	for {
+		// Pick a node
+		node, err := m.allocator.DetermineNodeToAddStorage(planned, class)
+		if err != nil {
+			if len(actions) == 0 {
+				return nil, err
+			}
+			logrus.Warnf("class:%s Unable to place more disk sets: %v",
+				class.Name,
+				err)
+			break
+		}
+
+		// The allocator returns the node from the planned copy
+		original := node
+		for i, n := range planned.Cluster.StorageNodes {
+			if n == node {
+				original = t.Cluster.StorageNodes[i]
+				break
+			}
+		}
+
+		// Determine how many disks we need to add to this node
+		numDisks, p := original.SetSizeForClass(class)
+		setSize := int64(numDisks) * class.DiskSizeGb
+		if setSize <= 0 {
+			if len(actions) == 0 {
+				return nil, fmt.Errorf("Node %s has no disks to add for class %s",
+					original.Metadata.ID,
+					class.Name)
+			}
+			break
+		}
+		if len(actions) != 0 && total+setSize > class.MaximumTotalSizeGb {
+			break
+		}
+		actions = append(actions, &PlannedAction{
+			Class:      class.Name,
+			Action:     ActionAdd,
+			Node:       original,
+			Pool:       p,
+			NumDevices: numDisks,
+			DiskSizeGb: class.DiskSizeGb,
+		})
+		total += setSize
+		if class.TargetUtilization <= 0 || total >= required {
+			break
+		}
+
+		// Let the allocator see the set in the next iteration
+		for d := 0; d < numDisks; d++ {
+			device := &topology.Device{
+				Class: class.Name,
+				Size:  class.DiskSizeGb,
+				Metadata: topology.DeviceMetadata{
+					ID: fmt.Sprintf("planned-%d-%d", len(actions), d),
+				},
+			}
+			if p != nil {
+				device.Pool = p.Name
+			}
+			node.Devices = append(node.Devices, device)
+		}
+	}
+
+	return actions, nil
+}
+
+// requiredStorage returns the total size the class needs to reach its
+// target utilization, and never less than its minimum size
+func requiredStorage(class *config.Class, utilization int, total int64) int64 {
+	required := class.MinimumTotalSizeGb
+	if class.TargetUtilization > 0 {
+		target := int64(class.TargetUtilization)
+		used := int64(utilization) * total
+		if r := (used + target - 1) / target; r > required {
+			required = r
+		}
+	}
+	return required
+}
@@ -0,0 +1,279 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/journal"
+	"github.com/libopenstorage/rico/pkg/topology"
+)
+
+const (
+	// deleteAttempts is the number of times a device released by the
+	// storage system is deleted before leaving it to the next reconcile
+	deleteAttempts = 3
+
+	// deleteBackoff is the wait after the first failed delete
+	deleteBackoff = time.Second
+)
+
+// Recover replays the journal, finishing or rolling back every operation
+// which was interrupted. It is also done at the start of every reconcile
+// pass, so it only needs to be called directly when the manager is not
+// started.
+func (m *Manager) Recover() error {
+	m.passLock.Lock()
+	defer m.passLock.Unlock()
+
+	if m.journalErr != nil {
+		return m.journalErr
+	}
+	t, err := m.storage.GetTopology()
+	if err != nil {
+		return err
+	}
+	_, err = m.recover(t)
+	return err
+}
+
+// recover replays all the entries in the journal. Returns true if any
+// change was made to the storage system or the cloud.
+func (m *Manager) recover(t *topology.Topology) (bool, error) {
+	entries, err := m.journal.Entries()
+	if err != nil {
+		return false, fmt.Errorf("Unable to read journal: %v", err)
+	}
+
+	changed := false
+	var recoverErr error
+	for _, entry := range entries {
+		logrus.Infof("class:%s Recovering %v", entry.Class, entry)
+
+		var (
+			entryChanged bool
+			err          error
+		)
+		switch entry.Operation {
+		case journal.OperationAdd:
+			entryChanged, err = m.recoverAdd(t, entry)
+		case journal.OperationRemove:
+			entryChanged, err = m.recoverRemove(t, entry)
+		case journal.OperationReplace:
+			entryChanged, err = m.recoverReplace(t, entry)
+		case journal.OperationGrow:
+			entryChanged, err = m.recoverGrow(t, entry)
+		default:
+			err = fmt.Errorf("Unknown operation %s", entry.Operation)
+		}
+		if err != nil {
+			logrus.Errorf("class:%s Unable to recover %v: %v",
+				entry.Class,
+				entry,
+				err)
+			recoverErr = err
+		}
+		changed = changed || entryChanged
+	}
+
+	return changed, recoverErr
+}
+
+// recoverAdd completes an add if the storage system has any of the
+// devices, otherwise the devices are deleted from the cloud. Returns true
+// if any device was deleted.
+func (m *Manager) recoverAdd(t *topology.Topology, entry *journal.Entry) (bool, error) {
+	if entry.State == journal.StateAdding {
+		for _, d := range entry.Devices {
+			if hasDevice(t, entry.InstanceID, d.ID) {
+				logrus.Infof("class:%s Storage system has devices from %s, "+
+					"add completed",
+					entry.Class,
+					entry.ID)
+				return false, m.journal.Delete(entry.ID)
+			}
+		}
+	}
+
+	return m.recoverDevices(entry)
+}
+
+// recoverRemove deletes the cloud devices released by the storage system.
+// Returns true if any device was deleted.
+func (m *Manager) recoverRemove(t *topology.Topology, entry *journal.Entry) (bool, error) {
+	if entry.State == journal.StateRemoving {
+		for _, d := range entry.Devices {
+			if hasDevice(t, entry.InstanceID, d.ID) {
+				// The storage system never removed it. Let the next
+				// reconcile decide again.
+				logrus.Infof("class:%s Device %s still in use, "+
+					"remove abandoned",
+					entry.Class,
+					d.ID)
+				return false, m.journal.Delete(entry.ID)
+			}
+		}
+		entry.State = journal.StateDeleting
+		if err := m.journal.Save(entry); err != nil {
+			return false, err
+		}
+	}
+
+	return m.recoverDevices(entry)
+}
+
+// recoverReplace deletes the failed device if the storage system has the
+// replacement, otherwise the replacement is deleted so the failed device
+// is replaced again on the next pass. Returns true if any device was
+// deleted.
+func (m *Manager) recoverReplace(t *topology.Topology, entry *journal.Entry) (bool, error) {
+	if entry.Replaced == nil {
+		return false, fmt.Errorf("Replace entry %s has no failed device", entry.ID)
+	}
+	if entry.State == journal.StateReplacing {
+		for _, d := range entry.Devices {
+			if hasDevice(t, entry.InstanceID, d.ID) {
+				logrus.Infof("class:%s Storage system has replacement %s, "+
+					"deleting failed device",
+					entry.Class,
+					d.ID)
+				entry.State = journal.StateDeleting
+				entry.Devices = []journal.Device{*entry.Replaced}
+				if err := m.journal.Save(entry); err != nil {
+					return false, err
+				}
+				break
+			}
+		}
+	}
+
+	return m.recoverDevices(entry)
+}
+
+// recoverDevices deletes the devices left in the entry with a single
+// attempt each. Returns true if any device was deleted.
+func (m *Manager) recoverDevices(entry *journal.Entry) (bool, error) {
+	before := len(entry.Devices)
+	err := m.deleteJournalDevices(entry, 1)
+	return len(entry.Devices) < before, err
+}
+
+// deleteJournalDevices deletes all the devices in the entry from the
+// cloud, trying each one up to the number of attempts provided. The entry
+// is deleted once it has no more devices. Returns a *DeleteError if any
+// device could not be deleted.
+func (m *Manager) deleteJournalDevices(entry *journal.Entry, attempts int) error {
+	deleteErr := &DeleteError{
+		InstanceID: entry.InstanceID,
+		Deleted:    make([]string, 0, len(entry.Devices)),
+		Errors:     make(map[string]error),
+	}
+	for _, d := range append([]journal.Device(nil), entry.Devices...) {
+		logrus.Infof("class:%s Detaching/deleting device %s/%s:%s",
+			entry.Class,
+			entry.InstanceID,
+			d.Path,
+			d.ID)
+		if err := m.deleteDevice(entry.InstanceID, d.ID, attempts); err != nil {
+			logrus.Errorf("class:%s Failed to delete device %s: %v",
+				entry.Class,
+				d.ID,
+				err)
+			deleteErr.Errors[d.ID] = err
+			continue
+		}
+		deleteErr.Deleted = append(deleteErr.Deleted, d.ID)
+		entry.RemoveDevice(d.ID)
+	}
+
+	if len(entry.Devices) == 0 {
+		return m.journal.Delete(entry.ID)
+	}
+	if err := m.journal.Save(entry); err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+// deleteDevice detaches and deletes a device from the cloud, waiting
+// twice as long after each failed attempt. A device which does not exist
+// is already deleted.
+func (m *Manager) deleteDevice(instanceID, deviceID string, attempts int) error {
+	delay := m.backoff
+	for attempt := 1; ; attempt++ {
+		err := m.cloud.DeviceDelete(instanceID, deviceID)
+		if err == nil || err == cloudprovider.ErrDeviceNotFound {
+			return nil
+		}
+		if attempt >= attempts {
+			return err
+		}
+		logrus.Warnf("Failed to delete device %s, attempt %d of %d: %v",
+			deviceID,
+			attempt,
+			attempts,
+			err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// journalSave saves the entry logging any failure. Used once the
+// operation can no longer be stopped.
+func (m *Manager) journalSave(entry *journal.Entry) {
+	if err := m.journal.Save(entry); err != nil {
+		logrus.Errorf("class:%s Unable to save journal entry %v: %v",
+			entry.Class,
+			entry,
+			err)
+	}
+}
+
+// journalDelete deletes a completed entry logging any failure
+func (m *Manager) journalDelete(entry *journal.Entry) {
+	if err := m.journal.Delete(entry.ID); err != nil {
+		logrus.Errorf("class:%s Unable to delete journal entry %v: %v",
+			entry.Class,
+			entry,
+			err)
+	}
+}
+
+func journalDevice(d *topology.Device) journal.Device {
+	return journal.Device{
+		ID:   d.Metadata.ID,
+		Path: d.Path,
+		Size: d.Size,
+	}
+}
+
+func hasDevice(t *topology.Topology, instanceID, deviceID string) bool {
+	for _, node := range t.Cluster.StorageNodes {
+		if node.Metadata.ID != instanceID {
+			continue
+		}
+		for _, d := range node.Devices {
+			if d.Metadata.ID == deviceID {
+				return true
+			}
+		}
+	}
+	return false
+}
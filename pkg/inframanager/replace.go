@@ -0,0 +1,229 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/libopenstorage/logrus"
+	"github.com/libopenstorage/rico/pkg/cloudprovider"
+	"github.com/libopenstorage/rico/pkg/config"
+	"github.com/libopenstorage/rico/pkg/journal"
+	"github.com/libopenstorage/rico/pkg/storageprovider"
+	"github.com/libopenstorage/rico/pkg/topology"
+
+	"github.com/pborman/uuid"
+)
+
+// replaceFailed replaces every failed device on the nodes which accept
+// new storage. The replacement is created on the node of the failed
+// device, so cordoned nodes and nodes in maintenance are skipped, and
+// nodes being decommissioned are emptied instead. Returns true if the
+// storage system took any replacement.
+func (m *Manager) replaceFailed(t *topology.Topology) ([]*ReplaceResult, bool) {
+	results := make([]*ReplaceResult, 0)
+	changed := false
+	for _, node := range t.Cluster.StorageNodes {
+		if !replaceable(node) {
+			continue
+		}
+		for _, device := range node.Devices {
+			if !device.Failed() {
+				continue
+			}
+
+			rr := &ReplaceResult{
+				Node:   node.Metadata.ID,
+				Device: device.Metadata.ID,
+			}
+			results = append(results, rr)
+
+			class := m.managedClass(device.Class)
+			if class == nil {
+				rr.Error = fmt.Errorf("Class %s is not managed", device.Class)
+			} else {
+				var replacement *topology.Device
+				replacement, rr.Error = m.replaceDevice(class,
+					node,
+					devicePool(node, device),
+					device)
+				if replacement != nil {
+					rr.Replacement = replacement.Metadata.ID
+					changed = true
+				}
+			}
+			if rr.Error != nil {
+				logrus.Errorf("node:%s Failed to replace device %s: %v",
+					node.Metadata.ID,
+					device.Metadata.ID,
+					rr.Error)
+			}
+		}
+	}
+	return results, changed
+}
+
+// replaceDevice creates a device of the class on the node, has the
+// storage system rebuild the failed device onto it and deletes the
+// failed device. Returns the replacement once the storage system is
+// using it.
+func (m *Manager) replaceDevice(
+	class *config.Class,
+	node *topology.StorageNode,
+	pool *topology.Pool,
+	failed *topology.Device,
+) (*topology.Device, error) {
+	replacer, ok := m.storage.(storageprovider.Replacer)
+	if !ok {
+		return nil, fmt.Errorf("Storage system does not support replacing devices")
+	}
+
+	// Journal the failed device first so recovery can finish or undo
+	// an interrupted replace
+	replaced := journalDevice(failed)
+	entry := &journal.Entry{
+		ID:         uuid.New(),
+		Operation:  journal.OperationReplace,
+		State:      journal.StateCreating,
+		Class:      class.Name,
+		InstanceID: node.Metadata.ID,
+		Devices:    make([]journal.Device, 0, 1),
+		Replaced:   &replaced,
+		Created:    time.Now(),
+	}
+	if pool != nil {
+		entry.Pool = pool.Name
+	}
+	if err := m.journal.Save(entry); err != nil {
+		return nil, fmt.Errorf("Unable to journal replace of device %s: %v",
+			failed.Metadata.ID,
+			err)
+	}
+
+	logrus.Infof("class:%s Creating replacement for device %s/%s:%s",
+		class.Name,
+		node.Metadata.ID,
+		failed.Path,
+		failed.Metadata.ID)
+	cd, err := m.cloud.DeviceCreate(node.Metadata.ID, class)
+	if err != nil {
+		m.journalDelete(entry)
+		return nil, fmt.Errorf("Failed to create replacement: %v", err)
+	}
+	replacement := &topology.Device{
+		Class: class.Name,
+		Pool:  failed.Pool,
+		Path:  cd.Path,
+		Size:  cd.Size,
+		Metadata: topology.DeviceMetadata{
+			ID: cd.ID,
+		},
+	}
+
+	// Rebuild onto the replacement
+	entry.Devices = append(entry.Devices, journalDevice(replacement))
+	entry.State = journal.StateReplacing
+	if err := m.journal.Save(entry); err != nil {
+		m.rollbackReplace(entry)
+		return nil, fmt.Errorf("Unable to journal replacement %s: %v", cd.ID, err)
+	}
+	logrus.Infof("class:%s Notifying storage system to replace %s with %s on node:%s",
+		class.Name,
+		failed.Metadata.ID,
+		replacement.Metadata.ID,
+		node.Metadata.ID)
+	if err := replacer.DeviceReplace(node, pool, failed, replacement); err != nil {
+		m.rollbackReplace(entry)
+		return nil, fmt.Errorf("Storage system failed to replace device: %v", err)
+	}
+
+	// The storage system no longer uses the failed device
+	entry.State = journal.StateDeleting
+	entry.Devices = []journal.Device{replaced}
+	m.journalSave(entry)
+	logrus.Infof("class:%s Detaching/deleting failed device %s/%s:%s",
+		class.Name,
+		node.Metadata.ID,
+		failed.Path,
+		failed.Metadata.ID)
+	err = m.cloud.DeviceDelete(node.Metadata.ID, failed.Metadata.ID)
+	if err != nil && err != cloudprovider.ErrDeviceNotFound {
+		// Leave the entry in the journal so the next reconcile can finish
+		return replacement, fmt.Errorf("Failed to delete device %s: %v",
+			failed.Metadata.ID,
+			err)
+	}
+
+	m.journalDelete(entry)
+	return replacement, nil
+}
+
+// rollbackReplace deletes the replacement created by a failed replace.
+// If it cannot be deleted the entry is kept to be retried by the next
+// reconcile.
+func (m *Manager) rollbackReplace(entry *journal.Entry) {
+	if err := m.deleteJournalDevices(entry, 1); err != nil {
+		logrus.Errorf("class:%s Failed to roll back replacement %v: %v",
+			entry.Class,
+			entry.Devices,
+			err)
+	}
+}
+
+// planReplacements returns an action for each failed device which would
+// be replaced
+func (m *Manager) planReplacements(t *topology.Topology) []*PlannedAction {
+	actions := make([]*PlannedAction, 0)
+	for _, node := range t.Cluster.StorageNodes {
+		if !replaceable(node) {
+			continue
+		}
+		for _, device := range node.Devices {
+			if !device.Failed() || m.managedClass(device.Class) == nil {
+				continue
+			}
+			actions = append(actions, &PlannedAction{
+				Class:      device.Class,
+				Action:     ActionReplace,
+				Node:       node,
+				Pool:       devicePool(node, device),
+				Device:     device,
+				NumDevices: 1,
+			})
+		}
+	}
+	return actions
+}
+
+// managedClass returns the class from the configuration or from the
+// classes being drained, or nil if the class is not managed
+func (m *Manager) managedClass(name string) *config.Class {
+	if class := m.config.Class(name); class != nil {
+		return class
+	}
+	if class, ok := m.draining[name]; ok {
+		return &class
+	}
+	return nil
+}
+
+// replaceable returns true if failed devices on the node are replaced.
+// The replacement is new storage on the node, so the node must accept it.
+func replaceable(node *topology.StorageNode) bool {
+	return node.Schedulable()
+}
@@ -0,0 +1,413 @@
+/*
+Package inframanager provides an interface to the infrastrcture manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package inframanager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Action is the type of change decided for a class during a reconcile pass
+type Action string
+
+// Outcome is the result of the action taken on a class
+type Outcome string
+
+const (
+	// ActionNone means the class did not need any change
+	ActionNone Action = "none"
+	// ActionAdd means storage was added to the class
+	ActionAdd Action = "add"
+	// ActionRemove means storage was removed from the class
+	ActionRemove Action = "remove"
+	// ActionReplace means a failed device was replaced
+	ActionReplace Action = "replace"
+	// ActionGrow means storage was added to the class by growing a device
+	ActionGrow Action = "grow"
+
+	// OutcomeNoChange means nothing was done
+	OutcomeNoChange Outcome = "nochange"
+	// OutcomeSkipped means an action was needed but could not be taken,
+	// for example when no device was found to remove
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeDeferred means an action was needed but is being held back
+	// by the cooldown or hysteresis settings of the class
+	OutcomeDeferred Outcome = "deferred"
+	// OutcomeSuccess means the action completed
+	OutcomeSuccess Outcome = "success"
+	// OutcomePartial means some disk sets were added before another one
+	// failed. See ClassResult.Error
+	OutcomePartial Outcome = "partial"
+	// OutcomeFailed means the action failed. See ClassResult.Error
+	OutcomeFailed Outcome = "failed"
+)
+
+// ClassResult holds what happened to a single class in a reconcile pass
+type ClassResult struct {
+	// Class name
+	Class string
+
+	// Action decided for the class
+	Action Action
+
+	// Outcome of the action
+	Outcome Outcome
+
+	// Error is set when Outcome is OutcomeFailed or OutcomePartial
+	Error error
+
+	// Draining is true if the class was removed from the configuration
+	// and its devices are being removed
+	Draining bool
+
+	// Rollbacks has the cleanup of every disk set which failed to be
+	// added, in the order they were tried
+	Rollbacks []*Rollback
+}
+
+// Rollback reports the cleanup of devices created by a failed add
+type Rollback struct {
+	// InstanceID of the node the disk set was added to
+	InstanceID string
+
+	// Deleted has the cloud ids of the devices detached and deleted
+	Deleted []string
+
+	// Errors has the error for each device which could not be deleted
+	// keyed by cloud id. These devices are left orphaned in the cloud.
+	Errors map[string]error
+}
+
+// Succeeded returns true if all the devices were deleted
+func (r *Rollback) Succeeded() bool {
+	return len(r.Errors) == 0
+}
+
+// String returns a string representation of the rollback for fmt.Printf
+func (r *Rollback) String() string {
+	s := fmt.Sprintf("node:%s deleted:%v", r.InstanceID, r.Deleted)
+	if !r.Succeeded() {
+		s += fmt.Sprintf(" orphaned:%v", r.Errors)
+	}
+	return s
+}
+
+// DeleteError is returned when devices released by the storage system
+// could not be deleted from the cloud. They are kept in the journal and
+// deleted by the next reconcile.
+type DeleteError struct {
+	// InstanceID of the node the devices were on
+	InstanceID string
+
+	// Deleted has the cloud ids of the devices detached and deleted
+	Deleted []string
+
+	// Errors has the error for each device which could not be deleted
+	// keyed by cloud id
+	Errors map[string]error
+}
+
+// Error returns a message with the error of each device
+func (e *DeleteError) Error() string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = fmt.Sprintf("%s: %v", id, e.Errors[id])
+	}
+	return fmt.Sprintf("Failed to delete %d of %d devices from node %s: %s",
+		len(ids),
+		len(ids)+len(e.Deleted),
+		e.InstanceID,
+		strings.Join(msgs, "; "))
+}
+
+// Result is the result of a reconcile pass
+type Result struct {
+	// Time the pass started
+	Start time.Time
+
+	// Time the pass ended
+	End time.Time
+
+	// Classes has one entry per class in the order of the configuration
+	Classes []*ClassResult
+
+	// Nodes has one entry per node being decommissioned
+	Nodes []*NodeResult
+
+	// Replacements has one entry per failed device
+	Replacements []*ReplaceResult
+
+	// Adopted has one entry per device of the cluster found attached to
+	// a node but missing from the storage system
+	Adopted []*AdoptResult
+
+	// GC holds the orphaned and mismatched devices found. It is nil if
+	// the configuration has no cluster ID.
+	GC *GCResult
+}
+
+// GCResult holds the differences found between the devices of the
+// cluster in the cloud and the topology
+type GCResult struct {
+	// Orphans are the cloud ids of the devices of the cluster which
+	// the storage system does not use
+	Orphans []string
+
+	// Deleted are the orphans deleted in this pass
+	Deleted []string
+
+	// Unknown are the ids of the devices in the topology which are not
+	// labeled with the cluster ID in the cloud
+	Unknown []string
+
+	// Mismatches describe the devices whose node, size or class differ
+	// between the topology and the cloud
+	Mismatches []string
+
+	// Errors has the orphans which could not be deleted
+	Errors map[string]error
+
+	// Err is set if the devices could not be compared
+	Err error
+}
+
+// String returns a string representation of the gc result for fmt.Printf
+func (gc *GCResult) String() string {
+	s := fmt.Sprintf("orphans:%v deleted:%v unknown:%v mismatches:%d failed:%d",
+		gc.Orphans,
+		gc.Deleted,
+		gc.Unknown,
+		len(gc.Mismatches),
+		len(gc.Errors))
+	if gc.Err != nil {
+		s += fmt.Sprintf(" error:%v", gc.Err)
+	}
+	return s
+}
+
+// AdoptResult holds what happened to a device found in the cloud
+type AdoptResult struct {
+	// Node instance id
+	Node string
+
+	// Device is the cloud id of the device
+	Device string
+
+	// Class of the device according to its labels
+	Class string
+
+	// Error is set if the device could not be added to the storage system
+	Error error
+}
+
+// String returns a string representation of the adopt result for fmt.Printf
+func (ar *AdoptResult) String() string {
+	s := fmt.Sprintf("node:%s device:%s class:%s",
+		ar.Node,
+		ar.Device,
+		ar.Class)
+	if ar.Error != nil {
+		s += fmt.Sprintf(" error:%v", ar.Error)
+	}
+	return s
+}
+
+// ReplaceResult holds what happened to a failed device
+type ReplaceResult struct {
+	// Node instance id
+	Node string
+
+	// Device is the cloud id of the failed device
+	Device string
+
+	// Replacement is the cloud id of the new device, if it was created
+	Replacement string
+
+	// Error is set if the device could not be replaced
+	Error error
+}
+
+// String returns a string representation of the replace result for fmt.Printf
+func (rr *ReplaceResult) String() string {
+	s := fmt.Sprintf("node:%s device:%s replacement:%s",
+		rr.Node,
+		rr.Device,
+		rr.Replacement)
+	if rr.Error != nil {
+		s += fmt.Sprintf(" error:%v", rr.Error)
+	}
+	return s
+}
+
+// NodeResult holds what happened to a node being decommissioned
+type NodeResult struct {
+	// Node instance id
+	Node string
+
+	// Removed has the cloud ids of the devices removed in this pass
+	Removed []string
+
+	// Remaining is the number of devices left on the node
+	Remaining int
+
+	// Deferred is the reason the node was not emptied further in this
+	// pass, such as the cooldown of a device class
+	Deferred string
+
+	// Error is set if a device could not be removed
+	Error error
+}
+
+// String returns a string representation of the node result for fmt.Printf
+func (nr *NodeResult) String() string {
+	s := fmt.Sprintf("node:%s removed:%v remaining:%d",
+		nr.Node,
+		nr.Removed,
+		nr.Remaining)
+	if len(nr.Deferred) != 0 {
+		s += fmt.Sprintf(" deferred:%s", nr.Deferred)
+	}
+	if nr.Error != nil {
+		s += fmt.Sprintf(" error:%v", nr.Error)
+	}
+	return s
+}
+
+// Class returns the result for the class name provided or nil if the
+// class was not part of the pass
+func (r *Result) Class(name string) *ClassResult {
+	for _, cr := range r.Classes {
+		if cr.Class == name {
+			return cr
+		}
+	}
+	return nil
+}
+
+// Failed returns the results of the classes which failed, including
+// those which only partially succeeded
+func (r *Result) Failed() []*ClassResult {
+	failed := make([]*ClassResult, 0)
+	for _, cr := range r.Classes {
+		if cr.Outcome == OutcomeFailed || cr.Outcome == OutcomePartial {
+			failed = append(failed, cr)
+		}
+	}
+	return failed
+}
+
+// Err returns an error summarizing all the classes and nodes which
+// failed, or nil if none failed
+func (r *Result) Err() error {
+	errs := make([]string, 0)
+	if failed := r.Failed(); len(failed) != 0 {
+		msgs := make([]string, len(failed))
+		for i, cr := range failed {
+			msgs[i] = fmt.Sprintf("class:%s %s: %v", cr.Class, cr.Action, cr.Error)
+		}
+		errs = append(errs, fmt.Sprintf("%d of %d classes failed: %s",
+			len(failed),
+			len(r.Classes),
+			strings.Join(msgs, "; ")))
+	}
+
+	msgs := make([]string, 0)
+	for _, nr := range r.Nodes {
+		if nr.Error != nil {
+			msgs = append(msgs, fmt.Sprintf("node:%s %v", nr.Node, nr.Error))
+		}
+	}
+	if len(msgs) != 0 {
+		errs = append(errs, fmt.Sprintf("%d of %d nodes failed to decommission: %s",
+			len(msgs),
+			len(r.Nodes),
+			strings.Join(msgs, "; ")))
+	}
+
+	msgs = make([]string, 0)
+	for _, rr := range r.Replacements {
+		if rr.Error != nil {
+			msgs = append(msgs, fmt.Sprintf("device:%s %v", rr.Device, rr.Error))
+		}
+	}
+	if len(msgs) != 0 {
+		errs = append(errs, fmt.Sprintf("%d of %d failed devices not replaced: %s",
+			len(msgs),
+			len(r.Replacements),
+			strings.Join(msgs, "; ")))
+	}
+
+	msgs = make([]string, 0)
+	for _, ar := range r.Adopted {
+		if ar.Error != nil {
+			msgs = append(msgs, fmt.Sprintf("device:%s %v", ar.Device, ar.Error))
+		}
+	}
+	if len(msgs) != 0 {
+		errs = append(errs, fmt.Sprintf("%d of %d devices not adopted: %s",
+			len(msgs),
+			len(r.Adopted),
+			strings.Join(msgs, "; ")))
+	}
+
+	if r.GC != nil {
+		if r.GC.Err != nil {
+			errs = append(errs, fmt.Sprintf("garbage collection failed: %v", r.GC.Err))
+		}
+		if len(r.GC.Errors) != 0 {
+			ids := make([]string, 0, len(r.GC.Errors))
+			for id := range r.GC.Errors {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			msgs := make([]string, len(ids))
+			for i, id := range ids {
+				msgs[i] = fmt.Sprintf("device:%s %v", id, r.GC.Errors[id])
+			}
+			errs = append(errs, fmt.Sprintf("%d orphaned devices not deleted: %s",
+				len(msgs),
+				strings.Join(msgs, "; ")))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// String returns a string representation of the class result for fmt.Printf
+func (cr *ClassResult) String() string {
+	s := fmt.Sprintf("class:%s action:%s outcome:%s",
+		cr.Class,
+		cr.Action,
+		cr.Outcome)
+	if cr.Error != nil {
+		s += fmt.Sprintf(" error:%v", cr.Error)
+	}
+	for _, rollback := range cr.Rollbacks {
+		s += fmt.Sprintf(" rollback:[%v]", rollback)
+	}
+	return s
+}
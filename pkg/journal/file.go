@@ -0,0 +1,151 @@
+/*
+Package journal provides a write-ahead journal of the operations in
+progress by the infrastructure manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File is a journal stored as JSON in a local file. Every change is
+// written to a temporary file which then replaces the journal, so the
+// file always holds a complete journal even if the process dies.
+type File struct {
+	lock    sync.Mutex
+	path    string
+	entries map[string]*Entry
+}
+
+// NewFile returns a journal stored in the file at path. Entries already
+// in the file are loaded so they can be recovered.
+func NewFile(path string) (*File, error) {
+	f := &File{
+		path:    path,
+		entries: make(map[string]*Entry),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read journal %s: %v", path, err)
+	}
+	if len(data) == 0 {
+		return f, nil
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("Unable to parse journal %s: %v", path, err)
+	}
+	for _, e := range entries {
+		f.entries[e.ID] = e
+	}
+
+	return f, nil
+}
+
+// Save creates or updates an entry
+func (f *File) Save(e *Entry) error {
+	if len(e.ID) == 0 {
+		return fmt.Errorf("Journal entry id cannot be empty")
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	e.Updated = time.Now()
+	old, existed := f.entries[e.ID]
+	f.entries[e.ID] = e.copy()
+	if err := f.write(); err != nil {
+		if existed {
+			f.entries[e.ID] = old
+		} else {
+			delete(f.entries, e.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes an entry
+func (f *File) Delete(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	old, existed := f.entries[id]
+	if !existed {
+		return nil
+	}
+	delete(f.entries, id)
+	if err := f.write(); err != nil {
+		f.entries[id] = old
+		return err
+	}
+	return nil
+}
+
+// Entries returns a copy of all the entries ordered by creation time
+func (f *File) Entries() ([]*Entry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return sortedEntries(f.entries), nil
+}
+
+func (f *File) write() error {
+	data, err := json.MarshalIndent(sortedEntries(f.entries), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(f.path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to write journal %s: %v", f.path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Unable to write journal %s: %v", f.path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Unable to sync journal %s: %v", f.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Unable to write journal %s: %v", f.path, err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("Unable to replace journal %s: %v", f.path, err)
+	}
+
+	// Persist the rename
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Package journal provides a write-ahead journal of the operations in
+progress by the infrastructure manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package journal
+
+import (
+	"fmt"
+	"time"
+)
+
+// Operation is the type of operation recorded in an entry
+type Operation string
+
+// State is the progress of an operation
+type State string
+
+const (
+	// OperationAdd creates cloud devices and adds them to the storage system
+	OperationAdd Operation = "add"
+	// OperationRemove removes a device from the storage system and
+	// deletes the cloud devices it returns
+	OperationRemove Operation = "remove"
+	// OperationReplace creates a device, has the storage system rebuild
+	// the data of a failed device onto it and deletes the failed device
+	OperationReplace Operation = "replace"
+	// OperationGrow resizes a cloud device and has the storage system
+	// use the new size
+	OperationGrow Operation = "grow"
+
+	// StateCreating means cloud devices are being created. Entry.Devices
+	// has the devices created so far.
+	StateCreating State = "creating"
+	// StateAdding means the storage system has been asked to add the
+	// devices in Entry.Devices
+	StateAdding State = "adding"
+	// StateRemoving means the storage system has been asked to remove
+	// the device in Entry.Devices
+	StateRemoving State = "removing"
+	// StateReplacing means the storage system has been asked to rebuild
+	// Entry.Replaced onto the devices in Entry.Devices
+	StateReplacing State = "replacing"
+	// StateGrowing means the cloud device in Entry.Devices is being
+	// resized to the size recorded in the entry
+	StateGrowing State = "growing"
+	// StateExpanding means the storage system has been asked to use the
+	// new size of the device in Entry.Devices
+	StateExpanding State = "expanding"
+	// StateDeleting means the storage system has released the devices in
+	// Entry.Devices and they are being deleted from the cloud. For a
+	// replace, Entry.Devices holds the failed device.
+	StateDeleting State = "deleting"
+)
+
+// Device identifies a cloud device recorded in an entry
+type Device struct {
+	// Cloud device ID
+	ID string `json:"id"`
+
+	// Path of the device node on the host
+	Path string `json:"path,omitempty"`
+
+	// Size in GiB
+	Size int64 `json:"size,omitempty"`
+}
+
+// Entry records the intent and progress of a single operation
+type Entry struct {
+	// ID of the entry
+	ID string `json:"id"`
+
+	// Operation recorded
+	Operation Operation `json:"operation"`
+
+	// State of the operation
+	State State `json:"state"`
+
+	// Class name of the devices
+	Class string `json:"class"`
+
+	// InstanceID is the cloud instance of the node
+	InstanceID string `json:"instanceId"`
+
+	// Pool name, if any
+	Pool string `json:"pool,omitempty"`
+
+	// Devices involved in the operation. See State for their meaning.
+	Devices []Device `json:"devices"`
+
+	// Replaced is the failed device. Only set for OperationReplace.
+	Replaced *Device `json:"replaced,omitempty"`
+
+	// Created is the time the operation started
+	Created time.Time `json:"created"`
+
+	// Updated is the time the entry was last saved
+	Updated time.Time `json:"updated"`
+}
+
+// Interface is a durable store of journal entries
+type Interface interface {
+	// Save creates or updates an entry
+	Save(e *Entry) error
+
+	// Delete removes the entry of a completed operation
+	Delete(id string) error
+
+	// Entries returns a copy of all the entries ordered by creation time
+	Entries() ([]*Entry, error)
+}
+
+// String returns a string representation of the entry for fmt.Printf
+func (e *Entry) String() string {
+	return fmt.Sprintf("J[%s|%s|%s|%s|%s|%v]",
+		e.ID,
+		e.Operation,
+		e.State,
+		e.Class,
+		e.InstanceID,
+		e.Devices)
+}
+
+// RemoveDevice removes the device with the cloud id from the entry
+func (e *Entry) RemoveDevice(id string) {
+	for i, d := range e.Devices {
+		if d.ID == id {
+			e.Devices = append(e.Devices[:i], e.Devices[i+1:]...)
+			return
+		}
+	}
+}
+
+func (e *Entry) copy() *Entry {
+	c := *e
+	c.Devices = make([]Device, len(e.Devices))
+	copy(c.Devices, e.Devices)
+	if e.Replaced != nil {
+		r := *e.Replaced
+		c.Replaced = &r
+	}
+	return &c
+}
@@ -0,0 +1,123 @@
+/*
+Package journal provides a write-ahead journal of the operations in
+progress by the infrastructure manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.json")
+
+	j, err := NewFile(path)
+	assert.NoError(t, err)
+	entries, err := j.Entries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	now := time.Now()
+	add := &Entry{
+		ID:         "one",
+		Operation:  OperationAdd,
+		State:      StateCreating,
+		Class:      "gp2",
+		InstanceID: "i-1",
+		Created:    now,
+	}
+	remove := &Entry{
+		ID:         "two",
+		Operation:  OperationRemove,
+		State:      StateRemoving,
+		Class:      "gp2",
+		InstanceID: "i-2",
+		Devices:    []Device{{ID: "vol-2"}},
+		Created:    now.Add(time.Second),
+	}
+	assert.NoError(t, j.Save(remove))
+	assert.NoError(t, j.Save(add))
+	assert.Error(t, j.Save(&Entry{}))
+
+	// Modifying the entry must not change the journal until saved
+	add.Devices = append(add.Devices, Device{ID: "vol-1", Size: 8})
+	entries, _ = j.Entries()
+	assert.Len(t, entries[0].Devices, 0)
+	add.State = StateAdding
+	assert.NoError(t, j.Save(add))
+
+	// Reload from the file
+	j, err = NewFile(path)
+	assert.NoError(t, err)
+	entries, err = j.Entries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "one", entries[0].ID)
+	assert.Equal(t, StateAdding, entries[0].State)
+	assert.Equal(t, []Device{{ID: "vol-1", Size: 8}}, entries[0].Devices)
+	assert.Equal(t, "two", entries[1].ID)
+	assert.Equal(t, OperationRemove, entries[1].Operation)
+
+	assert.NoError(t, j.Delete("one"))
+	assert.NoError(t, j.Delete("notthere"))
+	j, err = NewFile(path)
+	assert.NoError(t, err)
+	entries, _ = j.Entries()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "two", entries[0].ID)
+
+	// Corrupt file
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = NewFile(path)
+	assert.Error(t, err)
+}
+
+func TestEntryRemoveDevice(t *testing.T) {
+	e := &Entry{
+		Devices: []Device{{ID: "a"}, {ID: "b"}, {ID: "c"}},
+	}
+	e.RemoveDevice("b")
+	assert.Equal(t, []Device{{ID: "a"}, {ID: "c"}}, e.Devices)
+	e.RemoveDevice("x")
+	assert.Len(t, e.Devices, 2)
+}
+
+func TestEntryReplaced(t *testing.T) {
+	j := NewMemory()
+	replace := &Entry{
+		ID:         "one",
+		Operation:  OperationReplace,
+		State:      StateCreating,
+		Class:      "gp2",
+		InstanceID: "i-1",
+		Replaced:   &Device{ID: "vol-1"},
+	}
+	assert.NoError(t, j.Save(replace))
+	replace.Replaced.ID = "vol-2"
+
+	entries, err := j.Entries()
+	assert.NoError(t, err)
+	assert.Equal(t, "vol-1", entries[0].Replaced.ID)
+}
@@ -0,0 +1,85 @@
+/*
+Package journal provides a write-ahead journal of the operations in
+progress by the infrastructure manager
+Copyright 2018 Portworx
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package journal
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory journal. It does not survive a restart of the
+// process, but lets operations which failed halfway be finished on the
+// next reconcile.
+type Memory struct {
+	lock    sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewMemory returns a new in-memory journal
+func NewMemory() *Memory {
+	return &Memory{
+		entries: make(map[string]*Entry),
+	}
+}
+
+// Save creates or updates an entry
+func (m *Memory) Save(e *Entry) error {
+	if len(e.ID) == 0 {
+		return fmt.Errorf("Journal entry id cannot be empty")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	e.Updated = time.Now()
+	m.entries[e.ID] = e.copy()
+	return nil
+}
+
+// Delete removes an entry
+func (m *Memory) Delete(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.entries, id)
+	return nil
+}
+
+// Entries returns a copy of all the entries ordered by creation time
+func (m *Memory) Entries() ([]*Entry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return sortedEntries(m.entries), nil
+}
+
+func sortedEntries(entries map[string]*Entry) []*Entry {
+	list := make([]*Entry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e.copy())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Created.Equal(list[j].Created) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
@@ -119,6 +119,62 @@ func (f *Fake) NodeDelete(instanceID string) error {
 	return nil
 }
 
+// DeviceReplace swaps the failed device for the replacement
+func (f *Fake) DeviceReplace(
+	node *topology.StorageNode,
+	pool *topology.Pool,
+	failed *topology.Device,
+	replacement *topology.Device,
+) error {
+	for _, sn := range f.Topology.Cluster.StorageNodes {
+		if sn.Metadata.ID != node.Metadata.ID {
+			continue
+		}
+		for i, d := range sn.Devices {
+			if d.Metadata.ID == failed.Metadata.ID {
+				r := *replacement
+				r.Class = d.Class
+				r.Pool = d.Pool
+				r.Utilization = d.Utilization
+				r.Health = topology.DeviceHealthy
+				sn.Devices[i] = &r
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Device %s not found on node %s",
+		failed.Metadata.ID,
+		node.Metadata.ID)
+}
+
+// DeviceResize sets the size of the device in the topology and lowers
+// its utilization to match
+func (f *Fake) DeviceResize(
+	node *topology.StorageNode,
+	pool *topology.Pool,
+	device *topology.Device,
+	sizeGb int64,
+) error {
+	for _, sn := range f.Topology.Cluster.StorageNodes {
+		if sn.Metadata.ID != node.Metadata.ID {
+			continue
+		}
+		for _, d := range sn.Devices {
+			if d.Metadata.ID == device.Metadata.ID {
+				// The data used stays the same
+				if sizeGb > 0 {
+					d.Utilization = int(int64(d.Utilization) * d.Size / sizeGb)
+				}
+				d.Size = sizeGb
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Device %s not found on node %s",
+		device.Metadata.ID,
+		node.Metadata.ID)
+}
+
 // DeviceRemove removes a device from the topology
 func (f *Fake) DeviceRemove(
 	node *topology.StorageNode,
@@ -40,3 +40,26 @@ type Interface interface {
 	// from the infrastructure.
 	DeviceRemove(*topology.StorageNode, *topology.Pool, *topology.Device) ([]*topology.Device, error)
 }
+
+// Replacer is implemented by storage providers which can rebuild the
+// data of a failed device onto a new one
+type Replacer interface {
+	// DeviceReplace requests the storage system to rebuild the failed
+	// device onto the replacement and to stop using the failed device.
+	// The replacement is attached to the same node.
+	DeviceReplace(node *topology.StorageNode,
+		pool *topology.Pool,
+		failed *topology.Device,
+		replacement *topology.Device) error
+}
+
+// Resizer is implemented by storage providers which can use the extra
+// capacity of a device grown by the cloud provider
+type Resizer interface {
+	// DeviceResize requests the storage system to use the new size of
+	// the device, in GiB
+	DeviceResize(node *topology.StorageNode,
+		pool *topology.Pool,
+		device *topology.Device,
+		sizeGb int64) error
+}
@@ -28,10 +28,23 @@ func (d *Device) Verify() error {
 	if len(d.Class) == 0 {
 		return fmt.Errorf("Device class type cannot be empty")
 	}
+	switch d.Health {
+	case "", DeviceHealthy, DeviceDegraded, DeviceFailed:
+	default:
+		return fmt.Errorf("Device %s has unknown health %s", d.Metadata.ID, d.Health)
+	}
 	return nil
 }
 
+// Failed returns true if the device must be replaced
+func (d *Device) Failed() bool {
+	return d.Health == DeviceFailed
+}
+
 // String returns a string version of the device. Used to for %v fmt.Print
 func (d *Device) String() string {
+	if d.Health != "" && d.Health != DeviceHealthy {
+		return fmt.Sprintf("D[%s|%dGi|%d|%s] ", d.Class, d.Size, d.Utilization, d.Health)
+	}
 	return fmt.Sprintf("D[%s|%dGi|%d] ", d.Class, d.Size, d.Utilization)
 }
@@ -22,8 +22,8 @@ import (
 
 // Verify returns an error if the pool has any missing data
 func (p *Pool) Verify() error {
-	if p.SetSize == 0 {
-		return fmt.Errorf("Size in pool cannot be zero")
+	if p.SetSize <= 0 {
+		return fmt.Errorf("Size in pool must be greater than zero")
 	}
 	if len(p.Class) == 0 {
 		return fmt.Errorf("Pool class type cannot be empty")
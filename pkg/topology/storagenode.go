@@ -80,11 +80,50 @@ func (n *StorageNode) SetSizeForClass(class *config.Class) (int, *Pool) {
 	return numDisks, p
 }
 
+// SupportsClass returns true if the node accepts devices of the class
+func (n *StorageNode) SupportsClass(class *config.Class) bool {
+	if len(n.Classes) == 0 {
+		return true
+	}
+	for _, name := range n.Classes {
+		if name == class.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Schedulable returns true if storage can be added to the node
+func (n *StorageNode) Schedulable() bool {
+	return n.State == "" || n.State == NodeStateReady
+}
+
+// Removable returns true if storage can be removed from the node
+func (n *StorageNode) Removable() bool {
+	return n.State != NodeStateMaintenance
+}
+
+// HasRoomForClass returns true if a disk set for the class can be
+// attached to the node without going over its device limit
+func (n *StorageNode) HasRoomForClass(class *config.Class) bool {
+	if n.MaxDevices <= 0 {
+		return true
+	}
+	numDisks, _ := n.SetSizeForClass(class)
+	return len(n.Devices)+numDisks <= n.MaxDevices
+}
+
 // Verify returns an error if any data is missing from the StorageNode
 func (n *StorageNode) Verify() error {
 	if len(n.Metadata.ID) == 0 {
 		return fmt.Errorf("Node missing instance metadata id")
 	}
+	switch n.State {
+	case "", NodeStateReady, NodeStateCordoned,
+		NodeStateMaintenance, NodeStateDecommissioning:
+	default:
+		return fmt.Errorf("Node %s has unknown state %s", n.Metadata.ID, n.State)
+	}
 	for _, pool := range n.Pools {
 		if err := pool.Verify(); err != nil {
 			return err
@@ -126,11 +165,41 @@ func (n *StorageNode) DevicesForClass(class *config.Class) []*Device {
 	return devices
 }
 
+// Copy returns a deep copy of the node. Private cookies are shared
+// with the original.
+func (n *StorageNode) Copy() *StorageNode {
+	c := *n
+	if n.Devices != nil {
+		c.Devices = make([]*Device, len(n.Devices))
+		for i, d := range n.Devices {
+			device := *d
+			c.Devices[i] = &device
+		}
+	}
+	if n.Pools != nil {
+		c.Pools = make(map[string]*Pool, len(n.Pools))
+		for name, p := range n.Pools {
+			pool := *p
+			c.Pools[name] = &pool
+		}
+	}
+	if n.Classes != nil {
+		c.Classes = append([]string(nil), n.Classes...)
+	}
+	return &c
+}
+
 // String returns a string representation of the node for fmt.Printf
 func (n *StorageNode) String() string {
 	s := fmt.Sprintf("N[%s|%d]: ",
 		n.Metadata.ID,
 		len(n.Devices))
+	if n.State != "" && n.State != NodeStateReady {
+		s = fmt.Sprintf("N[%s|%d|%s]: ",
+			n.Metadata.ID,
+			len(n.Devices),
+			n.State)
+	}
 	for _, device := range n.Devices {
 		s += device.String()
 	}
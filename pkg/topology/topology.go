@@ -64,6 +64,21 @@ func (t *Topology) Verify() error {
 	return nil
 }
 
+// Copy returns a deep copy of the topology. Private cookies are shared
+// with the original.
+func (t *Topology) Copy() *Topology {
+	c := &Topology{
+		Cluster: StorageCluster{
+			StorageNodes: make([]*StorageNode, len(t.Cluster.StorageNodes)),
+			Private:      t.Cluster.Private,
+		},
+	}
+	for i, n := range t.Cluster.StorageNodes {
+		c.Cluster.StorageNodes[i] = n.Copy()
+	}
+	return c
+}
+
 // NumDevices returns the total number of devices in the topolgy
 func (t *Topology) NumDevices() int {
 	devices := 0
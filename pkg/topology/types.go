@@ -22,6 +22,23 @@ type DeviceMetadata struct {
 	ID string
 }
 
+// DeviceHealth is the health of a device as seen by the storage system
+type DeviceHealth string
+
+const (
+	// DeviceHealthy means the device is working. An empty health is the
+	// same as healthy.
+	DeviceHealthy DeviceHealth = "healthy"
+
+	// DeviceDegraded means the device works with errors or reduced
+	// performance
+	DeviceDegraded DeviceHealth = "degraded"
+
+	// DeviceFailed means the device can no longer be used and must be
+	// replaced
+	DeviceFailed DeviceHealth = "failed"
+)
+
 // Device contains information about the device of the storage system
 type Device struct {
 	// Path of the block device node
@@ -39,6 +56,9 @@ type Device struct {
 	// Utilization of the device as a percentage number
 	Utilization int
 
+	// Health of the device according to the storage system
+	Health DeviceHealth
+
 	// Metadata has cloud identification for the device
 	Metadata DeviceMetadata
 
@@ -66,6 +86,26 @@ type Pool struct {
 	Private interface{}
 }
 
+// NodeState is the lifecycle state of a storage node
+type NodeState string
+
+const (
+	// NodeStateReady lets storage be added to and removed from the node.
+	// An empty state is the same as ready.
+	NodeStateReady NodeState = "ready"
+
+	// NodeStateCordoned stops storage from being added to the node.
+	// Storage can still be removed.
+	NodeStateCordoned NodeState = "cordoned"
+
+	// NodeStateMaintenance stops any change to the storage of the node
+	NodeStateMaintenance NodeState = "maintenance"
+
+	// NodeStateDecommissioning stops storage from being added to the
+	// node and removes all of its devices
+	NodeStateDecommissioning NodeState = "decommissioning"
+)
+
 // InstanceMetadata contains cloud information about the instance
 type InstanceMetadata struct {
 	// ID is the cloud instance ID
@@ -93,6 +133,14 @@ type StorageNode struct {
 	// it defaults to all
 	Classes []string
 
+	// MaxDevices is the maximum number of devices which can be attached
+	// to the node. Zero means there is no limit.
+	MaxDevices int
+
+	// State is the lifecycle state of the node as reported by the
+	// storage system. Empty means ready.
+	State NodeState
+
 	// Private can be used by the storage system as a cookie
 	Private interface{}
 }